@@ -6,7 +6,7 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/tilteng/go-api-router/api_router"
+	"github.com/tilteng/go-api-framework/api_router"
 )
 
 type ApacheLoggerMiddleware struct {
@@ -0,0 +1,347 @@
+package api_framework
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tilteng/go-errors/errors"
+)
+
+var (
+	uuidType     = reflect.TypeOf(UUID{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// Fill in the struct v points to from the request, according to its
+// field tags:
+//
+//	path:"id"          a route var
+//	query:"limit"      a query parameter
+//	header:"X-Tenant"  a request header
+//	body:""            the request body, read with ReadBody()
+//
+// Add ",required" to the name to make a missing value (or an empty
+// body) an error, or a default:"25" tag for a value to use when it's
+// missing. Values are converted to the field's type: strings, bools,
+// ints, floats, UUID, time.Duration, time.Time (RFC 3339), anything
+// implementing encoding.TextUnmarshaler, pointers to those (left nil
+// when missing), and slices of those (from repeated or comma separated
+// values).
+// Untagged embedded structs are bound too.
+//
+// Every problem is returned, each with its source set, as errors
+// suitable for WriteResponse(). nil means success. A struct that can't
+// be bound, like one with a tagged map field, is an internal error.
+func (self *Controller) Bind(ctx context.Context, v interface{}) errors.Errors {
+	rctx := self.RequestContext(ctx)
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("Bind() needs a pointer to a struct, not %T", v))
+	}
+	if err := checkBindType(rv.Elem().Type()); err != nil {
+		rctx.LogErrorf("%s", err)
+		return errors.Errors{ErrInternalServerError.New(rctx, "").SetInternal(err)}
+	}
+	var errs errors.Errors
+	self.bindStruct(rctx, rv.Elem(), &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Returns the source ("path", "query" or "header") and name from a
+// field's tags, or "" if it has none
+func bindTag(field reflect.StructField) (source string, name string, required bool) {
+	for _, source := range []string{"path", "query", "header"} {
+		tag, ok := field.Tag.Lookup(source)
+		if !ok {
+			continue
+		}
+		name, required = parseBindTag(tag)
+		if name == "" {
+			name = field.Name
+		}
+		return source, name, required
+	}
+	return "", "", false
+}
+
+func parseBindTag(tag string) (name string, required bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "required" {
+			required = true
+		}
+	}
+	return parts[0], required
+}
+
+// Results from checkBindType(), by struct type
+var bindTypeErrors sync.Map
+
+// Returns an error if a struct has tagged fields Bind() can't set.
+// Each type is only checked once.
+func checkBindType(t reflect.Type) error {
+	if v, ok := bindTypeErrors.Load(t); ok {
+		// nil is stored for types that are fine
+		err, _ := v.(error)
+		return err
+	}
+	var err error
+	for i := 0; i < t.NumField() && err == nil; i++ {
+		field := t.Field(i)
+		_, is_body := field.Tag.Lookup("body")
+		source, _, _ := bindTag(field)
+		switch {
+		case !is_body && source == "":
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				err = checkBindType(field.Type)
+			}
+		case field.PkgPath != "":
+			err = fmt.Errorf("Can't bind unexported field %s.%s", t, field.Name)
+		case !is_body && !isBindType(field.Type):
+			err = fmt.Errorf(
+				"Can't bind a request value to %s.%s (%s)",
+				t,
+				field.Name,
+				field.Type,
+			)
+		}
+	}
+	bindTypeErrors.Store(t, err)
+	return err
+}
+
+// Whether setBindValue() can set a value of type t
+func isBindType(t reflect.Type) bool {
+	if isBindSlice(t) {
+		t = t.Elem()
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == uuidType || t == durationType || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func (self *Controller) bindStruct(rctx *RequestContext, rv reflect.Value, errs *errors.Errors) {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := rv.Field(i)
+
+		if tag, ok := field.Tag.Lookup("body"); ok {
+			self.bindBody(rctx, tag, fv, errs)
+			continue
+		}
+
+		source, name, required := bindTag(field)
+		if source == "" {
+			if field.Anonymous && fv.Kind() == reflect.Struct {
+				self.bindStruct(rctx, fv, errs)
+			}
+			continue
+		}
+
+		values := rctx.bindValues(source, name)
+		if len(values) == 0 {
+			if def, ok := field.Tag.Lookup("default"); ok {
+				values = []string{def}
+			} else if required {
+				errs.AddError(rctx.newBindError(
+					source,
+					name,
+					fmt.Sprintf("'%s' is required", name),
+				))
+				continue
+			} else {
+				continue
+			}
+		}
+
+		if !setBindValue(fv, values) {
+			errs.AddError(rctx.newBindError(
+				source,
+				name,
+				fmt.Sprintf("'%s' should be %s", name, bindTypeName(fv.Type())),
+			))
+		}
+	}
+}
+
+// An empty body leaves the field alone, unless it's required
+func (self *Controller) bindBody(rctx *RequestContext, tag string, fv reflect.Value, errs *errors.Errors) {
+	_, required := parseBindTag(tag)
+	if ser_rctx := rctx.serializerRequestContext; ser_rctx != nil && ser_rctx.IsBodyEmpty() {
+		if required {
+			errs.AddError(ErrInvalidRequestBody.New(rctx, "A request body is required"))
+		}
+		return
+	}
+	if err := self.ReadBody(rctx, fv.Addr().Interface()); err != nil {
+		errs.AddError(rctx.newBodyDecodeError(err))
+	}
+}
+
+func (self *RequestContext) bindValues(source string, name string) []string {
+	r := self.HTTPRequest()
+	switch source {
+	case "path":
+		if val, ok := self.RouteVar(name); ok {
+			return []string{val}
+		}
+	case "query":
+		return r.URL.Query()[name]
+	case "header":
+		return r.Header[http.CanonicalHeaderKey(name)]
+	}
+	return nil
+}
+
+func (self *RequestContext) newBindError(source string, name string, details string) *errors.Error {
+	switch source {
+	case "path":
+		return self.newInvalidRouteVarError(name, details)
+	case "query":
+		return SetErrorSource(ErrInvalidQueryParameter.New(self, details), &ErrorSource{Parameter: name})
+	}
+	return SetErrorSource(ErrInvalidHeader.New(self, details), &ErrorSource{Header: name})
+}
+
+func isBindSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice &&
+		t.Elem().Kind() != reflect.Uint8 &&
+		!reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// Returns false if a value couldn't be converted
+func setBindValue(fv reflect.Value, values []string) bool {
+	if !isBindSlice(fv.Type()) {
+		return setBindScalar(fv, values[0])
+	}
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	slice := reflect.MakeSlice(fv.Type(), len(items), len(items))
+	for i, item := range items {
+		if !setBindScalar(slice.Index(i), item) {
+			return false
+		}
+	}
+	fv.Set(slice)
+	return true
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func setBindScalar(fv reflect.Value, s string) bool {
+	t := fv.Type()
+	switch {
+	case t.Kind() == reflect.Ptr:
+		elem := reflect.New(t.Elem())
+		if !setBindScalar(elem.Elem(), s) {
+			return false
+		}
+		fv.Set(elem)
+		return true
+	case t == uuidType:
+		uuid := UUIDFromString(s)
+		if uuid == nil {
+			return false
+		}
+		fv.Set(reflect.ValueOf(*uuid))
+		return true
+	case t == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return false
+		}
+		fv.SetInt(int64(d))
+		return true
+	case reflect.PtrTo(t).Implements(textUnmarshalerType):
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)) == nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return false
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return false
+		}
+		fv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return false
+		}
+		fv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return false
+		}
+		fv.SetFloat(f)
+	default:
+		// checkBindType() rules this out
+		return false
+	}
+	return true
+}
+
+// For error messages, like "'limit' should be an integer"
+func bindTypeName(t reflect.Type) string {
+	if isBindSlice(t) {
+		return "a comma separated list, each " + bindTypeName(t.Elem())
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case uuidType:
+		return "a uuid"
+	case durationType:
+		return "a duration, like 1m30s"
+	case timeType:
+		return "an RFC 3339 time"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	}
+	return "a valid " + t.Name()
+}
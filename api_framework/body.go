@@ -0,0 +1,250 @@
+package api_framework
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/serializers_mw"
+	"github.com/tilteng/go-errors/errors"
+)
+
+// Route option to decode JSON bodies strictly: unknown fields, trailing
+// data, and nesting more than max_depth deep (if not 0) are rejected
+// with ErrMalformedRequestBody, and numbers decode as json.Number.
+func (self *Controller) StrictJSONDecodeOpts(max_depth int) *serializers_mw.JSONDecodeOpts {
+	return &serializers_mw.JSONDecodeOpts{
+		DisallowUnknownFields: true,
+		UseNumber:             true,
+		MaxDepth:              max_depth,
+		DisallowTrailingData:  true,
+	}
+}
+
+func (self *Controller) jsonDecodeOptsFromRouteOptions(opts ...interface{}) *serializers_mw.JSONDecodeOpts {
+	if opt, ok := firstRouteOption(opts, (*serializers_mw.JSONDecodeOpts)(nil)).(*serializers_mw.JSONDecodeOpts); ok {
+		return opt
+	}
+	return self.options.JSONDecodeOpts
+}
+
+// Limits on the size of request bodies. ControllerOpts.MaxBodySize and
+// ControllerOpts.MaxDecompressedBodySize are the defaults. Pass as a route
+// option to override them for that route. 0 keeps the default and -1
+// means no limit.
+type BodyLimitOpts struct {
+	// Largest body allowed, as sent
+	MaxSize int64
+	// Largest body allowed after decoding Content-Encoding: gzip
+	MaxDecompressedSize int64
+}
+
+// Route option to set the largest body allowed for a route
+func (self *Controller) BodyLimitOpts(max_size int64) *BodyLimitOpts {
+	return &BodyLimitOpts{MaxSize: max_size}
+}
+
+func (self *Controller) bodyLimitsFromRouteOptions(opts ...interface{}) *BodyLimitOpts {
+	limits := &BodyLimitOpts{
+		MaxSize:             self.options.MaxBodySize,
+		MaxDecompressedSize: self.options.MaxDecompressedBodySize,
+	}
+	if opt, ok := firstRouteOption(opts, (*BodyLimitOpts)(nil)).(*BodyLimitOpts); ok {
+		if opt.MaxSize != 0 {
+			limits.MaxSize = opt.MaxSize
+		}
+		if opt.MaxDecompressedSize != 0 {
+			limits.MaxDecompressedSize = opt.MaxDecompressedSize
+		}
+	}
+	return limits
+}
+
+// The request body, with limits applied and Content-Encoding decoded.
+// Reads fail with a *RequestError once there's a problem.
+type requestBody struct {
+	io.Closer
+	ctx    context.Context
+	reader io.Reader
+	err    *errors.Error
+}
+
+var requestBodyCtxKey = &contextKey{"request_body"}
+
+func (self *requestBody) Read(b []byte) (int, error) {
+	if self.err != nil {
+		return 0, &RequestError{self.err}
+	}
+	n, err := self.reader.Read(b)
+	if self.err != nil {
+		return n, &RequestError{self.err}
+	}
+	return n, err
+}
+
+func (self *requestBody) fail(class *errors.ErrorClass, details string) error {
+	if self.err == nil {
+		self.err = class.New(self.ctx, details)
+	}
+	return &RequestError{self.err}
+}
+
+// Fails once more than max bytes are read
+type limitedReader struct {
+	body      *requestBody
+	reader    io.Reader
+	remaining int64
+	max       int64
+	what      string
+}
+
+func (self *limitedReader) Read(b []byte) (int, error) {
+	if self.remaining < 0 {
+		return 0, self.tooLarge()
+	}
+	// Read one more than allowed, so we know when it's exceeded
+	if int64(len(b)) > self.remaining+1 {
+		b = b[:self.remaining+1]
+	}
+	n, err := self.reader.Read(b)
+	self.remaining -= int64(n)
+	if self.remaining < 0 {
+		return n + int(self.remaining), self.tooLarge()
+	}
+	return n, err
+}
+
+func (self *limitedReader) tooLarge() error {
+	return self.body.fail(
+		ErrRequestBodyTooLarge,
+		fmt.Sprintf("%s exceeds the limit of %d bytes", self.what, self.max),
+	)
+}
+
+// Decodes gzip, starting on the first read
+type gzipBodyReader struct {
+	body       *requestBody
+	compressed io.Reader
+	reader     *gzip.Reader
+}
+
+func (self *gzipBodyReader) Read(b []byte) (int, error) {
+	if self.reader == nil {
+		reader, err := gzip.NewReader(self.compressed)
+		if err != nil {
+			return 0, self.invalid(err)
+		}
+		self.reader = reader
+	}
+	n, err := self.reader.Read(b)
+	if err != nil && err != io.EOF {
+		return n, self.invalid(err)
+	}
+	return n, err
+}
+
+func (self *gzipBodyReader) invalid(err error) error {
+	if self.body.err != nil {
+		// Most likely the compressed body was too large
+		return &RequestError{self.body.err}
+	}
+	return self.body.fail(
+		ErrInvalidRequestBody,
+		fmt.Sprintf("Could not decode gzip request body: %s", err),
+	)
+}
+
+// Wrap the request body to enforce size limits and decode gzip. This
+// runs before any middleware, so nothing reads more than the limits.
+func (self *Controller) limitRequestBody(ctx context.Context, limits *BodyLimitOpts) context.Context {
+	rctx := self.Router.RequestContext(ctx)
+	r := rctx.HTTPRequest()
+	if r.Body == nil || r.Body == http.NoBody {
+		return ctx
+	}
+
+	body := &requestBody{Closer: r.Body, ctx: rctx, reader: r.Body}
+
+	if limits.MaxSize > 0 {
+		if r.ContentLength > limits.MaxSize {
+			body.fail(
+				ErrRequestBodyTooLarge,
+				fmt.Sprintf(
+					"Content-Length of %d exceeds the limit of %d bytes",
+					r.ContentLength,
+					limits.MaxSize,
+				),
+			)
+		}
+		body.reader = &limitedReader{
+			body:      body,
+			reader:    body.reader,
+			remaining: limits.MaxSize,
+			max:       limits.MaxSize,
+			what:      "Request body",
+		}
+	}
+
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		body.reader = &gzipBodyReader{body: body, compressed: body.reader}
+		if limits.MaxDecompressedSize > 0 {
+			body.reader = &limitedReader{
+				body:      body,
+				reader:    body.reader,
+				remaining: limits.MaxDecompressedSize,
+				max:       limits.MaxDecompressedSize,
+				what:      "Decompressed request body",
+			}
+		}
+		// Everything after us sees the decoded body
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+	default:
+		body.fail(
+			ErrUnsupportedContentEncoding,
+			fmt.Sprintf("Content-Encoding '%s' is not supported", encoding),
+		)
+	}
+
+	rctx.SetBody(body)
+	return context.WithValue(ctx, requestBodyCtxKey, body)
+}
+
+// The error from reading the request body, if it was too large or
+// couldn't be decoded
+func (self *RequestContext) requestBodyError() *errors.Error {
+	if body, ok := self.Value(requestBodyCtxKey).(*requestBody); ok {
+		return body.err
+	}
+	return nil
+}
+
+// An ErrMalformedRequestBody for a deserializer error, pointing at the
+// offending value when it's known. Errors from reading the body, like
+// it being too large, are returned in its place, as are form limits.
+func (self *RequestContext) newBodyDecodeError(err error) *errors.Error {
+	if body_err := self.requestBodyError(); body_err != nil {
+		return body_err
+	}
+	switch e := err.(type) {
+	case *RequestError:
+		if api_err, ok := e.ErrorType.(*errors.Error); ok {
+			return api_err
+		}
+	case *serializers_mw.FormLimitError:
+		return ErrRequestBodyTooLarge.New(self, e.Error())
+	case *serializers_mw.JSONDecodeError:
+		api_err := ErrMalformedRequestBody.New(self, e.Err.Error())
+		if e.Pointer != "" {
+			SetErrorSource(api_err, &ErrorSource{Pointer: e.Pointer})
+		}
+		return api_err
+	}
+	return ErrMalformedRequestBody.New(self, err.Error())
+}
@@ -0,0 +1,73 @@
+package api_framework
+
+import (
+	"compress/gzip"
+	"context"
+
+	"github.com/tilteng/go-api-framework/api_router"
+)
+
+// Configures gzip/deflate response compression, negotiated from
+// Accept-Encoding. Set ControllerOpts.Compression to enable it. Passed as
+// a route option, it overrides the controller's settings for that route.
+type CompressionOpts struct {
+	// Smaller responses aren't compressed. Default 1024
+	MinSize int
+	// gzip/flate compression level. Default gzip.DefaultCompression
+	Level int
+	// Don't compress this route's responses
+	Disable bool
+}
+
+// Route option to turn off compression for a route
+func (self *Controller) NoCompressionOpts() *CompressionOpts {
+	return &CompressionOpts{Disable: true}
+}
+
+type compressionWrapper struct {
+	minSize int
+	level   int
+}
+
+func (self *compressionWrapper) Wrap(next api_router.RouteFn) api_router.RouteFn {
+	return func(ctx context.Context) {
+		rctx := api_router.RequestContextFromContext(ctx)
+		writer := rctx.ResponseWriter()
+		writer.Header().Add("Vary", "Accept-Encoding")
+		encoding := api_router.NegotiateContentEncoding(rctx.Header("Accept-Encoding"))
+		if encoding != "" {
+			writer.EnableCompression(encoding, self.minSize, self.level)
+		}
+		next(ctx)
+		// Finish here, so the metrics and loggers see the final size
+		writer.FinishCompression()
+	}
+}
+
+func (self *Controller) newCompressionWrapper(ctx context.Context, opts ...interface{}) Middleware {
+	base := self.options.Compression
+	if base == nil || base.Disable {
+		return nil
+	}
+
+	wrapper := &compressionWrapper{minSize: base.MinSize, level: base.Level}
+	if opt, ok := firstRouteOption(opts, (*CompressionOpts)(nil)).(*CompressionOpts); ok {
+		if opt.Disable {
+			return nil
+		}
+		if opt.MinSize != 0 {
+			wrapper.minSize = opt.MinSize
+		}
+		if opt.Level != 0 {
+			wrapper.level = opt.Level
+		}
+	}
+
+	if wrapper.minSize <= 0 {
+		wrapper.minSize = 1024
+	}
+	if wrapper.level == 0 {
+		wrapper.level = gzip.DefaultCompression
+	}
+	return wrapper
+}
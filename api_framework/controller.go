@@ -4,18 +4,20 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
-	"github.com/tilteng/go-api-jsonschema/jsonschema_mw"
-	"github.com/tilteng/go-api-panichandler/panichandler_mw"
-	"github.com/tilteng/go-api-request-logger/request_logger_mw"
-	"github.com/tilteng/go-api-router/api_router"
-	"github.com/tilteng/go-api-serializers/serializers_mw"
+	"github.com/tilteng/go-api-framework/apache_logger_mw"
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-api-framework/jsonapi"
+	"github.com/tilteng/go-api-framework/jsonschema_mw"
+	"github.com/tilteng/go-api-framework/metrics_mw"
+	"github.com/tilteng/go-api-framework/panichandler_mw"
+	"github.com/tilteng/go-api-framework/request_logger_mw"
+	"github.com/tilteng/go-api-framework/serializers_mw"
 	"github.com/tilteng/go-app-context/app_context"
 	"github.com/tilteng/go-errors/errors"
-	"github.com/tilteng/go-logger/apache_logger_mw"
 	"github.com/tilteng/go-logger/logger"
-	"github.com/tilteng/go-metrics/metrics_mw"
 	"github.com/tilteng/go-request-tracing/request_tracing"
 )
 
@@ -33,12 +35,17 @@ type ErrorFormatter interface {
 
 type ControllerOpts struct {
 	// Used only for Link: header responses for json schema
-	BaseAPIURL             string
-	BaseRouter             *api_router.Router
-	ConsumesContent        []string
-	ProducesContent        []string
-	JSONSchemaRoutePath    string
-	JSONSchemaFilePath     string
+	BaseAPIURL          string
+	BaseRouter          *api_router.Router
+	ConsumesContent     []string
+	ProducesContent     []string
+	JSONSchemaRoutePath string
+	JSONSchemaFilePath  string
+	// If set, JSONSchemaFilePath is checked this often and changed
+	// schemas are reloaded. Meant for development.
+	JSONSchemaReloadInterval time.Duration
+	// If set, serve an OpenAPI 3 document describing all routes here
+	OpenAPIRoutePath       string
 	JSONSchemaErrorHandler jsonschema_mw.ErrorHandler
 	PanicHandler           panichandler_mw.PanicHandler
 	SerializerErrorHandler serializers_mw.ErrorHandler
@@ -47,6 +54,44 @@ type ControllerOpts struct {
 	ErrorFormatter         ErrorFormatter
 	RequestTraceManager    request_tracing.RequestTraceManager
 	RequestLoggerOpts      *request_logger_mw.RequestLoggerOpts
+	// If set, routes can be registered per API version. See APIVersion()
+	APIVersioning *APIVersioningOpts
+	// Serializers for this controller only, in addition to those
+	// registered with serializers_mw.RegisterSerializer(). Every
+	// ConsumesContent and ProducesContent type needs a serializer.
+	Serializers []serializers_mw.Serializer
+	// If set, responses are compressed when Accept-Encoding allows
+	Compression *CompressionOpts
+	// Largest request body allowed, before and after decoding
+	// Content-Encoding: gzip. 0 means no limit. See BodyLimitOpts.
+	MaxBodySize             int64
+	MaxDecompressedBodySize int64
+	// How JSON request bodies are decoded. Pass a
+	// *serializers_mw.JSONDecodeOpts as a route option to replace this
+	// for that route. See StrictJSONDecodeOpts().
+	JSONDecodeOpts *serializers_mw.JSONDecodeOpts
+	// Validate responses against JSONSchemaOpts.ResponseSchemas. Off if
+	// nil.
+	ResponseValidation *ResponseValidationOpts
+	// Page sizes and strategy for RequestContext.Page(). See
+	// PaginationOpts.
+	Pagination *PaginationOpts
+	// Key for signing page cursors. If not set, a random one is made in
+	// Init(), so cursors won't survive a restart or work across
+	// instances, and a warning is logged when a route uses
+	// CursorPagination.
+	CursorSecret []byte
+
+	// Used by Run(). If 0, AppContext.ServicePort() is used.
+	ServicePort       int
+	ServerReadTimeout time.Duration
+	// Limits how long a response may take to write, including a
+	// Stream(). 0 means no limit.
+	ServerWriteTimeout time.Duration
+	ServerIdleTimeout  time.Duration
+	// How long to wait for in-flight requests to finish on shutdown. This
+	// is also the limit for running shutdown hooks. 0 means wait forever.
+	ShutdownTimeout time.Duration
 
 	// We pull metrics, rollbar, and logger from AppContext
 	AppContext app_context.AppContext
@@ -65,6 +110,15 @@ type Controller struct {
 	ApacheLoggerMiddleware  *apache_logger_mw.ApacheLoggerMiddleware
 	MetricsMiddleware       *metrics_mw.MetricsMiddleware
 	RequestLoggerMiddleware *request_logger_mw.RequestLoggerMiddleware
+	middlewares             []*middlewareEntry
+	routesLock              sync.Mutex
+	registeredRoutes        []*registeredRoute
+	serverLock              sync.Mutex
+	server                  *runningServer
+	shutdownHooks           []ShutdownHook
+	apiVersionGroups        map[string]*RouteGroup
+	cursorKey               []byte
+	cursorKeyWarning        sync.Once
 }
 
 func (self *Controller) GenUUID() *UUID {
@@ -83,17 +137,48 @@ func (self *Controller) JSONSchemaOpts(name string) *jsonschema_mw.JSONSchemaOpt
 	return &jsonschema_mw.JSONSchemaOpts{Name: name}
 }
 
+// Deserialize the request body into v. If the body is too large or
+// can't be decoded, the error is a *RequestError that can be passed to
+// WriteResponse().
 func (self *Controller) ReadBody(ctx context.Context, v interface{}) error {
 	rctx := self.RequestContext(ctx)
-	return rctx.serializerRequestContext.ReadDeserializedBody(rctx, v)
+	var err error
+	if jsonapi.IsResource(v) {
+		err = self.readJSONAPIBody(rctx, v)
+	} else {
+		err = rctx.serializerRequestContext.ReadDeserializedBody(rctx, v)
+	}
+	if err == nil {
+		return nil
+	}
+	return &RequestError{rctx.newBodyDecodeError(err)}
 }
 
 func (self *Controller) WriteResponse(ctx context.Context, v interface{}) error {
 	rctx := self.RequestContext(ctx)
+	if req_err, ok := v.(*RequestError); ok {
+		v = req_err.ErrorType
+	}
 	if tilterr, ok := v.(errors.ErrorType); ok {
 		status := tilterr.GetStatus()
 		rctx.SetStatus(status)
 		v = self.errorFormatter.FormatErrors(ctx, tilterr)
+	} else {
+		links := rctx.paginationLinks()
+		if jsonapi.IsResource(v) {
+			doc, err := self.jsonAPIDocument(rctx, v)
+			if err != nil {
+				return self.WriteResponse(rctx, err)
+			}
+			if len(links) != 0 && doc.Links == nil {
+				doc.Links = jsonapi.Links{}
+			}
+			for rel, href := range links {
+				doc.Links[rel] = href
+			}
+			v = doc
+		}
+		rctx.setPaginationHeader(links)
 	}
 
 	rctx.SetResponseHeader(
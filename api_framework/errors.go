@@ -4,7 +4,8 @@ import (
 	"context"
 
 	"github.com/comstud/go-rollbar/rollbar"
-	"github.com/tilteng/go-api-jsonschema/jsonschema_mw"
+	"github.com/tilteng/go-api-framework/jsonschema_mw"
+	"github.com/tilteng/go-api-framework/serializers_mw"
 	"github.com/tilteng/go-errors/errors"
 )
 
@@ -12,13 +13,204 @@ var ErrInternalServerError = errors.ErrInternalServerError
 var ErrJSONSchemaValidationFailed = errors.ErrJSONSchemaValidationFailed
 var ErrRouteNotFound = errors.ErrRouteNotFound
 
+// A route exists for the path, but not for the method
+var ErrMethodNotAllowed = errors.NewErrorClass(
+	"ErrMethodNotAllowed",
+	"ERR_ID_METHOD_NOT_ALLOWED",
+	405,
+	"That method is not allowed for this route",
+)
+
+// A route var didn't satisfy its constraint or couldn't be converted
+var ErrInvalidRouteParameter = errors.NewErrorClass(
+	"ErrInvalidRouteParameter",
+	"ERR_ID_INVALID_ROUTE_PARAMETER",
+	400,
+	"Invalid route parameter",
+)
+
+// A query parameter was malformed or named something that doesn't exist
+var ErrInvalidQueryParameter = errors.NewErrorClass(
+	"ErrInvalidQueryParameter",
+	"ERR_ID_INVALID_QUERY_PARAMETER",
+	400,
+	"Invalid query parameter",
+)
+
+// A request header was malformed or missing
+var ErrInvalidHeader = errors.NewErrorClass(
+	"ErrInvalidHeader",
+	"ERR_ID_INVALID_HEADER",
+	400,
+	"Invalid request header",
+)
+
+// A page cursor wasn't one we made, or was tampered with
+var ErrInvalidPageCursor = errors.NewErrorClass(
+	"ErrInvalidPageCursor",
+	"ERR_ID_INVALID_PAGE_CURSOR",
+	400,
+	"Invalid page cursor",
+)
+
+// The request asked for an API version that doesn't exist
+var ErrUnsupportedAPIVersion = errors.NewErrorClass(
+	"ErrUnsupportedAPIVersion",
+	"ERR_ID_UNSUPPORTED_API_VERSION",
+	400,
+	"That API version is not supported",
+)
+
+// The request body is bigger than allowed
+var ErrRequestBodyTooLarge = errors.NewErrorClass(
+	"ErrRequestBodyTooLarge",
+	"ERR_ID_REQUEST_BODY_TOO_LARGE",
+	413,
+	"The request body is too large",
+)
+
+// The request body has a Content-Encoding we can't decode
+var ErrUnsupportedContentEncoding = errors.NewErrorClass(
+	"ErrUnsupportedContentEncoding",
+	"ERR_ID_UNSUPPORTED_CONTENT_ENCODING",
+	415,
+	"That Content-Encoding is not supported",
+)
+
+// The request body is missing, or couldn't be decoded according to its
+// Content-Encoding
+var ErrInvalidRequestBody = errors.NewErrorClass(
+	"ErrInvalidRequestBody",
+	"ERR_ID_INVALID_REQUEST_BODY",
+	400,
+	"The request body could not be decoded",
+)
+
+// The request body isn't valid for its Content-Type, or doesn't fit
+// what it's read into. Eg, bad JSON, or JSON an option like
+// JSONDecodeOpts.MaxDepth rejects.
+var ErrMalformedRequestBody = errors.NewErrorClass(
+	"ErrMalformedRequestBody",
+	"ERR_ID_MALFORMED_REQUEST_BODY",
+	400,
+	"The request body is malformed",
+)
+
+// A response didn't match the JSON schema declared for it
+var ErrResponseValidationFailed = errors.NewErrorClass(
+	"ErrResponseValidationFailed",
+	"ERR_ID_RESPONSE_VALIDATION_FAILED",
+	500,
+	"The response did not match its schema",
+)
+
+// The part of the request an error is about, for the JSON:API error
+// source object. It's kept in the error's Metadata under "source", and
+// the default error formatter moves it from meta to source.
+type ErrorSource struct {
+	// A JSON pointer into the request body, eg "/data/attributes/name"
+	Pointer string `json:"pointer,omitempty"`
+	// A query or route parameter
+	Parameter string `json:"parameter,omitempty"`
+	// A request header
+	Header string `json:"header,omitempty"`
+}
+
+const errorSourceMetadataKey = "source"
+
+// Set the source of err. Any other Metadata is kept, so set this after
+// SetMetadata().
+func SetErrorSource(err *errors.Error, source *ErrorSource) *errors.Error {
+	if err.Metadata == nil {
+		err.Metadata = map[string]interface{}{}
+	}
+	err.Metadata[errorSourceMetadataKey] = source
+	return err
+}
+
+func errorSource(err *errors.Error) *ErrorSource {
+	source, _ := err.Metadata[errorSourceMetadataKey].(*ErrorSource)
+	return source
+}
+
+// An errors.ErrorType that satisfies error, for functions like
+// ReadBody() that return an error. It can be passed to WriteResponse()
+// as is.
+type RequestError struct {
+	errors.ErrorType
+}
+
+func (self *RequestError) Error() string {
+	if details := self.GetDetails(); details != "" {
+		return self.GetName() + ": " + details
+	}
+	return self.GetName() + ": " + self.GetTitle()
+}
+
+type jsonAPIError struct {
+	ID     string                    `json:"id"`
+	Status int                       `json:"status,string"`
+	Links  *errors.JSONAPIErrorLinks `json:"links,omitempty"`
+	Code   string                    `json:"code,omitempty"`
+	Title  string                    `json:"title,omitempty"`
+	Detail string                    `json:"detail,omitempty"`
+	Source *ErrorSource              `json:"source,omitempty"`
+	Meta   errors.JSONAPIErrorMeta   `json:"meta,omitempty"`
+}
+
+type jsonAPIErrorResponse struct {
+	Errors []*jsonAPIError `json:"errors"`
+}
+
+// Like AsJSONAPIResponse(), with sources moved out of meta
+func newJSONAPIErrorResponse(errtype errors.ErrorType) interface{} {
+	var errs errors.Errors
+	switch e := errtype.(type) {
+	case *errors.Error:
+		errs = errors.Errors{e}
+	case errors.Errors:
+		errs = e
+	default:
+		return errtype.AsJSONAPIResponse()
+	}
+	resp := &jsonAPIErrorResponse{Errors: make([]*jsonAPIError, len(errs))}
+	for i, err := range errs {
+		jsonapi_err := err.AsJSONAPIError()
+		resp.Errors[i] = &jsonAPIError{
+			ID:     jsonapi_err.ID,
+			Status: jsonapi_err.Status,
+			Links:  jsonapi_err.Links,
+			Code:   jsonapi_err.Code,
+			Title:  jsonapi_err.Title,
+			Detail: jsonapi_err.Detail,
+			Meta:   jsonapi_err.Meta,
+		}
+		source := errorSource(err)
+		if source == nil {
+			continue
+		}
+		resp.Errors[i].Source = source
+		meta := errors.JSONAPIErrorMeta{}
+		for k, v := range jsonapi_err.Meta {
+			if k != errorSourceMetadataKey {
+				meta[k] = v
+			}
+		}
+		if len(meta) == 0 {
+			meta = nil
+		}
+		resp.Errors[i].Meta = meta
+	}
+	return resp
+}
+
 // Called to format an error or errors. Pass to custom callback, if set.
 func (self *Controller) formatErrors(ctx context.Context, errtype errors.ErrorType) interface{} {
 	rctx := self.RequestContext(ctx)
 	if self.options.ErrorFormatter != nil {
 		return self.options.ErrorFormatter.FormatErrors(rctx, errtype)
 	}
-	return errtype.AsJSONAPIResponse()
+	return newJSONAPIErrorResponse(errtype)
 }
 
 // Called when a panic occurs. Pass to custom callback, if set.
@@ -60,7 +252,15 @@ func (self *Controller) handleSerializerError(ctx context.Context, err error) {
 		return
 	}
 
-	rctx.SetStatus(500)
+	// We can't serialize an error object without a serializer
+	switch err.(type) {
+	case *serializers_mw.UnsupportedMediaTypeError:
+		rctx.SetStatus(415)
+	case *serializers_mw.NotAcceptableError:
+		rctx.SetStatus(406)
+	default:
+		rctx.SetStatus(500)
+	}
 	rctx.WriteResponseString(err.Error())
 }
 
@@ -73,9 +273,19 @@ func (self *Controller) handleJSONSchemaError(ctx context.Context, result *jsons
 		return self.options.JSONSchemaErrorHandler.Error(rctx, result)
 	}
 
+	// The body couldn't be decoded, so there's nothing to validate
+	if decode_err := result.DecodeError(); decode_err != nil {
+		self.WriteResponse(rctx, rctx.newBodyDecodeError(decode_err))
+		return false
+	}
+
 	json_errors := result.Errors()
 	api_errors := make(errors.Errors, 0, len(json_errors))
 	for _, json_err := range json_errors {
+		if result_err := json_err.ResultError(); result_err != nil {
+			api_errors.AddError(rctx.newSchemaValidationError(result.Source(), result_err))
+			continue
+		}
 		err := ErrJSONSchemaValidationFailed.New(rctx, "")
 		err.Details = json_err.String()
 		api_errors.AddError(err)
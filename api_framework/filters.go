@@ -0,0 +1,352 @@
+package api_framework
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tilteng/go-errors/errors"
+)
+
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterInt
+	FilterFloat
+	FilterBool
+	// RFC 3339
+	FilterTime
+	FilterUUID
+)
+
+type FilterOp string
+
+const (
+	FilterEq     FilterOp = "eq"
+	FilterIn     FilterOp = "in"
+	FilterLt     FilterOp = "lt"
+	FilterGt     FilterOp = "gt"
+	FilterPrefix FilterOp = "prefix"
+)
+
+var filterSQLOps = map[FilterOp]string{
+	FilterEq: "=",
+	FilterLt: "<",
+	FilterGt: ">",
+}
+
+// A field a list route can filter or sort on
+type FilterField struct {
+	Type FilterType
+	// Operators allowed with filter[name][op]=. filter[name]= is eq. No
+	// operators means the field can't be filtered on.
+	Ops      []FilterOp
+	Sortable bool
+	// Used by FilterQuery.SQL(). The field name if "".
+	Column string
+}
+
+func (self *FilterField) allows(op FilterOp) bool {
+	for _, allowed := range self.Ops {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *FilterField) column(name string) string {
+	if self.Column != "" {
+		return self.Column
+	}
+	return name
+}
+
+// Route option declaring the filter[...] and sort= query parameters a
+// route accepts. Anything else gets a 400 before the route is called.
+// See RequestContext.FilterQuery().
+type FilterOpts struct {
+	Fields map[string]*FilterField
+	// Used when sort= isn't given. Same syntax, like "-created".
+	DefaultSort string
+}
+
+func filterOptsFromRouteOptions(opts ...interface{}) *FilterOpts {
+	opt, ok := firstRouteOption(opts, (*FilterOpts)(nil)).(*FilterOpts)
+	if !ok {
+		return nil
+	}
+	opt.check()
+	return opt
+}
+
+// Panics if a field allows an operator it can't be filtered with, so
+// that's found when the route is added
+func (self *FilterOpts) check() {
+	for name, field := range self.Fields {
+		for _, op := range field.Ops {
+			switch op {
+			case FilterIn:
+			case FilterPrefix:
+				if field.Type != FilterString {
+					panic(fmt.Errorf("Filter field '%s' allows '%s', which only works with FilterString", name, op))
+				}
+			default:
+				if _, ok := filterSQLOps[op]; !ok {
+					panic(fmt.Errorf("Filter field '%s' allows unknown operator '%s'", name, op))
+				}
+			}
+		}
+	}
+}
+
+type Filter struct {
+	Field  string
+	Column string
+	Op     FilterOp
+	// string, int64, float64, bool, or time.Time according to the
+	// field's type. UUIDs are strings. For FilterIn, a []interface{} of
+	// those.
+	Value interface{}
+}
+
+type SortField struct {
+	Field      string
+	Column     string
+	Descending bool
+}
+
+// Parsed filter[...] and sort= query parameters. Filters are sorted by
+// field, then operator.
+type FilterQuery struct {
+	Filters []*Filter
+	Sort    []*SortField
+}
+
+// Filters on a field, if any
+func (self *FilterQuery) FiltersFor(field string) []*Filter {
+	var filters []*Filter
+	for _, filter := range self.Filters {
+		if filter.Field == field {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+func parseFilterValue(typ FilterType, s string) (interface{}, error) {
+	switch typ {
+	case FilterInt:
+		return strconv.ParseInt(s, 10, 64)
+	case FilterFloat:
+		return strconv.ParseFloat(s, 64)
+	case FilterBool:
+		return strconv.ParseBool(s)
+	case FilterTime:
+		return time.Parse(time.RFC3339, s)
+	case FilterUUID:
+		uuid := UUIDFromString(s)
+		if uuid == nil {
+			return nil, fmt.Errorf("not a uuid")
+		}
+		return uuid.String(), nil
+	}
+	return s, nil
+}
+
+var filterTypeNames = map[FilterType]string{
+	FilterString: "a string",
+	FilterInt:    "an integer",
+	FilterFloat:  "a number",
+	FilterBool:   "a boolean",
+	FilterTime:   "an RFC 3339 time",
+	FilterUUID:   "a uuid",
+}
+
+func (self *RequestContext) newFilterParamError(param string, details string) *errors.Error {
+	return SetErrorSource(ErrInvalidQueryParameter.New(self, details), &ErrorSource{Parameter: param})
+}
+
+// Parse filter[name]=, filter[name][op]= and sort= according to opts
+func (self *RequestContext) parseFilterQuery(opts *FilterOpts) (*FilterQuery, *errors.Error) {
+	values := self.HTTPRequest().URL.Query()
+	query := &FilterQuery{}
+
+	// In order, so the same query gives the same SQL
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if key == "filter" || strings.HasPrefix(key, "filter[") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// filter[name] or filter[name][op]
+		var parts []string
+		if strings.HasPrefix(key, "filter[") && strings.HasSuffix(key, "]") {
+			parts = strings.Split(key[len("filter["):len(key)-1], "][")
+		}
+		if len(parts) == 0 || len(parts) > 2 || parts[0] == "" {
+			return nil, self.newFilterParamError(
+				key,
+				fmt.Sprintf("Invalid filter parameter '%s', should be filter[FIELD] or filter[FIELD][OP]", key),
+			)
+		}
+		name := parts[0]
+		op := FilterEq
+		if len(parts) == 2 {
+			op = FilterOp(parts[1])
+		}
+
+		field, ok := opts.Fields[name]
+		if !ok || len(field.Ops) == 0 {
+			return nil, self.newFilterParamError(
+				key,
+				fmt.Sprintf("Can't filter on '%s'", name),
+			)
+		}
+		if !field.allows(op) {
+			return nil, self.newFilterParamError(
+				key,
+				fmt.Sprintf("Can't filter on '%s' with '%s'", name, op),
+			)
+		}
+
+		if len(values[key]) > 1 {
+			return nil, self.newFilterParamError(
+				key,
+				fmt.Sprintf("'%s' appears more than once", key),
+			)
+		}
+		raw := values.Get(key)
+		filter := &Filter{Field: name, Column: field.column(name), Op: op}
+		switch op {
+		case FilterIn:
+			list := []interface{}{}
+			for _, item := range strings.Split(raw, ",") {
+				value, err := parseFilterValue(field.Type, item)
+				if err != nil {
+					return nil, self.newFilterParamError(
+						key,
+						fmt.Sprintf("'%s' should be a comma separated list, each %s", key, filterTypeNames[field.Type]),
+					)
+				}
+				list = append(list, value)
+			}
+			filter.Value = list
+		case FilterPrefix:
+			filter.Value = raw
+		default:
+			value, err := parseFilterValue(field.Type, raw)
+			if err != nil {
+				return nil, self.newFilterParamError(
+					key,
+					fmt.Sprintf("'%s' should be %s", key, filterTypeNames[field.Type]),
+				)
+			}
+			filter.Value = value
+		}
+		query.Filters = append(query.Filters, filter)
+	}
+
+	sort_str, sort_given := values["sort"]
+	sort_param := opts.DefaultSort
+	if sort_given {
+		if len(sort_str) > 1 {
+			return nil, self.newFilterParamError(
+				"sort",
+				"'sort' appears more than once, use sort=a,b",
+			)
+		}
+		sort_param = sort_str[0]
+	}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(sort_param, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		sort_field := &SortField{}
+		if strings.HasPrefix(name, "-") {
+			sort_field.Descending = true
+			name = name[1:]
+		}
+		field, ok := opts.Fields[name]
+		if !ok || !field.Sortable {
+			return nil, self.newFilterParamError(
+				"sort",
+				fmt.Sprintf("Can't sort on '%s'", name),
+			)
+		}
+		if seen[name] {
+			return nil, self.newFilterParamError(
+				"sort",
+				fmt.Sprintf("'%s' appears more than once in sort", name),
+			)
+		}
+		seen[name] = true
+		sort_field.Field = name
+		sort_field.Column = field.column(name)
+		query.Sort = append(query.Sort, sort_field)
+	}
+
+	return query, nil
+}
+
+// The parsed filter[...] and sort= query parameters. nil if the route
+// has no FilterOpts.
+func (self *RequestContext) FilterQuery() *FilterQuery {
+	return self.filterQuery
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Render as SQL for AppContext.DB(). Placeholders are numbered from
+// first_arg, like $1. where and order_by start with WHERE and ORDER BY,
+// or are "" if there's nothing to filter or sort on.
+func (self *FilterQuery) SQL(first_arg int) (where string, order_by string, args []interface{}) {
+	placeholder := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(first_arg+len(args)-1)
+	}
+
+	conds := make([]string, 0, len(self.Filters))
+	for _, filter := range self.Filters {
+		switch filter.Op {
+		case FilterIn:
+			list := filter.Value.([]interface{})
+			phs := make([]string, len(list))
+			for i, value := range list {
+				phs[i] = placeholder(value)
+			}
+			conds = append(conds, filter.Column+" IN ("+strings.Join(phs, ", ")+")")
+		case FilterPrefix:
+			conds = append(conds, filter.Column+" LIKE "+placeholder(
+				escapeLike(filter.Value.(string))+"%",
+			))
+		default:
+			conds = append(conds, filter.Column+" "+filterSQLOps[filter.Op]+" "+placeholder(filter.Value))
+		}
+	}
+	if len(conds) != 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	orders := make([]string, len(self.Sort))
+	for i, sort_field := range self.Sort {
+		orders[i] = sort_field.Column
+		if sort_field.Descending {
+			orders[i] += " DESC"
+		}
+	}
+	if len(orders) != 0 {
+		order_by = "ORDER BY " + strings.Join(orders, ", ")
+	}
+
+	return where, order_by, args
+}
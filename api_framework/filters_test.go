@@ -0,0 +1,127 @@
+package api_framework
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterQuerySQL(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		query     *FilterQuery
+		first_arg int
+		where     string
+		order_by  string
+		args      []interface{}
+	}{
+		{
+			name:      "empty",
+			query:     &FilterQuery{},
+			first_arg: 1,
+		},
+		{
+			name: "comparisons",
+			query: &FilterQuery{
+				Filters: []*Filter{
+					{Field: "age", Column: "age", Op: FilterGt, Value: int64(2)},
+					{Field: "age", Column: "age", Op: FilterLt, Value: int64(10)},
+					{Field: "created", Column: "created_at", Op: FilterEq, Value: at},
+				},
+			},
+			first_arg: 1,
+			where:     "WHERE age > $1 AND age < $2 AND created_at = $3",
+			args:      []interface{}{int64(2), int64(10), at},
+		},
+		{
+			name: "in",
+			query: &FilterQuery{
+				Filters: []*Filter{
+					{Field: "color", Column: "color", Op: FilterIn, Value: []interface{}{"red", "black"}},
+					{Field: "name", Column: "name", Op: FilterEq, Value: "Sparky"},
+				},
+			},
+			first_arg: 1,
+			where:     "WHERE color IN ($1, $2) AND name = $3",
+			args:      []interface{}{"red", "black", "Sparky"},
+		},
+		{
+			name: "prefix is escaped",
+			query: &FilterQuery{
+				Filters: []*Filter{
+					{Field: "name", Column: "name", Op: FilterPrefix, Value: `50%_off\`},
+				},
+			},
+			first_arg: 1,
+			where:     "WHERE name LIKE $1",
+			args:      []interface{}{`50\%\_off\\%`},
+		},
+		{
+			name: "placeholders after other args",
+			query: &FilterQuery{
+				Filters: []*Filter{
+					{Field: "color", Column: "color", Op: FilterIn, Value: []interface{}{"red"}},
+					{Field: "name", Column: "name", Op: FilterEq, Value: "Sparky"},
+				},
+			},
+			first_arg: 3,
+			where:     "WHERE color IN ($3) AND name = $4",
+			args:      []interface{}{"red", "Sparky"},
+		},
+		{
+			name: "sort only",
+			query: &FilterQuery{
+				Sort: []*SortField{
+					{Field: "created", Column: "created_at", Descending: true},
+					{Field: "name", Column: "name"},
+				},
+			},
+			first_arg: 1,
+			order_by:  "ORDER BY created_at DESC, name",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			where, order_by, args := test.query.SQL(test.first_arg)
+			if where != test.where {
+				t.Errorf("where is %q, want %q", where, test.where)
+			}
+			if order_by != test.order_by {
+				t.Errorf("order_by is %q, want %q", order_by, test.order_by)
+			}
+			if !reflect.DeepEqual(args, test.args) {
+				t.Errorf("args are %#v, want %#v", args, test.args)
+			}
+		})
+	}
+}
+
+func TestFilterOptsCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		field  *FilterField
+		panics bool
+	}{
+		{"string ops", &FilterField{Type: FilterString, Ops: []FilterOp{FilterEq, FilterIn, FilterPrefix}}, false},
+		{"int comparisons", &FilterField{Type: FilterInt, Ops: []FilterOp{FilterEq, FilterLt, FilterGt, FilterIn}}, false},
+		{"unknown op", &FilterField{Type: FilterString, Ops: []FilterOp{"like"}}, true},
+		{"prefix on int", &FilterField{Type: FilterInt, Ops: []FilterOp{FilterPrefix}}, true},
+		{"prefix on time", &FilterField{Type: FilterTime, Ops: []FilterOp{FilterPrefix}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if panicked := recover() != nil; panicked != test.panics {
+					t.Errorf("panicked is %v, want %v", panicked, test.panics)
+				}
+			}()
+			filterOptsFromRouteOptions(&FilterOpts{
+				Fields: map[string]*FilterField{"field": test.field},
+			})
+		})
+	}
+}
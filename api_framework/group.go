@@ -0,0 +1,117 @@
+package api_framework
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/tilteng/go-api-framework/api_router"
+)
+
+// A set of routes under a common path that share default route options
+// and middleware. Routes inherit the group's options and may override
+// them by passing their own. Groups can be nested to any depth.
+type RouteGroup struct {
+	*api_router.Router
+	controller *Controller
+	middleware *groupMiddlewareOpts
+}
+
+// Carried in a group's route options, so that wrapWithMiddleware can
+// find the middleware for every group a route belongs to.
+type groupMiddlewareOpts struct {
+	entries []*middlewareEntry
+	// Set once a route in the group, or a nested group, is wrapped
+	used bool
+}
+
+func (self *groupMiddlewareOpts) add(name MiddlewareStage, mw Middleware) {
+	if mw == nil {
+		panic(fmt.Sprintf("Middleware '%s' must not be nil", name))
+	}
+	if len(name) == 0 {
+		panic("Middleware must have a name")
+	}
+	// Routes are wrapped when they're registered, so earlier routes
+	// would silently go without it
+	if self.used {
+		panic(fmt.Sprintf(
+			"Middleware '%s' must be added to the group before any of its routes are registered",
+			name,
+		))
+	}
+	for _, entry := range self.entries {
+		if entry.stage == name {
+			panic(fmt.Sprintf("Middleware '%s' is already registered on this group", name))
+		}
+	}
+	self.entries = append(self.entries, &middlewareEntry{stage: name, middleware: mw})
+}
+
+func newRouteGroup(controller *Controller, parent *api_router.Router, path string, opts ...interface{}) *RouteGroup {
+	mw_opts := &groupMiddlewareOpts{}
+	return &RouteGroup{
+		Router:     parent.Group(path, append(opts[:len(opts):len(opts)], mw_opts)...),
+		controller: controller,
+		middleware: mw_opts,
+	}
+}
+
+// Create a route group under path. opts are passed to every route in the
+// group, after the route's own options.
+func (self *Controller) Group(path string, opts ...interface{}) *RouteGroup {
+	return newRouteGroup(self, self.Router, path, opts...)
+}
+
+// Create a nested group. It inherits this group's options and
+// middleware.
+func (self *RouteGroup) Group(path string, opts ...interface{}) *RouteGroup {
+	return newRouteGroup(self.controller, self.Router, path, opts...)
+}
+
+// Returns the first option in opts with the same type as like, or nil.
+// Route options list the route's own first, then each group's from the
+// innermost out, so the most specific one wins.
+func firstRouteOption(opts []interface{}, like interface{}) interface{} {
+	t := reflect.TypeOf(like)
+	for _, opt := range opts {
+		if reflect.TypeOf(opt) == t {
+			return opt
+		}
+	}
+	return nil
+}
+
+// Add middleware for routes in this group and its nested groups. Group
+// middleware runs just outside the validation stages (response-validation
+// and jsonschema), outermost group first, in the order added. So it sees
+// requests before they're validated, and its responses are validated like
+// the route's. This must be called before any routes are added to the
+// group or its nested groups. Routes may skip it by name with
+// MiddlewareOpts.
+func (self *RouteGroup) Use(name MiddlewareStage, mw Middleware) *RouteGroup {
+	self.middleware.add(name, mw)
+	return self
+}
+
+// Wrap fn with group middleware found in opts. Route options list the
+// innermost group first.
+func wrapWithGroupMiddleware(ctx context.Context, fn api_router.RouteFn, skip map[MiddlewareStage]bool, opts ...interface{}) api_router.RouteFn {
+	for _, opt_i := range opts {
+		mw_opts, ok := opt_i.(*groupMiddlewareOpts)
+		if !ok {
+			continue
+		}
+		mw_opts.used = true
+		for i := len(mw_opts.entries) - 1; i >= 0; i-- {
+			entry := mw_opts.entries[i]
+			if skip[entry.stage] {
+				continue
+			}
+			if wrapper := entry.wrapperForRoute(ctx, opts...); wrapper != nil {
+				fn = wrapper.Wrap(fn)
+			}
+		}
+	}
+	return fn
+}
@@ -0,0 +1,76 @@
+package api_framework
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/tilteng/go-api-framework/api_router"
+)
+
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return MiddlewareFn(func(next api_router.RouteFn) api_router.RouteFn {
+		return func(ctx context.Context) {
+			*calls = append(*calls, name)
+			next(ctx)
+		}
+	})
+}
+
+// Group middleware sees requests before the validation stages do
+func TestGroupMiddlewareOrder(t *testing.T) {
+	var calls []string
+	controller := &Controller{}
+	for _, stage := range []MiddlewareStage{
+		MiddlewareStagePanicHandler,
+		MiddlewareStageResponseValidation,
+		MiddlewareStageJSONSchema,
+		"last",
+	} {
+		controller.middlewares = append(controller.middlewares, &middlewareEntry{
+			stage:      stage,
+			middleware: recordingMiddleware(string(stage), &calls),
+		})
+	}
+
+	outer := &groupMiddlewareOpts{}
+	outer.add("outer-group", recordingMiddleware("outer-group", &calls))
+	inner := &groupMiddlewareOpts{}
+	inner.add("inner-group-1", recordingMiddleware("inner-group-1", &calls))
+	inner.add("inner-group-2", recordingMiddleware("inner-group-2", &calls))
+
+	fn := controller.wrapWithMiddleware(
+		context.Background(),
+		func(context.Context) { calls = append(calls, "route") },
+		controller.SkipMiddlewareOpts("inner-group-2"),
+		inner,
+		outer,
+	)
+	fn(context.Background())
+
+	want := []string{
+		"panic-handler",
+		"outer-group",
+		"inner-group-1",
+		"response-validation",
+		"jsonschema",
+		"last",
+		"route",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("middleware ran in order %v, want %v", calls, want)
+	}
+}
+
+func TestGroupUseAfterRoutes(t *testing.T) {
+	mw_opts := &groupMiddlewareOpts{}
+	mw_opts.add("first", MiddlewareFn(func(next api_router.RouteFn) api_router.RouteFn { return next }))
+	wrapWithGroupMiddleware(context.Background(), func(context.Context) {}, nil, mw_opts)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("adding middleware after a route was registered didn't panic")
+		}
+	}()
+	mw_opts.add("second", MiddlewareFn(func(next api_router.RouteFn) api_router.RouteFn { return next }))
+}
@@ -5,14 +5,14 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/tilteng/go-api-jsonschema/jsonschema_mw"
-	"github.com/tilteng/go-api-panichandler/panichandler_mw"
-	"github.com/tilteng/go-api-request-logger/request_logger_mw"
-	"github.com/tilteng/go-api-router/api_router"
-	"github.com/tilteng/go-api-serializers/serializers_mw"
+	"github.com/tilteng/go-api-framework/apache_logger_mw"
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-api-framework/jsonschema_mw"
+	"github.com/tilteng/go-api-framework/metrics_mw"
+	"github.com/tilteng/go-api-framework/panichandler_mw"
+	"github.com/tilteng/go-api-framework/request_logger_mw"
+	"github.com/tilteng/go-api-framework/serializers_mw"
 	"github.com/tilteng/go-app-context/app_context"
-	"github.com/tilteng/go-logger/apache_logger_mw"
-	"github.com/tilteng/go-metrics/metrics_mw"
 	"github.com/tilteng/go-request-tracing/request_tracing"
 )
 
@@ -21,8 +21,7 @@ func (self *Controller) setupSchemaRoutes() error {
 		panic("setupSchemaRoutes() called with no middleware or route path")
 	}
 
-	schemas := self.JSONSchemaMiddleware.GetSchemas()
-
+	// Schemas are looked up for each request, as they may be reloaded
 	self.GET(self.options.JSONSchemaRoutePath, func(ctx context.Context) {
 		rctx := self.RequestContext(ctx)
 
@@ -32,77 +31,110 @@ func (self *Controller) setupSchemaRoutes() error {
 
 		prefix := ""
 
-		for k, v := range schemas {
+		for k, v := range self.JSONSchemaMiddleware.GetSchemas() {
 			rctx.WriteResponseString(prefix + fmt.Sprintf(
 				`{ "%s": %s }`, k, v.GetJSONString(),
 			))
 			prefix = ", "
 		}
 		rctx.WriteResponseString("]")
-	})
+	}, &OpenAPIOpts{Exclude: true})
 
 	sr := self.SubRouterForPath(self.options.JSONSchemaRoutePath)
 
-	for k := range schemas {
-		sr.GET("/"+k, func(ctx context.Context) {
-			// We need the closure to have its own value, so we don't
-			// grab the key from the 'range' above.
-			v := schemas[k]
-			rctx := self.RequestContext(ctx)
-			rctx.SetStatus(200)
-			rctx.SetResponseHeader("Content-Type", "application/json+schema")
-			rctx.WriteResponseString(v.GetJSONString())
-		})
-	}
+	sr.GET("/{name:.+}", func(ctx context.Context) {
+		rctx := self.RequestContext(ctx)
+		name, _ := rctx.RouteVar("name")
+		v := self.JSONSchemaMiddleware.GetSchema(name)
+		if v == nil {
+			self.WriteResponse(rctx, ErrRouteNotFound.New(
+				rctx,
+				fmt.Sprintf("There is no schema named '%s'", name),
+			))
+			return
+		}
+		rctx.SetStatus(200)
+		rctx.SetResponseHeader("Content-Type", "application/json+schema")
+		rctx.WriteResponseString(v.GetJSONString())
+	}, &OpenAPIOpts{Exclude: true})
 
 	return nil
 }
 
-// Wrap the original route. We want to achieve this order:
-// metrics -> apache-logger -> serializer -> panic_handler -> jsonschema
+// Reload changed schemas until we shut down
+func (self *Controller) watchSchemas(ctx context.Context, interval time.Duration) {
+	watch_ctx, cancel := context.WithCancel(ctx)
+	go self.JSONSchemaMiddleware.WatchPath(
+		watch_ctx,
+		self.options.JSONSchemaFilePath,
+		interval,
+	)
+	self.AddShutdownHook(ShutdownHookFn(func(context.Context) error {
+		cancel()
+		return nil
+	}))
+	self.logger.LogDebugf(ctx, "Reloading changed json schemas every %s", interval)
+}
+
+// Lets the json schema middleware validate bodies in any format we
+// consume, like msgpack
+func (self *Controller) decodeBodyForJSONSchema(ctx context.Context, body []byte) (interface{}, error) {
+	var doc interface{}
+	if err := serializers_mw.DeserializeBody(ctx, body, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Wrap the original route with the middleware chain. The built-in stages
+// give us this order:
+// metrics -> request-logger -> apache-logger -> compression ->
+// serializer -> panic-handler -> response-validation -> jsonschema
 // Ie, we want the logger to log exactly what is returned after
-// serialization. We want the ability to serialize panic_handler
+// serialization and compression. We want the ability to serialize panic_handler
 // responses. And json schema validation should just happen right
-// before we call the real route handler.
+// before we call the real route handler. Middleware added with Use(),
+// UseBefore(), and UseAfter() is slotted in relative to these.
 func (self *Controller) wrapNewRoute(rt *api_router.Route, opts ...interface{}) {
 	ctx := context.TODO()
 
 	orig_fn := rt.RouteFn()
 
+	jsonapi_opts := jsonAPIOptsFromRouteOptions(opts...)
+	pagination := self.paginationFromRouteOptions(opts...)
+	self.warnRandomCursorKey(ctx, rt, pagination)
+	filter_opts := filterOptsFromRouteOptions(opts...)
+
 	// Create our Request right before calling middleware
 	fn := func(ctx context.Context) {
-		orig_fn(self.RequestContext(ctx))
-	}
-
-	// Wrap with our request last
-
-	if js_mw := self.JSONSchemaMiddleware; js_mw != nil {
-		if wrapper := js_mw.NewWrapperFromRouteOptions(ctx, opts...); wrapper != nil {
-			fn = wrapper.Wrap(fn)
+		rctx := self.RequestContext(ctx)
+		rctx.pagination = pagination
+		if err := rctx.checkAPIVersion(); err != nil {
+			self.WriteResponse(rctx, err)
+			return
 		}
-	}
-
-	if ph_mw := self.PanicHandlerMiddleware; ph_mw != nil {
-		fn = ph_mw.NewWrapper().Wrap(fn)
-	}
-
-	if ser_mw := self.SerializerMiddleware; ser_mw != nil {
-		fn = ser_mw.NewWrapper().Wrap(fn)
-	}
-
-	if log_mw := self.ApacheLoggerMiddleware; log_mw != nil {
-		fn = log_mw.NewWrapper().Wrap(fn)
-	}
-
-	if reqlog_mw := self.RequestLoggerMiddleware; reqlog_mw != nil {
-		if wrapper := reqlog_mw.NewWrapper(ctx, opts...); wrapper != nil {
-			fn = wrapper.Wrap(fn)
+		if jsonapi_opts != nil {
+			if _, err := rctx.checkJSONAPIQuery(jsonapi_opts.Resource); err != nil {
+				self.WriteResponse(rctx, err)
+				return
+			}
 		}
+		if filter_opts != nil {
+			filter_query, err := rctx.parseFilterQuery(filter_opts)
+			if err != nil {
+				self.WriteResponse(rctx, err)
+				return
+			}
+			rctx.filterQuery = filter_query
+		}
+		defer rctx.closeStream()
+		orig_fn(rctx)
 	}
 
-	if metrics_mw := self.MetricsMiddleware; metrics_mw != nil {
-		fn = metrics_mw.NewWrapper().Wrap(fn)
-	}
+	fn = self.wrapWithMiddleware(ctx, fn, opts...)
+
+	body_limits := self.bodyLimitsFromRouteOptions(opts...)
+	json_decode_opts := self.jsonDecodeOptsFromRouteOptions(opts...)
 
 	// Set up request IDs first.
 
@@ -113,6 +145,10 @@ func (self *Controller) wrapNewRoute(rt *api_router.Route, opts ...interface{})
 		)
 		rctx.SetResponseHeader("X-Trace-Id", rt.GetTraceID())
 		rctx.SetResponseHeader("X-Span-Id", rt.GetSpanID())
+		ctx = self.limitRequestBody(ctx, body_limits)
+		if json_decode_opts != nil {
+			ctx = serializers_mw.ContextWithJSONDecodeOpts(ctx, json_decode_opts)
+		}
 		fn(self.requestTraceManager.ContextWithRequestTrace(ctx, rt))
 		// Normally we write this right before any data is written. But
 		// we should set it here also just in case we're returning an
@@ -127,6 +163,8 @@ func (self *Controller) wrapNewRoute(rt *api_router.Route, opts ...interface{})
 
 	rt.SetRouteFn(top_fn)
 
+	self.recordRoute(rt, opts...)
+
 	self.logger.LogDebug(ctx, "Registered route:", rt.Method(), rt.FullPath())
 }
 
@@ -141,6 +179,10 @@ func (self *Controller) Init(ctx context.Context) error {
 	self.appContext = self.options.AppContext
 	self.logger = self.appContext.Logger()
 
+	if err := self.setupCursorKey(); err != nil {
+		return err
+	}
+
 	// Set this early, as we're going to use it to set up our logger
 	self.requestTraceManager = self.options.RequestTraceManager
 	if self.requestTraceManager == nil {
@@ -151,8 +193,13 @@ func (self *Controller) Init(ctx context.Context) error {
 		self.options.BaseRouter = api_router.NewMuxRouter()
 	}
 
+	if self.options.APIVersioning != nil {
+		self.options.APIVersioning.init()
+	}
+
 	self.Router = self.options.BaseRouter
 	self.Router.SetNewRouteNotifier(self.wrapNewRoute)
+	self.Router.SetInvalidRouteVarHandler(self.handleInvalidRouteVar)
 
 	if self.MetricsEnabled() && self.MetricsMiddleware == nil {
 		self.MetricsMiddleware = metrics_mw.NewMiddleware(self.MetricsClient())
@@ -175,7 +222,9 @@ func (self *Controller) Init(ctx context.Context) error {
 		js_mw := jsonschema_mw.NewMiddlewareWithLinkPathPrefix(
 			self.handleJSONSchemaError,
 			route_prefix,
-		).SetLogger(self.Logger())
+		).SetLogger(self.Logger()).
+			SetBodyDecoder(self.decodeBodyForJSONSchema).
+			SetFormReader(serializers_mw.ReadFormValues)
 
 		err := js_mw.LoadFromPath(ctx, self.options.JSONSchemaFilePath)
 		if err != nil {
@@ -184,6 +233,10 @@ func (self *Controller) Init(ctx context.Context) error {
 
 		self.JSONSchemaMiddleware = js_mw
 		self.logger.LogDebug(ctx, "jsonschema middleware is enabled")
+
+		if interval := self.options.JSONSchemaReloadInterval; interval > 0 {
+			self.watchSchemas(ctx, interval)
+		}
 	}
 
 	if self.SerializerMiddleware == nil {
@@ -194,6 +247,14 @@ func (self *Controller) Init(ctx context.Context) error {
 		)
 	}
 
+	for _, serializer := range self.options.Serializers {
+		self.SerializerMiddleware.AddSerializer(serializer)
+	}
+
+	if err := self.SerializerMiddleware.Check(); err != nil {
+		return err
+	}
+
 	if self.ApacheLoggerMiddleware == nil {
 		if self.options.ApacheLogWriter != nil {
 			self.ApacheLoggerMiddleware = apache_logger_mw.NewMiddleware(
@@ -210,6 +271,10 @@ func (self *Controller) Init(ctx context.Context) error {
 		}
 	}
 
+	if self.options.OpenAPIRoutePath != "" {
+		self.setupOpenAPIRoute()
+	}
+
 	if self.RequestLoggerMiddleware == nil && self.options.RequestLoggerOpts != nil {
 		if self.options.RequestLoggerOpts.Logger == nil {
 			self.options.RequestLoggerOpts.Logger = self.Logger()
@@ -227,6 +292,24 @@ func (self *Controller) Init(ctx context.Context) error {
 		))
 	})
 
+	self.Router.Set405Handler(func(ctx context.Context) {
+		rctx := self.RequestContext(ctx)
+		http_req := rctx.HTTPRequest()
+		self.WriteResponse(rctx, ErrMethodNotAllowed.New(
+			rctx,
+			fmt.Sprintf(
+				"Method %s is not allowed for %s. Allowed methods: %s",
+				http_req.Method,
+				http_req.URL.EscapedPath(),
+				rctx.ResponseWriter().Header().Get("Allow"),
+			),
+		))
+	})
+
+	// Registered so that middleware (CORS, etc) also applies to
+	// automatic OPTIONS responses. The router sets the Allow header.
+	self.Router.SetOPTIONSHandler(func(ctx context.Context) {})
+
 	return nil
 }
 
@@ -235,11 +318,17 @@ func NewControllerOpts(app_context app_context.AppContext) *ControllerOpts {
 		panic("app_context must not be nil")
 	}
 	return &ControllerOpts{
-		AppContext:        app_context,
-		BaseAPIURL:        "http://localhost/",
-		ConsumesContent:   []string{"application/json"},
-		ProducesContent:   []string{"application/json"},
-		RequestLoggerOpts: &request_logger_mw.RequestLoggerOpts{},
+		AppContext:              app_context,
+		BaseAPIURL:              "http://localhost/",
+		ConsumesContent:         []string{"application/json"},
+		ProducesContent:         []string{"application/json"},
+		RequestLoggerOpts:       &request_logger_mw.RequestLoggerOpts{},
+		MaxBodySize:             10 << 20,
+		MaxDecompressedBodySize: 100 << 20,
+		ServerReadTimeout:       30 * time.Second,
+		ServerWriteTimeout:      60 * time.Second,
+		ServerIdleTimeout:       120 * time.Second,
+		ShutdownTimeout:         30 * time.Second,
 	}
 }
 
@@ -250,6 +339,7 @@ func NewController(opts *ControllerOpts) *Controller {
 	c := &Controller{
 		options: opts,
 	}
+	c.middlewares = c.newBuiltinMiddlewareEntries()
 	c.errorFormatter = ErrorFormatterFn(c.formatErrors)
 	return c
 }
@@ -0,0 +1,129 @@
+package api_framework
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/jsonapi"
+	"github.com/tilteng/go-errors/errors"
+)
+
+const JSONAPIMediaType = jsonapi.MediaType
+
+// Route option naming the resource a route returns, as a tagged struct
+// such as &Kitten{}. include= and fields[TYPE]= are checked against it
+// before the route is called, so handlers can rely on
+// RequestContext.JSONAPIQuery(). Without it, they're checked when the
+// response is written.
+type JSONAPIOpts struct {
+	Resource interface{}
+}
+
+// Route option for a route returning this JSON:API resource
+func (self *Controller) JSONAPIOpts(resource interface{}) *JSONAPIOpts {
+	if !jsonapi.IsResource(resource) {
+		panic("JSONAPIOpts resource must be a struct with jsonapi tags")
+	}
+	return &JSONAPIOpts{Resource: resource}
+}
+
+func jsonAPIOptsFromRouteOptions(opts ...interface{}) *JSONAPIOpts {
+	for _, opt_i := range opts {
+		if opt, ok := opt_i.(*JSONAPIOpts); ok && opt.Resource != nil {
+			return opt
+		}
+	}
+	return nil
+}
+
+type jsonAPIQuery struct {
+	query *jsonapi.Query
+	err   *errors.Error
+}
+
+func (self *RequestContext) newJSONAPIQueryError(err error) *errors.Error {
+	if query_err, ok := err.(*jsonapi.QueryError); ok {
+		return SetErrorSource(
+			ErrInvalidQueryParameter.New(self, query_err.Message),
+			&ErrorSource{Parameter: query_err.Parameter},
+		)
+	}
+	err_obj := ErrInternalServerError.New(self, "")
+	err_obj.SetInternal(err)
+	return err_obj
+}
+
+// The include= and fields[TYPE]= query parameters, or an
+// ErrInvalidQueryParameter suitable for WriteResponse(). Use
+// Query.Includes() to find out which relationships to load.
+func (self *RequestContext) JSONAPIQuery() (*jsonapi.Query, *errors.Error) {
+	if self.jsonapiQuery == nil {
+		self.jsonapiQuery = &jsonAPIQuery{}
+		query, err := jsonapi.ParseQuery(self.HTTPRequest().URL.Query())
+		if err != nil {
+			self.jsonapiQuery.err = self.newJSONAPIQueryError(err)
+		} else {
+			self.jsonapiQuery.query = query
+		}
+	}
+	return self.jsonapiQuery.query, self.jsonapiQuery.err
+}
+
+// Parse the query and check it against a resource
+func (self *RequestContext) checkJSONAPIQuery(resource interface{}) (*jsonapi.Query, *errors.Error) {
+	query, err := self.JSONAPIQuery()
+	if err != nil {
+		return nil, err
+	}
+	if validate_err := query.Validate(resource); validate_err != nil {
+		self.jsonapiQuery.query = nil
+		self.jsonapiQuery.err = self.newJSONAPIQueryError(validate_err)
+		return nil, self.jsonapiQuery.err
+	}
+	return query, nil
+}
+
+// Build a JSON:API document for a tagged resource, or a slice of them.
+// Self links are built from ControllerOpts.BaseAPIURL, and include= and fields[TYPE]= are applied.
+func (self *Controller) jsonAPIDocument(rctx *RequestContext, v interface{}) (*jsonapi.Document, *errors.Error) {
+	query, err_obj := rctx.checkJSONAPIQuery(v)
+	if err_obj != nil {
+		return nil, err_obj
+	}
+	base_url := strings.TrimRight(self.options.BaseAPIURL, "/")
+	doc, err := jsonapi.Marshal(v, &jsonapi.MarshalOpts{
+		BaseURL: base_url,
+		Include: query.Include,
+		Fields:  query.Fields,
+	})
+	if err != nil {
+		err_obj := ErrInternalServerError.New(rctx, "")
+		err_obj.SetInternal(err)
+		return nil, err_obj
+	}
+	if base_url != "" {
+		doc.Links = jsonapi.Links{
+			"self": base_url + rctx.HTTPRequest().URL.RequestURI(),
+		}
+	}
+	return doc, nil
+}
+
+// Read a JSON:API document into a tagged resource. The body is decoded
+// with the negotiated deserializer first, so any media type we consume
+// works.
+func (self *Controller) readJSONAPIBody(rctx *RequestContext, v interface{}) error {
+	var body interface{}
+	err := rctx.serializerRequestContext.ReadDeserializedBody(rctx, &body)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return &RequestError{ErrMalformedRequestBody.New(rctx, err.Error())}
+	}
+	if err := jsonapi.Unmarshal(data, v); err != nil {
+		return &RequestError{ErrMalformedRequestBody.New(rctx, err.Error())}
+	}
+	return nil
+}
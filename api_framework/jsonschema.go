@@ -0,0 +1,157 @@
+package api_framework
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/jsonschema_mw"
+	"github.com/tilteng/go-errors/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// How a schema validation failure is described in error meta. code is
+// stable, so clients can match on it. keyword is the JSON schema
+// keyword that failed. expected names the ErrorDetails entry holding
+// what the schema wanted.
+type schemaErrorInfo struct {
+	code     string
+	keyword  string
+	expected string
+	// For failures about a property of an object, the ErrorDetails entry
+	// naming it. The pointer is to the property rather than the object.
+	property string
+}
+
+// By gojsonschema error type
+var schemaErrorInfos = map[string]*schemaErrorInfo{
+	"required":                        {code: "required", keyword: "required", property: "property"},
+	"invalid_type":                    {code: "type", keyword: "type", expected: "expected"},
+	"number_any_of":                   {code: "any_of", keyword: "anyOf"},
+	"number_one_of":                   {code: "one_of", keyword: "oneOf"},
+	"number_all_of":                   {code: "all_of", keyword: "allOf"},
+	"number_not":                      {code: "not", keyword: "not"},
+	"missing_dependency":              {code: "dependency", keyword: "dependencies", property: "dependency"},
+	"enum":                            {code: "enum", keyword: "enum", expected: "allowed"},
+	"array_no_additional_items":       {code: "additional_items", keyword: "additionalItems"},
+	"array_min_items":                 {code: "min_items", keyword: "minItems", expected: "min"},
+	"array_max_items":                 {code: "max_items", keyword: "maxItems", expected: "max"},
+	"unique":                          {code: "unique_items", keyword: "uniqueItems"},
+	"array_min_properties":            {code: "min_properties", keyword: "minProperties", expected: "min"},
+	"array_max_properties":            {code: "max_properties", keyword: "maxProperties", expected: "max"},
+	"additional_property_not_allowed": {code: "additional_properties", keyword: "additionalProperties", property: "property"},
+	"invalid_property_pattern":        {code: "pattern_properties", keyword: "patternProperties", expected: "pattern", property: "property"},
+	"string_gte":                      {code: "min_length", keyword: "minLength", expected: "min"},
+	"string_lte":                      {code: "max_length", keyword: "maxLength", expected: "max"},
+	"pattern":                         {code: "pattern", keyword: "pattern", expected: "pattern"},
+	"format":                          {code: "format", keyword: "format", expected: "format"},
+	"multiple_of":                     {code: "multiple_of", keyword: "multipleOf", expected: "multiple"},
+	"number_gte":                      {code: "minimum", keyword: "minimum", expected: "min"},
+	"number_gt":                       {code: "exclusive_minimum", keyword: "exclusiveMinimum", expected: "min"},
+	"number_lte":                      {code: "maximum", keyword: "maximum", expected: "max"},
+	"number_lt":                       {code: "exclusive_maximum", keyword: "exclusiveMaximum", expected: "max"},
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// gojsonschema contexts look like (root).data.attributes.name. Join
+// with a delimiter that can't be confused with a key.
+func schemaErrorPointer(result_err gojsonschema.ResultError, property string) string {
+	parts := strings.Split(result_err.Context().String("\x00"), "\x00")
+	if property != "" {
+		parts = append(parts, property)
+	}
+	ptr := ""
+	// The first part is (root)
+	for _, part := range parts[1:] {
+		ptr += "/" + escapeJSONPointer(part)
+	}
+	return ptr
+}
+
+// The query parameter or header a failure is about. Their schemas are
+// objects, so it's the first property in the context. Failures about
+// the object itself, like a missing property, name it in property.
+func schemaErrorParameter(result_err gojsonschema.ResultError, property string) (name string, in_context bool) {
+	parts := strings.Split(result_err.Context().String("\x00"), "\x00")
+	if len(parts) > 1 {
+		return parts[1], true
+	}
+	return property, false
+}
+
+// An ErrJSONSchemaValidationFailed pointing at the offending value, with
+// the failed keyword and the expected and actual values in meta. For
+// query parameters and headers, the source is the parameter or header.
+func (self *RequestContext) newSchemaValidationError(source jsonschema_mw.JSONSchemaSource, result_err gojsonschema.ResultError) *errors.Error {
+	details := result_err.Details()
+	info, ok := schemaErrorInfos[result_err.Type()]
+	if !ok {
+		info = &schemaErrorInfo{code: result_err.Type(), keyword: result_err.Type()}
+	}
+
+	property := ""
+	if info.property != "" {
+		property, _ = details[info.property].(string)
+	}
+
+	var err *errors.Error
+	var err_source *ErrorSource
+	switch source {
+	case jsonschema_mw.JSONSchemaSourceQuery, jsonschema_mw.JSONSchemaSourceHeader:
+		name, in_context := schemaErrorParameter(result_err, property)
+		if !in_context {
+			// The description already names the property
+			err = ErrJSONSchemaValidationFailed.New(self, result_err.Description())
+		} else {
+			err = ErrJSONSchemaValidationFailed.New(
+				self,
+				fmt.Sprintf("'%s': %s", name, result_err.Description()),
+			)
+		}
+		if name == "" {
+			break
+		}
+		if source == jsonschema_mw.JSONSchemaSourceQuery {
+			err_source = &ErrorSource{Parameter: name}
+		} else {
+			err_source = &ErrorSource{Header: name}
+		}
+	default:
+		err = ErrJSONSchemaValidationFailed.New(self, result_err.String())
+		if ptr := schemaErrorPointer(result_err, property); ptr != "" {
+			err_source = &ErrorSource{Pointer: ptr}
+		}
+	}
+
+	meta := map[string]interface{}{
+		"code":    info.code,
+		"keyword": info.keyword,
+	}
+	if info.expected != "" {
+		meta["expected"] = details[info.expected]
+	}
+	if allowed, ok := details["allowed"].(string); ok && info.code == "enum" {
+		// The JSON encoded enum values, joined with ", "
+		var values []interface{}
+		if json.Unmarshal([]byte("["+allowed+"]"), &values) == nil {
+			meta["expected"] = values
+		}
+	}
+	switch {
+	case source == jsonschema_mw.JSONSchemaSourceHeader:
+		// Headers may hold credentials, so they aren't echoed back
+	case info.code == "type":
+		meta["actual"] = details["given"]
+	case property == "":
+		// Otherwise the value is the object holding the property
+		meta["actual"] = result_err.Value()
+	}
+	err.SetMetadata(meta)
+	if err_source != nil {
+		SetErrorSource(err, err_source)
+	}
+	return err
+}
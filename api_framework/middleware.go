@@ -0,0 +1,279 @@
+package api_framework
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tilteng/go-api-framework/api_router"
+)
+
+// Names of middleware stages. The built-in stages run in this order,
+// outermost first:
+//
+// metrics -> request-logger -> apache-logger -> compression ->
+// serializer -> panic-handler -> (group middleware) ->
+// response-validation -> jsonschema -> route
+type MiddlewareStage string
+
+const (
+	MiddlewareStageMetrics       MiddlewareStage = "metrics"
+	MiddlewareStageRequestLogger MiddlewareStage = "request-logger"
+	MiddlewareStageApacheLogger  MiddlewareStage = "apache-logger"
+	MiddlewareStageCompression   MiddlewareStage = "compression"
+	MiddlewareStageSerializer    MiddlewareStage = "serializer"
+	MiddlewareStagePanicHandler  MiddlewareStage = "panic-handler"
+	// Checks what's written by the stages inside it, including request
+	// validation errors
+	MiddlewareStageResponseValidation MiddlewareStage = "response-validation"
+	MiddlewareStageJSONSchema         MiddlewareStage = "jsonschema"
+)
+
+// Anything that can wrap a route function
+type Middleware interface {
+	Wrap(api_router.RouteFn) api_router.RouteFn
+}
+
+type MiddlewareFn func(api_router.RouteFn) api_router.RouteFn
+
+func (self MiddlewareFn) Wrap(next api_router.RouteFn) api_router.RouteFn {
+	return self(next)
+}
+
+// Middleware that wants to see the options passed to GET(), POST(), etc.
+// NewWrapperFromRouteOptions is called once per route at registration
+// time. Returning nil skips the middleware for that route.
+type RouteOptionsMiddleware interface {
+	Middleware
+	NewWrapperFromRouteOptions(context.Context, ...interface{}) Middleware
+}
+
+// Route option to skip middleware stages for a single route
+type MiddlewareOpts struct {
+	Skip []MiddlewareStage
+}
+
+type middlewareEntry struct {
+	stage      MiddlewareStage
+	middleware Middleware
+	// Set for built-in stages, so that the exported *Middleware fields
+	// on Controller are looked up when a route is registered.
+	builtin func(context.Context, ...interface{}) Middleware
+}
+
+func (self *middlewareEntry) wrapperForRoute(ctx context.Context, opts ...interface{}) Middleware {
+	if self.builtin != nil {
+		return self.builtin(ctx, opts...)
+	}
+	if rt_mw, ok := self.middleware.(RouteOptionsMiddleware); ok {
+		return rt_mw.NewWrapperFromRouteOptions(ctx, opts...)
+	}
+	return self.middleware
+}
+
+func (self *Controller) newBuiltinMiddlewareEntries() []*middlewareEntry {
+	return []*middlewareEntry{
+		{
+			stage: MiddlewareStageMetrics,
+			builtin: func(ctx context.Context, opts ...interface{}) Middleware {
+				if self.MetricsMiddleware == nil {
+					return nil
+				}
+				return self.MetricsMiddleware.NewWrapper()
+			},
+		},
+		{
+			stage: MiddlewareStageRequestLogger,
+			builtin: func(ctx context.Context, opts ...interface{}) Middleware {
+				if self.RequestLoggerMiddleware == nil {
+					return nil
+				}
+				if wrapper := self.RequestLoggerMiddleware.NewWrapper(ctx, opts...); wrapper != nil {
+					return wrapper
+				}
+				return nil
+			},
+		},
+		{
+			stage: MiddlewareStageApacheLogger,
+			builtin: func(ctx context.Context, opts ...interface{}) Middleware {
+				if self.ApacheLoggerMiddleware == nil {
+					return nil
+				}
+				return self.ApacheLoggerMiddleware.NewWrapper()
+			},
+		},
+		{
+			stage:   MiddlewareStageCompression,
+			builtin: self.newCompressionWrapper,
+		},
+		{
+			stage: MiddlewareStageSerializer,
+			builtin: func(ctx context.Context, opts ...interface{}) Middleware {
+				if self.SerializerMiddleware == nil {
+					return nil
+				}
+				return self.SerializerMiddleware.NewWrapper()
+			},
+		},
+		{
+			stage: MiddlewareStagePanicHandler,
+			builtin: func(ctx context.Context, opts ...interface{}) Middleware {
+				if self.PanicHandlerMiddleware == nil {
+					return nil
+				}
+				return self.PanicHandlerMiddleware.NewWrapper()
+			},
+		},
+		{
+			stage:   MiddlewareStageResponseValidation,
+			builtin: self.newResponseValidationWrapper,
+		},
+		{
+			stage: MiddlewareStageJSONSchema,
+			builtin: func(ctx context.Context, opts ...interface{}) Middleware {
+				if self.JSONSchemaMiddleware == nil {
+					return nil
+				}
+				if wrapper := self.JSONSchemaMiddleware.NewWrapperFromRouteOptions(ctx, opts...); wrapper != nil {
+					return wrapper
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func (self *Controller) middlewareIndex(stage MiddlewareStage) int {
+	for i, entry := range self.middlewares {
+		if entry.stage == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// Middleware is applied to routes when they're registered, so it can't
+// be added once there are any
+func (self *Controller) hasRegisteredRoutes() bool {
+	self.routesLock.Lock()
+	defer self.routesLock.Unlock()
+	return len(self.registeredRoutes) != 0
+}
+
+func (self *Controller) insertMiddleware(idx int, name MiddlewareStage, mw Middleware) {
+	if mw == nil {
+		panic(fmt.Sprintf("Middleware '%s' must not be nil", name))
+	}
+	if len(name) == 0 {
+		panic("Middleware must have a name")
+	}
+	if self.middlewareIndex(name) != -1 {
+		panic(fmt.Sprintf("Middleware '%s' is already registered", name))
+	}
+	// Routes are wrapped when they're registered, so earlier routes
+	// would silently go without it
+	if self.hasRegisteredRoutes() {
+		panic(fmt.Sprintf(
+			"Middleware '%s' must be added before any routes are registered, including by Init()",
+			name,
+		))
+	}
+
+	entry := &middlewareEntry{stage: name, middleware: mw}
+
+	self.middlewares = append(self.middlewares, nil)
+	copy(self.middlewares[idx+1:], self.middlewares[idx:])
+	self.middlewares[idx] = entry
+}
+
+func (self *Controller) mustMiddlewareIndex(stage MiddlewareStage) int {
+	idx := self.middlewareIndex(stage)
+	if idx == -1 {
+		panic(fmt.Sprintf("No middleware stage named '%s'", stage))
+	}
+	return idx
+}
+
+// Add middleware to run after all other controller middleware, right
+// before the route handler. This, UseBefore(), and UseAfter() must be
+// called before Init(), which registers routes.
+func (self *Controller) Use(name MiddlewareStage, mw Middleware) *Controller {
+	self.insertMiddleware(len(self.middlewares), name, mw)
+	return self
+}
+
+// Add middleware to run before (outside of) an existing stage.
+func (self *Controller) UseBefore(stage MiddlewareStage, name MiddlewareStage, mw Middleware) *Controller {
+	self.insertMiddleware(self.mustMiddlewareIndex(stage), name, mw)
+	return self
+}
+
+// Add middleware to run after (inside of) an existing stage.
+func (self *Controller) UseAfter(stage MiddlewareStage, name MiddlewareStage, mw Middleware) *Controller {
+	self.insertMiddleware(self.mustMiddlewareIndex(stage)+1, name, mw)
+	return self
+}
+
+// Names of all middleware stages, outermost first
+func (self *Controller) MiddlewareStages() []MiddlewareStage {
+	stages := make([]MiddlewareStage, len(self.middlewares))
+	for i, entry := range self.middlewares {
+		stages[i] = entry.stage
+	}
+	return stages
+}
+
+// Route option to skip the named middleware stages
+func (self *Controller) SkipMiddlewareOpts(stages ...MiddlewareStage) *MiddlewareOpts {
+	return &MiddlewareOpts{Skip: stages}
+}
+
+func skippedMiddlewareFromRouteOptions(opts ...interface{}) map[MiddlewareStage]bool {
+	skip := map[MiddlewareStage]bool{}
+	for _, opt_i := range opts {
+		opt, ok := opt_i.(*MiddlewareOpts)
+		if !ok {
+			continue
+		}
+		for _, stage := range opt.Skip {
+			skip[stage] = true
+		}
+	}
+	return skip
+}
+
+// Group middleware goes right outside the first validation stage, or
+// innermost if both have been removed
+func (self *Controller) groupMiddlewareIndex() int {
+	for i, entry := range self.middlewares {
+		switch entry.stage {
+		case MiddlewareStageResponseValidation, MiddlewareStageJSONSchema:
+			return i
+		}
+	}
+	return len(self.middlewares)
+}
+
+func wrapWithMiddlewareEntries(ctx context.Context, fn api_router.RouteFn, entries []*middlewareEntry, skip map[MiddlewareStage]bool, opts ...interface{}) api_router.RouteFn {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if skip[entry.stage] {
+			continue
+		}
+		if wrapper := entry.wrapperForRoute(ctx, opts...); wrapper != nil {
+			fn = wrapper.Wrap(fn)
+		}
+	}
+	return fn
+}
+
+// Wrap fn with every middleware stage not skipped by the route options,
+// innermost first.
+func (self *Controller) wrapWithMiddleware(ctx context.Context, fn api_router.RouteFn, opts ...interface{}) api_router.RouteFn {
+	skip := skippedMiddlewareFromRouteOptions(opts...)
+	group_idx := self.groupMiddlewareIndex()
+
+	fn = wrapWithMiddlewareEntries(ctx, fn, self.middlewares[group_idx:], skip, opts...)
+	fn = wrapWithGroupMiddleware(ctx, fn, skip, opts...)
+	return wrapWithMiddlewareEntries(ctx, fn, self.middlewares[:group_idx], skip, opts...)
+}
@@ -0,0 +1,669 @@
+package api_framework
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-api-framework/jsonschema_mw"
+	"github.com/tilteng/go-errors/errors"
+)
+
+const openAPIVersion = "3.0.3"
+
+// Route option to describe a route in the generated OpenAPI document
+type OpenAPIOpts struct {
+	Summary     string
+	Description string
+	OperationID string
+	Tags        []string
+	Deprecated  bool
+	// Error classes this route may return, in addition to the defaults
+	Errors []*errors.ErrorClass
+	// Leave this route out of the document entirely
+	Exclude bool
+}
+
+type OpenAPIDocument struct {
+	OpenAPI    string                     `json:"openapi"`
+	Info       *OpenAPIInfo               `json:"info"`
+	Servers    []*OpenAPIServer           `json:"servers,omitempty"`
+	Paths      map[string]OpenAPIPathItem `json:"paths"`
+	Components *OpenAPIComponents         `json:"components,omitempty"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+// Keyed by lowercase HTTP method
+type OpenAPIPathItem map[string]*OpenAPIOperation
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId,omitempty"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name     string                 `json:"name"`
+	In       string                 `json:"in"`
+	Required bool                   `json:"required"`
+	Schema   map[string]interface{} `json:"schema,omitempty"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIMediaType struct {
+	Schema map[string]interface{} `json:"schema,omitempty"`
+}
+
+type OpenAPIResponse struct {
+	Ref         string                       `json:"$ref,omitempty"`
+	Description string                       `json:"description,omitempty"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIComponents struct {
+	Schemas   map[string]interface{}      `json:"schemas,omitempty"`
+	Responses map[string]*OpenAPIResponse `json:"responses,omitempty"`
+}
+
+type registeredRoute struct {
+	route *api_router.Route
+	opts  []interface{}
+}
+
+// Matches {name} and {name:pattern} in mux-style paths
+var pathVarRegexp = regexp.MustCompile(`\{([^{}:]+)(?::((?:[^{}]|\{[^{}]*\})*))?\}`)
+
+// Route option to add a summary and description to the OpenAPI document
+func (self *Controller) OpenAPIOpts(summary, description string) *OpenAPIOpts {
+	return &OpenAPIOpts{Summary: summary, Description: description}
+}
+
+func (self *Controller) recordRoute(rt *api_router.Route, opts ...interface{}) {
+	self.routesLock.Lock()
+	defer self.routesLock.Unlock()
+	self.registeredRoutes = append(self.registeredRoutes, &registeredRoute{
+		route: rt,
+		opts:  opts,
+	})
+}
+
+func (self *Controller) registeredRoutesCopy() []*registeredRoute {
+	self.routesLock.Lock()
+	defer self.routesLock.Unlock()
+	routes := make([]*registeredRoute, len(self.registeredRoutes))
+	copy(routes, self.registeredRoutes)
+	return routes
+}
+
+func openAPIOptsFromRouteOptions(opts ...interface{}) *OpenAPIOpts {
+	merged := &OpenAPIOpts{}
+	for _, opt_i := range opts {
+		opt, ok := opt_i.(*OpenAPIOpts)
+		if !ok {
+			continue
+		}
+		// As with firstRouteOption(), a route's own summary wins over
+		// its group's
+		if merged.Summary == "" {
+			merged.Summary = opt.Summary
+		}
+		if merged.Description == "" {
+			merged.Description = opt.Description
+		}
+		if merged.OperationID == "" {
+			merged.OperationID = opt.OperationID
+		}
+		merged.Tags = append(merged.Tags, opt.Tags...)
+		merged.Errors = append(merged.Errors, opt.Errors...)
+		merged.Deprecated = merged.Deprecated || opt.Deprecated
+		merged.Exclude = merged.Exclude || opt.Exclude
+	}
+	return merged
+}
+
+// Converts a mux-style path into an OpenAPI path plus its parameters.
+// Typed constraints like {id:uuid} have already been stripped by the
+// router and are passed in constraints. A regular expression, like
+// {id:[0-9]+}, is still in the path and becomes the schema's pattern.
+func openAPIPathAndParameters(path string, constraints map[string]*api_router.RouteVarConstraint) (string, []*OpenAPIParameter) {
+	var params []*OpenAPIParameter
+
+	oapi_path := pathVarRegexp.ReplaceAllStringFunc(path, func(s string) string {
+		m := pathVarRegexp.FindStringSubmatch(s)
+		schema := map[string]interface{}{"type": "string"}
+		if m[2] != "" {
+			schema["pattern"] = "^" + m[2] + "$"
+		}
+		if constraint, ok := constraints[m[1]]; ok {
+			switch constraint.Type {
+			case "uuid":
+				schema["format"] = "uuid"
+			case "int":
+				schema["type"] = "integer"
+				schema["format"] = "int64"
+			case "bool":
+				schema["type"] = "boolean"
+			case "time":
+				schema["format"] = "date-time"
+			case "enum":
+				schema["enum"] = constraint.Values
+			}
+		}
+		params = append(params, &OpenAPIParameter{
+			Name:     m[1],
+			In:       "path",
+			Required: true,
+			Schema:   schema,
+		})
+		return "{" + m[1] + "}"
+	})
+
+	return oapi_path, params
+}
+
+func openAPIOperationID(method, path string) string {
+	parts := []string{strings.ToLower(method)}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		parts = append(parts, strings.Title(part))
+	}
+	return strings.Join(parts, "")
+}
+
+// The full class name, like "github.com_tilteng_go-errors_errors.ErrNotFound".
+// An ErrorManager won't define the same full name twice, so these don't
+// collide. Component keys may only have letters, digits, '.', '-' and '_'.
+func errorClassResponseName(errcls *errors.ErrorClass) string {
+	name := errcls.Name
+	if idx := strings.LastIndex(name, "/vendor/"); idx != -1 {
+		name = name[idx+len("/vendor/"):]
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Decode a JSON schema into something we can embed. $schema and id
+// aren't valid inside of OpenAPI schema objects.
+func openAPISchemaFromJSONString(json_string string) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(json_string), &schema); err != nil {
+		return nil, err
+	}
+	delete(schema, "$schema")
+	delete(schema, "id")
+	delete(schema, "$id")
+	return schema, nil
+}
+
+// Component names can't have a "/", which schema names in directories,
+// like v1/kitten, do
+func openAPISchemaName(name string) string {
+	return strings.Replace(name, "/", ".", -1)
+}
+
+func openAPISchemaRef(name string) string {
+	return "#/components/schemas/" + openAPISchemaName(name)
+}
+
+// Point $refs between our schemas at their components
+func (self *Controller) rewriteOpenAPISchemaRefs(from *jsonschema_mw.JSONSchema, node interface{}) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for k, v := range node {
+			ref, ok := v.(string)
+			if k != "$ref" || !ok {
+				self.rewriteOpenAPISchemaRefs(from, v)
+				continue
+			}
+			if name, pointer, ok := self.JSONSchemaMiddleware.ResolveRef(from, ref); ok {
+				node[k] = openAPISchemaRef(name) + pointer
+			}
+		}
+	case []interface{}:
+		for _, v := range node {
+			self.rewriteOpenAPISchemaRefs(from, v)
+		}
+	}
+}
+
+func (self *Controller) newOpenAPIErrorResponse(classes []*errors.ErrorClass) *OpenAPIResponse {
+	titles := make([]string, len(classes))
+	for i, errcls := range classes {
+		titles[i] = errcls.Code + ": " + errcls.Title
+	}
+	return &OpenAPIResponse{
+		Description: strings.Join(titles, "\n"),
+		Content:     self.openAPIContent("#/components/schemas/JSONAPIErrorResponse"),
+	}
+}
+
+func (self *Controller) openAPIContent(schema_ref string) map[string]*OpenAPIMediaType {
+	content := map[string]*OpenAPIMediaType{}
+	for _, ctype := range self.options.ProducesContent {
+		content[ctype] = &OpenAPIMediaType{
+			Schema: map[string]interface{}{"$ref": schema_ref},
+		}
+	}
+	return content
+}
+
+// Error classes an operation returns on their own are added to
+// components, and referenced from there.
+func (self *Controller) newOpenAPIOperation(rr *registeredRoute, oapi_opts *OpenAPIOpts, params []*OpenAPIParameter, components *OpenAPIComponents) *OpenAPIOperation {
+	rt := rr.route
+
+	op := &OpenAPIOperation{
+		OperationID: oapi_opts.OperationID,
+		Summary:     oapi_opts.Summary,
+		Description: oapi_opts.Description,
+		Tags:        oapi_opts.Tags,
+		Deprecated:  oapi_opts.Deprecated,
+		Parameters:  params,
+		Responses:   map[string]*OpenAPIResponse{},
+	}
+
+	if op.OperationID == "" {
+		op.OperationID = openAPIOperationID(rt.Method(), rt.FullPath())
+	}
+
+	status := rt.DefaultStatus()
+	op.Responses[strconv.Itoa(status)] = &OpenAPIResponse{
+		Description: http.StatusText(status),
+	}
+
+	if self.JSONSchemaMiddleware != nil {
+		response_schemas := jsonSchemaOptsResponseSchemas(rr.opts...)
+		for resp_status, name := range response_schemas {
+			if resp_status == 0 {
+				// Covers the default status unless it's listed
+				if _, ok := response_schemas[status]; ok {
+					continue
+				}
+				resp_status = status
+			}
+			op.Responses[strconv.Itoa(resp_status)] = &OpenAPIResponse{
+				Description: http.StatusText(resp_status),
+				Content:     self.openAPIContent(openAPISchemaRef(name)),
+			}
+		}
+	}
+
+	error_classes := []*errors.ErrorClass{ErrInternalServerError}
+
+	if len(rt.VarConstraints()) != 0 {
+		error_classes = append(error_classes, ErrInvalidRouteParameter)
+	}
+
+	query_params, query_errors := self.openAPIQueryParameters(rr.opts...)
+	op.Parameters = append(op.Parameters, query_params...)
+	error_classes = append(error_classes, query_errors...)
+
+	if self.JSONSchemaMiddleware != nil {
+		query_name, header_name := jsonSchemaOptsParamSchemas(rr.opts...)
+		schema_params := append(
+			self.openAPISchemaParameters(query_name, "query"),
+			self.openAPISchemaParameters(header_name, "header")...,
+		)
+		if len(schema_params) != 0 {
+			op.Parameters = append(op.Parameters, schema_params...)
+			error_classes = append(error_classes, ErrJSONSchemaValidationFailed)
+		}
+	}
+
+	if name := jsonSchemaOptsName(rr.opts...); name != "" && self.JSONSchemaMiddleware != nil {
+		content := map[string]*OpenAPIMediaType{}
+		for _, ctype := range self.options.ConsumesContent {
+			content[ctype] = &OpenAPIMediaType{
+				Schema: map[string]interface{}{
+					"$ref": openAPISchemaRef(name),
+				},
+			}
+		}
+		op.RequestBody = &OpenAPIRequestBody{
+			Required: true,
+			Content:  content,
+		}
+		error_classes = append(error_classes, ErrJSONSchemaValidationFailed)
+	}
+
+	// Any body is size limited and has its Content-Encoding decoded
+	// before it's read, and then it's deserialized
+	switch {
+	case op.RequestBody != nil, rt.Method() == "POST", rt.Method() == "PUT", rt.Method() == "PATCH":
+		error_classes = append(
+			error_classes,
+			ErrRequestBodyTooLarge,
+			ErrUnsupportedContentEncoding,
+			ErrInvalidRequestBody,
+			ErrMalformedRequestBody,
+		)
+	}
+
+	error_classes = append(error_classes, oapi_opts.Errors...)
+
+	// Responses are keyed by status, so group error classes that
+	// share one. A class can be listed more than once, like when a
+	// route validates both its parameters and its body.
+	by_status := map[int][]*errors.ErrorClass{}
+	seen := map[*errors.ErrorClass]bool{}
+	for _, errcls := range error_classes {
+		if seen[errcls] {
+			continue
+		}
+		seen[errcls] = true
+		by_status[errcls.Status] = append(by_status[errcls.Status], errcls)
+	}
+
+	for status, classes := range by_status {
+		if len(classes) == 1 {
+			name := errorClassResponseName(classes[0])
+			if _, ok := components.Responses[name]; !ok {
+				components.Responses[name] = self.newOpenAPIErrorResponse(classes)
+			}
+			op.Responses[strconv.Itoa(status)] = &OpenAPIResponse{
+				Ref: "#/components/responses/" + name,
+			}
+			continue
+		}
+		op.Responses[strconv.Itoa(status)] = self.newOpenAPIErrorResponse(classes)
+	}
+
+	return op
+}
+
+var filterTypeSchemas = map[FilterType]map[string]interface{}{
+	FilterString: {"type": "string"},
+	FilterInt:    {"type": "integer"},
+	FilterFloat:  {"type": "number"},
+	FilterBool:   {"type": "boolean"},
+	FilterTime:   {"type": "string", "format": "date-time"},
+	FilterUUID:   {"type": "string", "format": "uuid"},
+}
+
+// Query parameters from JSONAPIOpts, PaginationOpts, and FilterOpts
+func (self *Controller) openAPIQueryParameters(opts ...interface{}) ([]*OpenAPIParameter, []*errors.ErrorClass) {
+	var params []*OpenAPIParameter
+	var error_classes []*errors.ErrorClass
+
+	add := func(name string, schema map[string]interface{}) {
+		params = append(params, &OpenAPIParameter{
+			Name:   name,
+			In:     "query",
+			Schema: schema,
+		})
+	}
+	string_schema := map[string]interface{}{"type": "string"}
+
+	if jsonAPIOptsFromRouteOptions(opts...) != nil {
+		add("include", string_schema)
+	}
+
+	if hasPaginationOpts(opts...) {
+		add("page[size]", map[string]interface{}{"type": "integer", "minimum": 1})
+		if self.paginationFromRouteOptions(opts...).Strategy == CursorPagination {
+			add("page[after]", string_schema)
+			add("page[before]", string_schema)
+			error_classes = append(error_classes, ErrInvalidPageCursor)
+		} else {
+			add("page[offset]", map[string]interface{}{"type": "integer", "minimum": 0})
+		}
+	}
+
+	if filter_opts := filterOptsFromRouteOptions(opts...); filter_opts != nil {
+		names := make([]string, 0, len(filter_opts.Fields))
+		sortable := false
+		for name, field := range filter_opts.Fields {
+			names = append(names, name)
+			sortable = sortable || field.Sortable
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := filter_opts.Fields[name]
+			for _, op := range field.Ops {
+				switch op {
+				case FilterEq:
+					add("filter["+name+"]", filterTypeSchemas[field.Type])
+				case FilterIn, FilterPrefix:
+					add("filter["+name+"]["+string(op)+"]", string_schema)
+				default:
+					add("filter["+name+"]["+string(op)+"]", filterTypeSchemas[field.Type])
+				}
+			}
+		}
+		if sortable {
+			add("sort", string_schema)
+		}
+	}
+
+	if len(params) != 0 {
+		error_classes = append(error_classes, ErrInvalidQueryParameter)
+	}
+	return params, error_classes
+}
+
+func jsonSchemaOptsName(opts ...interface{}) string {
+	for _, opt_i := range opts {
+		opt, ok := opt_i.(*jsonschema_mw.JSONSchemaOpts)
+		if ok && len(opt.Name) != 0 {
+			return opt.Name
+		}
+	}
+	return ""
+}
+
+// For each, the first option naming one wins
+func jsonSchemaOptsParamSchemas(opts ...interface{}) (query_name string, header_name string) {
+	for _, opt_i := range opts {
+		opt, ok := opt_i.(*jsonschema_mw.JSONSchemaOpts)
+		if !ok {
+			continue
+		}
+		if query_name == "" {
+			query_name = opt.QuerySchema
+		}
+		if header_name == "" {
+			header_name = opt.HeaderSchema
+		}
+	}
+	return query_name, header_name
+}
+
+// One parameter per property of a query or header schema
+func (self *Controller) openAPISchemaParameters(name string, in string) []*OpenAPIParameter {
+	if name == "" {
+		return nil
+	}
+	schema := self.JSONSchemaMiddleware.GetSchema(name)
+	if schema == nil {
+		return nil
+	}
+	var doc struct {
+		Properties map[string]map[string]interface{} `json:"properties"`
+		Required   []string                          `json:"required"`
+	}
+	if err := json.Unmarshal([]byte(schema.GetJSONString()), &doc); err != nil {
+		return nil
+	}
+
+	required := map[string]bool{}
+	for _, prop_name := range doc.Required {
+		required[prop_name] = true
+	}
+	names := make([]string, 0, len(doc.Properties))
+	for prop_name := range doc.Properties {
+		names = append(names, prop_name)
+	}
+	sort.Strings(names)
+
+	params := make([]*OpenAPIParameter, len(names))
+	for i, prop_name := range names {
+		params[i] = &OpenAPIParameter{
+			Name:     prop_name,
+			In:       in,
+			Required: required[prop_name],
+			Schema:   doc.Properties[prop_name],
+		}
+	}
+	return params
+}
+
+func jsonSchemaOptsResponseSchemas(opts ...interface{}) map[int]string {
+	for _, opt_i := range opts {
+		opt, ok := opt_i.(*jsonschema_mw.JSONSchemaOpts)
+		if ok && len(opt.ResponseSchemas) != 0 {
+			return opt.ResponseSchemas
+		}
+	}
+	return nil
+}
+
+func (self *Controller) newOpenAPIComponents() (*OpenAPIComponents, error) {
+	components := &OpenAPIComponents{
+		Schemas: map[string]interface{}{
+			"JSONAPIErrorResponse": map[string]interface{}{
+				"type":     "object",
+				"required": []string{"errors"},
+				"properties": map[string]interface{}{
+					"errors": map[string]interface{}{
+						"type": "array",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"id":     map[string]interface{}{"type": "string"},
+								"status": map[string]interface{}{"type": "string"},
+								"code":   map[string]interface{}{"type": "string"},
+								"title":  map[string]interface{}{"type": "string"},
+								"detail": map[string]interface{}{"type": "string"},
+								"source": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"pointer":   map[string]interface{}{"type": "string"},
+										"parameter": map[string]interface{}{"type": "string"},
+										"header":    map[string]interface{}{"type": "string"},
+									},
+								},
+								"meta": map[string]interface{}{"type": "object"},
+							},
+						},
+					},
+				},
+			},
+		},
+		Responses: map[string]*OpenAPIResponse{},
+	}
+
+	if self.JSONSchemaMiddleware != nil {
+		for name, schema := range self.JSONSchemaMiddleware.GetSchemas() {
+			oapi_schema, err := openAPISchemaFromJSONString(schema.GetJSONString())
+			if err != nil {
+				return nil, err
+			}
+			self.rewriteOpenAPISchemaRefs(schema, oapi_schema)
+			components.Schemas[openAPISchemaName(name)] = oapi_schema
+		}
+	}
+
+	return components, nil
+}
+
+// Build an OpenAPI 3 document describing every route registered so far
+func (self *Controller) OpenAPIDocument() (*OpenAPIDocument, error) {
+	doc := &OpenAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: &OpenAPIInfo{
+			Title:   self.AppName(),
+			Version: self.CodeVersion(),
+		},
+		Paths: map[string]OpenAPIPathItem{},
+	}
+
+	if doc.Info.Version == "" {
+		doc.Info.Version = "unknown"
+	}
+
+	if self.options.BaseAPIURL != "" {
+		doc.Servers = []*OpenAPIServer{{URL: self.options.BaseAPIURL}}
+	}
+
+	components, err := self.newOpenAPIComponents()
+	if err != nil {
+		return nil, err
+	}
+	doc.Components = components
+
+	for _, rr := range self.registeredRoutesCopy() {
+		rt := rr.route
+		oapi_opts := openAPIOptsFromRouteOptions(rr.opts...)
+		if oapi_opts.Exclude || rt.IsVirtual() {
+			continue
+		}
+
+		path, params := openAPIPathAndParameters(
+			rt.FullPath(),
+			rt.VarConstraints(),
+		)
+
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = OpenAPIPathItem{}
+			doc.Paths[path] = item
+		}
+
+		item[strings.ToLower(rt.Method())] = self.newOpenAPIOperation(
+			rr,
+			oapi_opts,
+			params,
+			components,
+		)
+	}
+
+	return doc, nil
+}
+
+func (self *Controller) setupOpenAPIRoute() {
+	self.GET(self.options.OpenAPIRoutePath, func(ctx context.Context) {
+		rctx := self.RequestContext(ctx)
+
+		doc, err := self.OpenAPIDocument()
+		if err != nil {
+			panic(err)
+		}
+
+		byt, err := json.Marshal(doc)
+		if err != nil {
+			panic(err)
+		}
+
+		rctx.SetStatus(200)
+		rctx.SetResponseHeader("Content-Type", "application/json")
+		rctx.WriteResponse(byt)
+	}, &OpenAPIOpts{Exclude: true})
+}
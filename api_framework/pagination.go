@@ -0,0 +1,379 @@
+package api_framework
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-api-framework/jsonapi"
+	"github.com/tilteng/go-errors/errors"
+)
+
+type PaginationStrategy int
+
+const (
+	// page[offset] and page[size]
+	OffsetPagination PaginationStrategy = iota
+	// page[after], page[before] and page[size]. Cursors are opaque to
+	// clients and signed, so they can't be tampered with.
+	CursorPagination
+)
+
+// Which page a cursor gets, relative to the value in it
+type CursorDirection string
+
+const (
+	// page[after]
+	CursorAfter CursorDirection = "after"
+	// page[before]
+	CursorBefore CursorDirection = "before"
+)
+
+func (self CursorDirection) param() string {
+	return "page[" + string(self) + "]"
+}
+
+const (
+	defaultPageSize = 25
+	defaultMaxPage  = 100
+	cursorMACSize   = 16
+)
+
+// How RequestContext.Page() reads pages. ControllerOpts.Pagination is
+// the default. Pass as a route option to override it for that route.
+// Zero values keep the default.
+type PaginationOpts struct {
+	Strategy PaginationStrategy
+	// Page size when page[size] isn't given
+	DefaultSize int
+	// Larger page[size] values are clamped to this
+	MaxSize int
+}
+
+func (self *Controller) paginationFromRouteOptions(opts ...interface{}) *PaginationOpts {
+	pagination := &PaginationOpts{
+		DefaultSize: defaultPageSize,
+		MaxSize:     defaultMaxPage,
+	}
+	if def := self.options.Pagination; def != nil {
+		pagination.Strategy = def.Strategy
+		if def.DefaultSize > 0 {
+			pagination.DefaultSize = def.DefaultSize
+		}
+		if def.MaxSize > 0 {
+			pagination.MaxSize = def.MaxSize
+		}
+	}
+	if opt, ok := firstRouteOption(opts, (*PaginationOpts)(nil)).(*PaginationOpts); ok {
+		pagination.Strategy = opt.Strategy
+		if opt.DefaultSize > 0 {
+			pagination.DefaultSize = opt.DefaultSize
+		}
+		if opt.MaxSize > 0 {
+			pagination.MaxSize = opt.MaxSize
+		}
+	}
+	if pagination.DefaultSize > pagination.MaxSize {
+		pagination.DefaultSize = pagination.MaxSize
+	}
+	return pagination
+}
+
+func hasPaginationOpts(opts ...interface{}) bool {
+	return firstRouteOption(opts, (*PaginationOpts)(nil)) != nil
+}
+
+func (self *Controller) setupCursorKey() error {
+	if len(self.options.CursorSecret) != 0 {
+		self.cursorKey = self.options.CursorSecret
+		return nil
+	}
+	self.cursorKey = make([]byte, 32)
+	if _, err := rand.Read(self.cursorKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Logged once, for the first route that needs it
+func (self *Controller) warnRandomCursorKey(ctx context.Context, rt *api_router.Route, pagination *PaginationOpts) {
+	if pagination.Strategy != CursorPagination || len(self.options.CursorSecret) != 0 {
+		return
+	}
+	self.cursorKeyWarning.Do(func() {
+		self.logger.LogWarnf(
+			ctx,
+			"%s %s uses cursor pagination, but ControllerOpts.CursorSecret is not set. Cursors will not survive a restart or work across instances.",
+			rt.Method(),
+			rt.FullPath(),
+		)
+	})
+}
+
+// The route and direction are signed along with the value, so a cursor
+// only works where it was given out
+func (self *Controller) cursorMAC(route_path string, direction CursorDirection, value string) []byte {
+	mac := hmac.New(sha256.New, self.cursorKey)
+	mac.Write([]byte(route_path))
+	mac.Write([]byte{0})
+	mac.Write([]byte(direction))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)[:cursorMACSize]
+}
+
+// Sign a value for use as a page cursor for the route with the full path
+// route_path. Cursors aren't encrypted, so don't put anything secret in
+// them.
+func (self *Controller) EncodeCursor(route_path string, direction CursorDirection, value string) string {
+	return base64.RawURLEncoding.EncodeToString(
+		append(self.cursorMAC(route_path, direction, value), value...),
+	)
+}
+
+// Returns the value passed to EncodeCursor(), or false if the cursor
+// wasn't made by us for the same route and direction
+func (self *Controller) DecodeCursor(route_path string, direction CursorDirection, cursor string) (string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) < cursorMACSize {
+		return "", false
+	}
+	value := string(data[cursorMACSize:])
+	if !hmac.Equal(data[:cursorMACSize], self.cursorMAC(route_path, direction, value)) {
+		return "", false
+	}
+	return value, true
+}
+
+// The page a list route was asked for. Tell it what comes next with
+// SetTotal() or SetHasMore() for offset pagination, or SetNextCursor()
+// and SetPrevCursor() for cursor pagination. Pagination links are then
+// added to the response by WriteResponse() and Stream.
+type Page struct {
+	Strategy PaginationStrategy
+	Size     int
+	Offset   int
+	// Values passed to SetNextCursor() and SetPrevCursor() for an
+	// earlier page
+	After  string
+	Before string
+
+	rctx       *RequestContext
+	total      int
+	hasMore    bool
+	nextCursor string
+	prevCursor string
+}
+
+func (self *RequestContext) newPageParamError(class *errors.ErrorClass, param string, details string) *errors.Error {
+	return SetErrorSource(class.New(self, details), &ErrorSource{Parameter: param})
+}
+
+// The page asked for with page[...] query parameters, or an
+// ErrInvalidQueryParameter or ErrInvalidPageCursor suitable for
+// WriteResponse()
+func (self *RequestContext) Page() (*Page, *errors.Error) {
+	if self.page != nil {
+		return self.page, nil
+	}
+
+	opts := self.pagination
+	if opts == nil {
+		opts = self.controller.paginationFromRouteOptions()
+	}
+	query := self.HTTPRequest().URL.Query()
+	page := &Page{
+		Strategy: opts.Strategy,
+		Size:     opts.DefaultSize,
+		rctx:     self,
+		total:    -1,
+	}
+
+	if s := query.Get("page[size]"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size < 1 {
+			return nil, self.newPageParamError(
+				ErrInvalidQueryParameter,
+				"page[size]",
+				"page[size] should be a positive integer",
+			)
+		}
+		if size > opts.MaxSize {
+			size = opts.MaxSize
+		}
+		page.Size = size
+	}
+
+	switch opts.Strategy {
+	case OffsetPagination:
+		if s := query.Get("page[offset]"); s != "" {
+			offset, err := strconv.Atoi(s)
+			if err != nil || offset < 0 {
+				return nil, self.newPageParamError(
+					ErrInvalidQueryParameter,
+					"page[offset]",
+					"page[offset] should be a non-negative integer",
+				)
+			}
+			page.Offset = offset
+		}
+	case CursorPagination:
+		route_path := self.CurrentRoute().FullPath()
+		for _, direction := range []CursorDirection{CursorAfter, CursorBefore} {
+			param := direction.param()
+			cursor := query.Get(param)
+			if cursor == "" {
+				continue
+			}
+			value, ok := self.controller.DecodeCursor(route_path, direction, cursor)
+			if !ok {
+				return nil, self.newPageParamError(
+					ErrInvalidPageCursor,
+					param,
+					fmt.Sprintf("%s is not a valid cursor", param),
+				)
+			}
+			if direction == CursorAfter {
+				page.After = value
+			} else {
+				page.Before = value
+			}
+		}
+	}
+
+	self.page = page
+	return page, nil
+}
+
+// Offset pagination: the total number of items, if known
+func (self *Page) SetTotal(total int) *Page {
+	self.total = total
+	self.hasMore = self.Offset+self.Size < total
+	return self
+}
+
+// Offset pagination: whether there are items after this page
+func (self *Page) SetHasMore(has_more bool) *Page {
+	self.hasMore = has_more
+	return self
+}
+
+// Cursor pagination: the value that gets the page after this one, as
+// Page.After. "" means this is the last page.
+func (self *Page) SetNextCursor(value string) *Page {
+	self.nextCursor = value
+	return self
+}
+
+// Cursor pagination: the value that gets the page before this one, as
+// Page.Before. "" means this is the first page.
+func (self *Page) SetPrevCursor(value string) *Page {
+	self.prevCursor = value
+	return self
+}
+
+func (self *Page) url(params map[string]string) string {
+	rctx := self.rctx
+	r := rctx.HTTPRequest()
+	query := r.URL.Query()
+	for k := range query {
+		if strings.HasPrefix(k, "page[") {
+			delete(query, k)
+		}
+	}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	u := strings.TrimRight(rctx.controller.options.BaseAPIURL, "/") + r.URL.EscapedPath()
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// first, prev, next and last links, as they apply
+func (self *Page) Links() jsonapi.Links {
+	size := strconv.Itoa(self.Size)
+	links := jsonapi.Links{}
+
+	switch self.Strategy {
+	case OffsetPagination:
+		links["first"] = self.url(map[string]string{"page[size]": size})
+		if self.Offset > 0 {
+			prev := self.Offset - self.Size
+			if prev < 0 {
+				prev = 0
+			}
+			links["prev"] = self.url(map[string]string{
+				"page[offset]": strconv.Itoa(prev),
+				"page[size]":   size,
+			})
+		}
+		if self.hasMore {
+			links["next"] = self.url(map[string]string{
+				"page[offset]": strconv.Itoa(self.Offset + self.Size),
+				"page[size]":   size,
+			})
+		}
+		if self.total > 0 {
+			links["last"] = self.url(map[string]string{
+				"page[offset]": strconv.Itoa((self.total - 1) / self.Size * self.Size),
+				"page[size]":   size,
+			})
+		}
+	case CursorPagination:
+		route_path := self.rctx.CurrentRoute().FullPath()
+		links["first"] = self.url(map[string]string{"page[size]": size})
+		if self.prevCursor != "" {
+			links["prev"] = self.url(map[string]string{
+				CursorBefore.param(): self.rctx.controller.EncodeCursor(route_path, CursorBefore, self.prevCursor),
+				"page[size]":         size,
+			})
+		}
+		if self.nextCursor != "" {
+			links["next"] = self.url(map[string]string{
+				CursorAfter.param(): self.rctx.controller.EncodeCursor(route_path, CursorAfter, self.nextCursor),
+				"page[size]":        size,
+			})
+		}
+	}
+
+	return links
+}
+
+// RFC 8288 Link header value
+func linkHeader(links jsonapi.Links) string {
+	rels := make([]string, 0, len(links))
+	for rel := range links {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	parts := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		if href, ok := links[rel].(string); ok {
+			parts = append(parts, fmt.Sprintf(`<%s>; rel="%s"`, href, rel))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Pagination links, if the route asked for a page
+func (self *RequestContext) paginationLinks() jsonapi.Links {
+	if self.page == nil {
+		return nil
+	}
+	return self.page.Links()
+}
+
+func (self *RequestContext) setPaginationHeader(links jsonapi.Links) {
+	if hdr := linkHeader(links); hdr != "" {
+		self.ResponseWriter().Header().Add("Link", hdr)
+	}
+}
@@ -3,8 +3,8 @@ package api_framework
 import (
 	"context"
 
-	"github.com/tilteng/go-api-router/api_router"
-	"github.com/tilteng/go-api-serializers/serializers_mw"
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-api-framework/serializers_mw"
 	"github.com/tilteng/go-logger/logger"
 	"github.com/tilteng/go-request-tracing/request_tracing"
 )
@@ -36,6 +36,12 @@ type RequestContext struct {
 	// This brings in logging
 	request_tracing.RequestTrace
 	serializerRequestContext serializers_mw.RequestContext
+	controller               *Controller
+	stream                   *Stream
+	jsonapiQuery             *jsonAPIQuery
+	pagination               *PaginationOpts
+	page                     *Page
+	filterQuery              *FilterQuery
 }
 
 var requestContextCtxKey = &contextKey{"request_context"}
@@ -53,6 +59,7 @@ func (self *Controller) newRequestContextFromContext(ctx context.Context) *Reque
 
 	rctx := &RequestContext{
 		privateContext:           ctx,
+		controller:               self,
 		appContext:               self.appContext,
 		serializerRequestContext: ser_rctx,
 		RequestTrace: self.requestTraceManager.NewRequestTraceFromHTTPRequest(
@@ -0,0 +1,171 @@
+package api_framework
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type ResponseValidationMode int
+
+const (
+	// Responses aren't validated
+	ResponseValidationOff ResponseValidationMode = iota
+	// Violations are logged, counted in metrics and reported as an
+	// ErrResponseValidationFailed, but the response is sent as is
+	ResponseValidationReport
+	// Like ResponseValidationReport, but the response is replaced with
+	// the ErrResponseValidationFailed. Responses are held back until
+	// they're validated, so this is meant for dev and test.
+	ResponseValidationStrict
+)
+
+// Validates JSON responses against the schemas named by
+// JSONSchemaOpts.ResponseSchemas. Set ControllerOpts.ResponseValidation
+// according to the environment: strict in dev and test, report in
+// staging, and off or sampled in production.
+type ResponseValidationOpts struct {
+	Mode ResponseValidationMode
+	// Fraction of responses to validate, like 0.01. 0 means all of them.
+	SampleRate float64
+	// Counted when a response doesn't match. Default
+	// "route.response_validation_failed"
+	MetricName string
+}
+
+func isJSONResponse(ctype string) bool {
+	ctype = strings.ToLower(strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0]))
+	return ctype == "application/json" || strings.HasSuffix(ctype, "+json")
+}
+
+type responseValidationWrapper struct {
+	controller *Controller
+	opts       *ResponseValidationOpts
+	// Schema names by status. 0 is for any other status. They're looked
+	// up for each response, as they may be reloaded.
+	schemas map[int]string
+}
+
+func (self *responseValidationWrapper) schemaFor(status int) *gojsonschema.Schema {
+	name, ok := self.schemas[status]
+	if !ok {
+		name = self.schemas[0]
+	}
+	if name == "" {
+		return nil
+	}
+	if schema := self.controller.JSONSchemaMiddleware.GetSchema(name); schema != nil {
+		return schema.GetSchema()
+	}
+	return nil
+}
+
+func (self *responseValidationWrapper) Wrap(next api_router.RouteFn) api_router.RouteFn {
+	return func(ctx context.Context) {
+		if self.opts.SampleRate > 0 && rand.Float64() >= self.opts.SampleRate {
+			next(ctx)
+			return
+		}
+
+		rctx := self.controller.RequestContext(ctx)
+		writer := rctx.ResponseWriter()
+		strict := self.opts.Mode == ResponseValidationStrict
+		if strict {
+			writer.HoldResponse()
+		}
+		next(ctx)
+
+		// Streamed responses don't keep a copy
+		body := writer.ResponseCopy()
+		schema := self.schemaFor(writer.Status())
+		if schema == nil || len(body) == 0 || !isJSONResponse(writer.Header().Get("Content-Type")) {
+			writer.ReleaseResponse()
+			return
+		}
+
+		violations := validateResponse(schema, body)
+		if len(violations) == 0 {
+			writer.ReleaseResponse()
+			return
+		}
+		self.controller.responseValidationFailed(rctx, self.opts, violations, strict)
+	}
+}
+
+// Returns what's wrong with the response, if anything
+func validateResponse(schema *gojsonschema.Schema, body []byte) []string {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return []string{"Error validating response: " + err.Error()}
+	}
+	violations := make([]string, 0, len(result.Errors()))
+	for _, result_err := range result.Errors() {
+		ptr := schemaErrorPointer(result_err, "")
+		if ptr == "" {
+			ptr = "/"
+		}
+		violations = append(violations, ptr+": "+result_err.Description())
+	}
+	return violations
+}
+
+func (self *Controller) responseValidationFailed(rctx *RequestContext, opts *ResponseValidationOpts, violations []string, strict bool) {
+	writer := rctx.ResponseWriter()
+	status := writer.Status()
+
+	if self.MetricsEnabled() {
+		name := opts.MetricName
+		if name == "" {
+			name = "route.response_validation_failed"
+		}
+		self.MetricsClient().Incr(name, 1, map[string]string{
+			"route":  rctx.CurrentRoute().FullPath(),
+			"method": rctx.HTTPRequest().Method,
+			"status": fmt.Sprintf("%d", status),
+		})
+	}
+
+	// Committing logs the error and reports it, as it's a 500
+	api_err := ErrResponseValidationFailed.Start(
+		fmt.Sprintf(
+			"%d response for %s %s does not match its schema: %s",
+			status,
+			rctx.HTTPRequest().Method,
+			rctx.CurrentRoute().FullPath(),
+			strings.Join(violations, "; "),
+		),
+	).SetInternalMetadata(map[string]interface{}{
+		"status":     status,
+		"violations": violations,
+	}).Commit(rctx)
+
+	if strict {
+		writer.DiscardResponse()
+		self.WriteResponse(rctx, api_err)
+	}
+}
+
+func (self *Controller) newResponseValidationWrapper(ctx context.Context, opts ...interface{}) Middleware {
+	validation := self.options.ResponseValidation
+	if validation == nil || validation.Mode == ResponseValidationOff || self.JSONSchemaMiddleware == nil {
+		return nil
+	}
+
+	response_schemas := jsonSchemaOptsResponseSchemas(opts...)
+	if len(response_schemas) == 0 {
+		return nil
+	}
+
+	for _, name := range response_schemas {
+		self.JSONSchemaMiddleware.UseSchema(name)
+	}
+	return &responseValidationWrapper{
+		controller: self,
+		opts:       validation,
+		schemas:    response_schemas,
+	}
+}
@@ -0,0 +1,121 @@
+package api_framework
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-errors/errors"
+)
+
+func (self *RequestContext) newInvalidRouteVarError(name string, details string) *errors.Error {
+	return SetErrorSource(ErrInvalidRouteParameter.New(self, details), &ErrorSource{Parameter: name})
+}
+
+func (self *RequestContext) requiredRouteVar(name string) (string, *errors.Error) {
+	val, ok := self.RouteVar(name)
+	if !ok {
+		return "", self.newInvalidRouteVarError(
+			name,
+			fmt.Sprintf("Route var '%s' is missing", name),
+		)
+	}
+	return val, nil
+}
+
+// Returns the route var as a UUID, or an ErrInvalidRouteParameter
+// suitable for WriteResponse()
+func (self *RequestContext) RouteVarUUID(name string) (*UUID, *errors.Error) {
+	val, err := self.requiredRouteVar(name)
+	if err != nil {
+		return nil, err
+	}
+	uuid := UUIDFromString(val)
+	if uuid == nil {
+		return nil, self.newInvalidRouteVarError(
+			name,
+			fmt.Sprintf("'%s' should be a uuid", name),
+		)
+	}
+	return uuid, nil
+}
+
+func (self *RequestContext) RouteVarInt64(name string) (int64, *errors.Error) {
+	val, err := self.requiredRouteVar(name)
+	if err != nil {
+		return 0, err
+	}
+	i, conv_err := strconv.ParseInt(val, 10, 64)
+	if conv_err != nil {
+		return 0, self.newInvalidRouteVarError(
+			name,
+			fmt.Sprintf("'%s' should be an integer", name),
+		)
+	}
+	return i, nil
+}
+
+func (self *RequestContext) RouteVarBool(name string) (bool, *errors.Error) {
+	val, err := self.requiredRouteVar(name)
+	if err != nil {
+		return false, err
+	}
+	b, conv_err := strconv.ParseBool(val)
+	if conv_err != nil {
+		return false, self.newInvalidRouteVarError(
+			name,
+			fmt.Sprintf("'%s' should be a boolean", name),
+		)
+	}
+	return b, nil
+}
+
+// Returns the route var if it's one of the allowed values
+func (self *RequestContext) RouteVarEnum(name string, allowed ...string) (string, *errors.Error) {
+	val, err := self.requiredRouteVar(name)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range allowed {
+		if val == a {
+			return val, nil
+		}
+	}
+	return "", self.newInvalidRouteVarError(
+		name,
+		fmt.Sprintf("'%s' should be one of: %s", name, strings.Join(allowed, ", ")),
+	)
+}
+
+// Parses the route var with the given time layout. If layout is "",
+// time.RFC3339 is used.
+func (self *RequestContext) RouteVarTime(name string, layout string) (time.Time, *errors.Error) {
+	val, err := self.requiredRouteVar(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	t, conv_err := time.Parse(layout, val)
+	if conv_err != nil {
+		return time.Time{}, self.newInvalidRouteVarError(
+			name,
+			fmt.Sprintf("'%s' should be a time in the format %s", name, layout),
+		)
+	}
+	return t, nil
+}
+
+// Called when a route var fails a constraint declared in the route
+// path, like {id:uuid}
+func (self *Controller) handleInvalidRouteVar(ctx context.Context, var_err *api_router.RouteVarError) {
+	rctx := self.RequestContext(ctx)
+	self.WriteResponse(rctx, rctx.newInvalidRouteVarError(
+		var_err.Name,
+		fmt.Sprintf("Route var '%s': %s", var_err.Name, var_err.Err),
+	))
+}
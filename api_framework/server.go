@@ -0,0 +1,224 @@
+package api_framework
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type ShutdownHookFn func(context.Context) error
+
+func (self ShutdownHookFn) Shutdown(ctx context.Context) error {
+	return self(ctx)
+}
+
+type ShutdownHook interface {
+	Shutdown(context.Context) error
+}
+
+var ErrServerAlreadyRunning = errors.New("Server is already running")
+
+// Register a hook to be called after the server has stopped accepting
+// connections and in-flight requests have drained. Hooks are called in
+// reverse order of registration, like defers.
+func (self *Controller) AddShutdownHook(hook ShutdownHook) *Controller {
+	self.serverLock.Lock()
+	defer self.serverLock.Unlock()
+	self.shutdownHooks = append(self.shutdownHooks, hook)
+	return self
+}
+
+// The port we'll listen on. ControllerOpts.ServicePort takes precedence
+// over AppContext.ServicePort()
+func (self *Controller) ServicePort() int {
+	if port := self.options.ServicePort; port != 0 {
+		return port
+	}
+	return self.appContext.ServicePort()
+}
+
+func (self *Controller) newHTTPServer() *http.Server {
+	return &http.Server{
+		Handler:      self,
+		ReadTimeout:  self.options.ServerReadTimeout,
+		WriteTimeout: self.options.ServerWriteTimeout,
+		IdleTimeout:  self.options.ServerIdleTimeout,
+	}
+}
+
+type runningServer struct {
+	server     *http.Server
+	shutdownCh chan struct{}
+	// Closed once we start draining requests
+	drainingCh chan struct{}
+	doneCh     chan struct{}
+	shutdownFn sync.Once
+}
+
+// Serve requests on an existing listener until the context is cancelled,
+// SIGINT or SIGTERM is received, or Shutdown() is called. In-flight
+// requests are given ControllerOpts.ShutdownTimeout to finish, after
+// which shutdown hooks are run.
+func (self *Controller) Serve(ctx context.Context, listener net.Listener) error {
+	self.serverLock.Lock()
+	if self.server != nil {
+		self.serverLock.Unlock()
+		return ErrServerAlreadyRunning
+	}
+	running := &runningServer{
+		server:     self.newHTTPServer(),
+		shutdownCh: make(chan struct{}),
+		drainingCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	self.server = running
+	self.serverLock.Unlock()
+
+	defer func() {
+		self.serverLock.Lock()
+		self.server = nil
+		self.serverLock.Unlock()
+		close(running.doneCh)
+	}()
+
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig_ch)
+
+	serve_err_ch := make(chan error, 1)
+	go func() {
+		serve_err_ch <- running.server.Serve(listener)
+	}()
+
+	self.logger.LogInfof(ctx, "Server started on %s", listener.Addr())
+
+	select {
+	case err := <-serve_err_ch:
+		self.logger.LogErrorf(ctx, "Server exited unexpectedly: %s", err)
+		self.runShutdownHooks(ctx)
+		return err
+	case sig := <-sig_ch:
+		self.logger.LogInfof(ctx, "Received signal %s, shutting down", sig)
+	case <-ctx.Done():
+		self.logger.LogInfof(ctx, "Context finished, shutting down: %s", ctx.Err())
+	case <-running.shutdownCh:
+		self.logger.LogInfo(ctx, "Shutdown requested")
+	}
+
+	close(running.drainingCh)
+	err := self.drain(ctx, running.server)
+	<-serve_err_ch
+
+	if hook_err := self.runShutdownHooks(ctx); err == nil {
+		err = hook_err
+	}
+
+	self.logger.LogInfo(ctx, "Server stopped")
+
+	return err
+}
+
+// Listen on ServicePort() and serve requests. See Serve().
+func (self *Controller) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", self.ServicePort()))
+	if err != nil {
+		return err
+	}
+	return self.Serve(ctx, listener)
+}
+
+// Ask a running Serve() or Run() to shut down, and wait until it has
+// drained in-flight requests and run shutdown hooks, or until ctx is
+// done.
+func (self *Controller) Shutdown(ctx context.Context) error {
+	self.serverLock.Lock()
+	running := self.server
+	self.serverLock.Unlock()
+
+	if running == nil {
+		return nil
+	}
+
+	running.shutdownFn.Do(func() {
+		close(running.shutdownCh)
+	})
+
+	select {
+	case <-running.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Closed once a running server starts draining requests. nil if we're
+// not running a server.
+func (self *Controller) serverDraining() <-chan struct{} {
+	self.serverLock.Lock()
+	defer self.serverLock.Unlock()
+	if self.server == nil {
+		return nil
+	}
+	return self.server.drainingCh
+}
+
+func (self *Controller) drain(ctx context.Context, server *http.Server) error {
+	// Don't inherit cancellation from ctx. It may be the very thing
+	// that told us to shut down.
+	var drain_ctx context.Context = context.Background()
+	if timeout := self.options.ShutdownTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		drain_ctx, cancel = context.WithTimeout(drain_ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	self.logger.LogInfo(ctx, "Draining in-flight requests")
+
+	if err := server.Shutdown(drain_ctx); err != nil {
+		self.logger.LogErrorf(ctx, "Error draining requests: %s", err)
+		server.Close()
+		return err
+	}
+
+	self.logger.LogInfof(ctx, "Drained in-flight requests in %s", time.Since(start))
+	return nil
+}
+
+func (self *Controller) runShutdownHooks(ctx context.Context) error {
+	self.serverLock.Lock()
+	hooks := make([]ShutdownHook, len(self.shutdownHooks))
+	copy(hooks, self.shutdownHooks)
+	self.serverLock.Unlock()
+
+	var hook_ctx context.Context = context.Background()
+	if timeout := self.options.ShutdownTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		hook_ctx, cancel = context.WithTimeout(hook_ctx, timeout)
+		defer cancel()
+	}
+
+	var first_err error
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].Shutdown(hook_ctx); err != nil {
+			self.logger.LogErrorf(ctx, "Error from shutdown hook: %s", err)
+			if first_err == nil {
+				first_err = err
+			}
+		}
+	}
+
+	if len(hooks) != 0 {
+		self.logger.LogInfof(ctx, "Ran %d shutdown hook(s)", len(hooks))
+	}
+
+	return first_err
+}
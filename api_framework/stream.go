@@ -0,0 +1,198 @@
+package api_framework
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tilteng/go-api-framework/serializers_mw"
+)
+
+const (
+	NDJSONMediaType      = "application/x-ndjson"
+	EventStreamMediaType = "text/event-stream"
+)
+
+var ErrStreamClosed = errors.New("Stream is closed")
+
+type StreamEvent serializers_mw.ServerSentEvent
+
+// Writes a response a record or event at a time, flushing after each.
+// Server-sent events are used if text/event-stream was negotiated from
+// Accept:, otherwise NDJSON. Add the media types you want to stream to
+// ControllerOpts.ProducesContent. Streams end when the client goes
+// away, when the server starts shutting down, or when the route
+// returns. ControllerOpts.ServerWriteTimeout also ends a stream once it's
+// passed, counting from when the request was read, and it defaults to 60
+// seconds. Set it to 0 if streams should run longer.
+type Stream struct {
+	rctx      *RequestContext
+	ctx       context.Context
+	cancel    context.CancelFunc
+	flusher   http.Flusher
+	events    bool
+	lock      sync.Mutex
+	started   bool
+	heartbeat *time.Ticker
+	err       error
+}
+
+// Returns the stream for this request, starting it if needed. Headers
+// and status should be set before the first Send().
+func (self *Controller) Stream(ctx context.Context) *Stream {
+	rctx := self.RequestContext(ctx)
+	if rctx.stream != nil {
+		return rctx.stream
+	}
+
+	stream := &Stream{rctx: rctx}
+	stream.ctx, stream.cancel = context.WithCancel(rctx)
+	stream.flusher, _ = rctx.ResponseWriter().(http.Flusher)
+
+	if ser_rctx := rctx.serializerRequestContext; ser_rctx != nil {
+		ctype := strings.SplitN(ser_rctx.ContentType(), ";", 2)[0]
+		stream.events = strings.EqualFold(strings.TrimSpace(ctype), EventStreamMediaType)
+	}
+
+	if draining := self.serverDraining(); draining != nil {
+		go func() {
+			select {
+			case <-draining:
+				stream.Close()
+			case <-stream.ctx.Done():
+			}
+		}()
+	}
+
+	rctx.stream = stream
+	return stream
+}
+
+// Closed when the stream ends
+func (self *Stream) Done() <-chan struct{} {
+	return self.ctx.Done()
+}
+
+// Whether events are server-sent events rather than NDJSON
+func (self *Stream) IsEventStream() bool {
+	return self.events
+}
+
+// Send a comment every interval, so proxies and clients don't time out
+// an idle stream. Only used for server-sent events.
+func (self *Stream) SetHeartbeat(interval time.Duration) *Stream {
+	if !self.events || interval <= 0 {
+		return self
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.heartbeat != nil {
+		self.heartbeat.Stop()
+	}
+	ticker := time.NewTicker(interval)
+	self.heartbeat = ticker
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				self.write(func() error {
+					return self.rctx.WriteResponseString(":\n\n")
+				})
+			case <-self.ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return self
+}
+
+// Send a record. For server-sent events, this is an event with v as its
+// data.
+func (self *Stream) Send(v interface{}) error {
+	if self.events {
+		return self.SendEvent(&StreamEvent{Data: v})
+	}
+	return self.write(func() error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return self.rctx.WriteResponse(append(data, '\n'))
+	})
+}
+
+// Send an event. For NDJSON, only its data is sent.
+func (self *Stream) SendEvent(event *StreamEvent) error {
+	if !self.events {
+		return self.Send(event.Data)
+	}
+	return self.write(func() error {
+		_, err := (*serializers_mw.ServerSentEvent)(event).WriteTo(
+			self.rctx.ResponseWriter(),
+		)
+		return err
+	})
+}
+
+// End the stream. Called automatically when the route returns.
+func (self *Stream) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.cancel()
+}
+
+func (self *Stream) start() {
+	self.started = true
+	rctx := self.rctx
+	ctype := NDJSONMediaType
+	if self.events {
+		ctype = EventStreamMediaType
+	}
+	rctx.SetResponseHeader("Content-Type", ctype)
+	rctx.SetResponseHeader("Cache-Control", "no-cache")
+	// Ask nginx not to buffer
+	rctx.SetResponseHeader("X-Accel-Buffering", "no")
+	rctx.setPaginationHeader(rctx.paginationLinks())
+	rctx.ResponseWriter().DisableResponseCopy()
+	rctx.WriteStatusHeader()
+}
+
+func (self *Stream) write(fn func() error) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.err != nil {
+		return self.err
+	}
+	if self.ctx.Err() != nil {
+		return ErrStreamClosed
+	}
+	if !self.started {
+		self.start()
+	}
+
+	if err := fn(); err != nil {
+		// Most likely the client went away
+		self.err = err
+		self.cancel()
+		return err
+	}
+	if self.flusher != nil {
+		self.flusher.Flush()
+	}
+	return nil
+}
+
+func (self *RequestContext) closeStream() {
+	if self.stream != nil {
+		self.stream.Close()
+	}
+}
@@ -1,9 +1,11 @@
 package api_framework
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/pborman/uuid"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 type UUID struct {
@@ -38,3 +40,38 @@ func UUIDFromString(s string) *UUID {
 		return &UUID{uuid}
 	}
 }
+
+// Encoded as 16 raw bytes by the msgpack serializer, rather than a
+// 36 character string
+func (self UUID) MarshalMsgpack() ([]byte, error) {
+	if self.UUID == nil {
+		return msgpack.Marshal(nil)
+	}
+	return msgpack.Marshal([]byte(self.UUID))
+}
+
+// Accepts the raw bytes or the string form
+func (self *UUID) UnmarshalMsgpack(b []byte) error {
+	var v interface{}
+	if err := msgpack.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+		self.UUID = nil
+	case []byte:
+		if len(v) != 16 {
+			return fmt.Errorf("invalid uuid length: %d", len(v))
+		}
+		self.UUID = append(uuid.UUID{}, v...)
+	case string:
+		parsed := uuid.Parse(v)
+		if parsed == nil {
+			return fmt.Errorf("invalid uuid: %s", v)
+		}
+		self.UUID = parsed
+	default:
+		return fmt.Errorf("invalid uuid: %v", v)
+	}
+	return nil
+}
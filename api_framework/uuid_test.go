@@ -0,0 +1,61 @@
+package api_framework
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tilteng/go-api-framework/serializers_mw"
+)
+
+func TestUUIDMsgpack(t *testing.T) {
+	id := UUIDFromString("0c595954-5418-490e-9831-5623f82aa5ad")
+
+	type kitten struct {
+		Id     UUID  `json:"id"`
+		Parent *UUID `json:"parent"`
+	}
+
+	b, err := serializers_mw.MsgpackMarshal(&kitten{Id: *id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 16 raw bytes, after the map, key, and bin headers
+	if !bytes.Contains(b, append([]byte{0xc4, 16}, id.UUID...)) {
+		t.Errorf("encoded as % x, want the 16 raw bytes", b)
+	}
+	got := &kitten{}
+	if err := serializers_mw.MsgpackUnmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Id.String() != id.String() || got.Parent != nil {
+		t.Errorf("decoded %v and %v, want %v and nil", got.Id, got.Parent, id)
+	}
+
+	tests := []struct {
+		name string
+		v    interface{}
+		ok   bool
+	}{
+		{"string form", id.String(), true},
+		{"raw bytes", []byte(id.UUID), true},
+		{"short bytes", []byte(id.UUID)[:15], false},
+		{"bad string", "not-a-uuid", false},
+		{"number", 5, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := serializers_mw.MsgpackMarshal(test.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &UUID{}
+			err = serializers_mw.MsgpackUnmarshal(b, got)
+			if (err == nil) != test.ok {
+				t.Fatalf("error is %v, want ok %v", err, test.ok)
+			}
+			if test.ok && got.String() != id.String() {
+				t.Errorf("decoded %v, want %v", got, id)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package api_framework
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/ww/goautoneg"
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-errors/errors"
+)
+
+// Configures API versioning. Each version's routes live under a path
+// prefix, like /v2/kittens. Requests without the prefix are routed to
+// the version asked for in Header or in the MediaType's "version"
+// parameter in Accept:, or else to DefaultVersion.
+type APIVersioningOpts struct {
+	// Known versions, oldest first. Eg, []string{"1", "2"}
+	Versions []string
+	// Used when a request doesn't ask for a version. Defaults to the
+	// last of Versions.
+	DefaultVersion string
+	// Deprecated versions, with the date each was (or will be)
+	// deprecated. They still work, but responses get a Deprecation
+	// header with the date (RFC 9745), and their routes are marked
+	// deprecated in the OpenAPI document.
+	DeprecatedVersions map[string]time.Time
+	// fmt format for a version's path prefix. Defaults to "/v%s"
+	PathPrefixFormat string
+	// If set, the version may be given in this request header. Eg,
+	// "X-API-Version"
+	Header string
+	// If set, the version may be given as a "version" parameter on this
+	// media type in Accept:. Eg, "application/vnd.app+json" allows
+	// "Accept: application/vnd.app+json; version=2"
+	MediaType string
+	// Deprecation header values by version, set by init()
+	deprecationHeaders map[string]string
+}
+
+func (self *APIVersioningOpts) isKnownVersion(version string) bool {
+	for _, v := range self.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *APIVersioningOpts) isDeprecatedVersion(version string) bool {
+	_, ok := self.DeprecatedVersions[version]
+	return ok
+}
+
+func (self *APIVersioningOpts) pathPrefix(version string) string {
+	return fmt.Sprintf(self.PathPrefixFormat, version)
+}
+
+// Fill in defaults and make sure the options make sense
+func (self *APIVersioningOpts) init() {
+	if len(self.Versions) == 0 {
+		panic("APIVersioningOpts must list at least one version")
+	}
+	if self.DefaultVersion == "" {
+		self.DefaultVersion = self.Versions[len(self.Versions)-1]
+	}
+	if !self.isKnownVersion(self.DefaultVersion) {
+		panic(fmt.Sprintf("Default API version '%s' is not in Versions", self.DefaultVersion))
+	}
+	self.deprecationHeaders = map[string]string{}
+	for v, date := range self.DeprecatedVersions {
+		if !self.isKnownVersion(v) {
+			panic(fmt.Sprintf("Deprecated API version '%s' is not in Versions", v))
+		}
+		if date.IsZero() {
+			panic(fmt.Sprintf("Deprecated API version '%s' must have a date", v))
+		}
+		// A structured field Date
+		self.deprecationHeaders[v] = "@" + strconv.FormatInt(date.Unix(), 10)
+	}
+	if self.PathPrefixFormat == "" {
+		self.PathPrefixFormat = "/v%s"
+	}
+}
+
+// The API version resolved for a request
+type apiVersion struct {
+	version    string
+	deprecated bool
+	// Version asked for, if it's not one we know about
+	unsupported string
+}
+
+var apiVersionCtxKey = &contextKey{"api_version"}
+
+// The API version resolved for this request, or "" if versioning is not
+// enabled.
+func (self *RequestContext) APIVersion() string {
+	if ver, ok := self.Value(apiVersionCtxKey).(*apiVersion); ok {
+		return ver.version
+	}
+	return ""
+}
+
+func (self *RequestContext) APIVersionDeprecated() bool {
+	if ver, ok := self.Value(apiVersionCtxKey).(*apiVersion); ok {
+		return ver.deprecated
+	}
+	return false
+}
+
+// Returns the group for a version's routes, creating it if needed.
+// Route options and middleware for every route in the version can be
+// set on the group.
+func (self *Controller) APIVersion(version string) *RouteGroup {
+	opts := self.options.APIVersioning
+	if opts == nil {
+		panic("APIVersion() called without ControllerOpts.APIVersioning set")
+	}
+	if !opts.isKnownVersion(version) {
+		panic(fmt.Sprintf("Unknown API version '%s'", version))
+	}
+
+	if group, ok := self.apiVersionGroups[version]; ok {
+		return group
+	}
+
+	var group_opts []interface{}
+	if opts.isDeprecatedVersion(version) {
+		group_opts = append(group_opts, &OpenAPIOpts{Deprecated: true})
+	}
+
+	group := self.Group(opts.pathPrefix(version), group_opts...)
+	if self.apiVersionGroups == nil {
+		self.apiVersionGroups = map[string]*RouteGroup{}
+	}
+	self.apiVersionGroups[version] = group
+	return group
+}
+
+// Registers routes under several API versions at once
+type APIVersionSet struct {
+	groups []*RouteGroup
+}
+
+func (self *Controller) APIVersions(versions ...string) *APIVersionSet {
+	set := &APIVersionSet{}
+	for _, version := range versions {
+		set.groups = append(set.groups, self.APIVersion(version))
+	}
+	return set
+}
+
+func (self *APIVersionSet) NewRoute(method string, path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	routes := make([]*api_router.Route, len(self.groups))
+	for i, group := range self.groups {
+		routes[i] = group.NewRoute(method, path, fn, opts...)
+	}
+	return routes
+}
+
+func (self *APIVersionSet) DELETE(path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	return self.NewRoute("DELETE", path, fn, opts...)
+}
+
+func (self *APIVersionSet) GET(path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	return self.NewRoute("GET", path, fn, opts...)
+}
+
+func (self *APIVersionSet) HEAD(path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	return self.NewRoute("HEAD", path, fn, opts...)
+}
+
+func (self *APIVersionSet) PATCH(path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	return self.NewRoute("PATCH", path, fn, opts...)
+}
+
+func (self *APIVersionSet) POST(path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	return self.NewRoute("POST", path, fn, opts...)
+}
+
+func (self *APIVersionSet) PUT(path string, fn api_router.RouteFn, opts ...interface{}) []*api_router.Route {
+	return self.NewRoute("PUT", path, fn, opts...)
+}
+
+// Returns the version and whether it came from the path prefix
+func (self *Controller) apiVersionFromPath(path string) (string, bool) {
+	opts := self.options.APIVersioning
+	for _, version := range opts.Versions {
+		prefix := opts.pathPrefix(version)
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// Version asked for in the header or Accept:, if any
+func (self *Controller) requestedAPIVersion(r *http.Request) string {
+	opts := self.options.APIVersioning
+
+	if opts.Header != "" {
+		if version := strings.TrimSpace(r.Header.Get(opts.Header)); version != "" {
+			return version
+		}
+	}
+
+	if opts.MediaType != "" {
+		if accept := r.Header.Get("Accept"); accept != "" {
+			// Media types and their parameter names are case insensitive
+			for _, clause := range goautoneg.ParseAccept(accept) {
+				if !strings.EqualFold(clause.Type+"/"+clause.SubType, opts.MediaType) {
+					continue
+				}
+				for name, version := range clause.Params {
+					if strings.EqualFold(name, "version") && version != "" {
+						return version
+					}
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// Resolve the API version for a request. Requests without a version
+// path prefix are rewritten to the resolved version's path. If no route
+// matches that, the router serves the original path instead.
+func (self *Controller) versionedRequest(w http.ResponseWriter, r *http.Request) *http.Request {
+	opts := self.options.APIVersioning
+	ver := &apiVersion{}
+
+	version, from_path := self.apiVersionFromPath(r.URL.Path)
+	if !from_path {
+		if opts.Header != "" {
+			w.Header().Add("Vary", opts.Header)
+		}
+		if opts.MediaType != "" {
+			w.Header().Add("Vary", "Accept")
+		}
+		version = self.requestedAPIVersion(r)
+		if version == "" {
+			version = opts.DefaultVersion
+		} else if !opts.isKnownVersion(version) {
+			// Still route to the default version, so the error goes
+			// through the usual middleware.
+			ver.unsupported = version
+			version = opts.DefaultVersion
+		}
+	}
+
+	ver.version = version
+	if header, ok := opts.deprecationHeaders[version]; ok {
+		ver.deprecated = true
+		w.Header().Set("Deprecation", header)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), apiVersionCtxKey, ver))
+	if from_path {
+		return r
+	}
+
+	orig_req := r
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// Not a versioned route, like the OpenAPI document
+		ver.unsupported = ""
+		self.Router.ServeHTTP(w, orig_req)
+	})
+
+	prefix := opts.pathPrefix(version)
+	versioned_url := *r.URL
+	versioned_url.Path = prefix + r.URL.Path
+	if versioned_url.RawPath != "" {
+		versioned_url.RawPath = prefix + r.URL.RawPath
+	}
+	versioned_req := api_router.WithUnmatchedFallback(r, fallback)
+	versioned_req.URL = &versioned_url
+	return versioned_req
+}
+
+// Implements http.Handler. With API versioning enabled, requests are
+// routed to the right version first.
+func (self *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if self.options.APIVersioning != nil {
+		r = self.versionedRequest(w, r)
+	}
+	self.Router.ServeHTTP(w, r)
+}
+
+// Returns ErrUnsupportedAPIVersion if the request asked for a version
+// we don't know about.
+func (self *RequestContext) checkAPIVersion() *errors.Error {
+	ver, ok := self.Value(apiVersionCtxKey).(*apiVersion)
+	if !ok || ver.unsupported == "" {
+		return nil
+	}
+	return ErrUnsupportedAPIVersion.New(
+		self,
+		fmt.Sprintf("API version '%s' is not supported", ver.unsupported),
+	)
+}
@@ -0,0 +1,89 @@
+package api_framework
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-app-context/app_context"
+)
+
+func newVersionedTestController(t *testing.T, router *api_router.Router) *Controller {
+	actx, err := app_context.NewAppContext("versioning-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewControllerOpts(actx)
+	opts.BaseRouter = router
+	opts.OpenAPIRoutePath = "/openapi.json"
+	opts.APIVersioning = &APIVersioningOpts{
+		Versions: []string{"1", "2"},
+		DeprecatedVersions: map[string]time.Time{
+			"1": time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		Header:    "X-API-Version",
+		MediaType: "application/vnd.kittens+json",
+	}
+	c := NewController(opts)
+	if err := c.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.APIVersions("1", "2").GET("/ping", func(ctx context.Context) {
+		rctx := c.RequestContext(ctx)
+		c.WriteResponse(rctx, rctx.APIVersion())
+	})
+	c.APIVersion("2").GET("/only2", func(ctx context.Context) {
+		c.WriteResponse(ctx, "2")
+	})
+	return c
+}
+
+func TestAPIVersioning(t *testing.T) {
+	tests := []struct {
+		path        string
+		header      string
+		value       string
+		status      int
+		body        string
+		deprecation string
+	}{
+		{"/ping", "", "", 200, `"2"`, ""},
+		{"/v1/ping", "", "", 200, `"1"`, "@1767225600"},
+		{"/ping", "X-API-Version", "1", 200, `"1"`, "@1767225600"},
+		{"/ping", "Accept", "application/vnd.kittens+json; version=1", 200, `"1"`, "@1767225600"},
+		{"/ping", "X-API-Version", "9", 400, "", ""},
+		{"/only2", "", "", 200, `"2"`, ""},
+		{"/only2", "X-API-Version", "1", 404, "", "@1767225600"},
+		// Not versioned, so served from the path as given
+		{"/openapi.json", "X-API-Version", "9", 200, "", ""},
+		{"/v3/ping", "", "", 404, "", ""},
+	}
+
+	for name, router := range map[string]*api_router.Router{
+		"mux":   api_router.NewMuxRouter(),
+		"radix": api_router.NewRadixRouter(),
+	} {
+		c := newVersionedTestController(t, router)
+		for _, test := range tests {
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("%s: GET %s with %s: %s got status %d, want %d", name, test.path, test.header, test.value, w.Code, test.status)
+				continue
+			}
+			if body := strings.TrimSpace(w.Body.String()); test.body != "" && body != test.body {
+				t.Errorf("%s: GET %s with %s: %s got body %s, want %s", name, test.path, test.header, test.value, body, test.body)
+			}
+			if got := w.Header().Get("Deprecation"); got != test.deprecation {
+				t.Errorf("%s: GET %s with %s: %s got Deprecation %q, want %q", name, test.path, test.header, test.value, got, test.deprecation)
+			}
+		}
+	}
+}
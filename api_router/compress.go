@@ -0,0 +1,244 @@
+package api_router
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content encodings we can compress responses with, most preferred first
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// Returns the content encoding to compress a response with, according to
+// Accept-Encoding, or "" if the response shouldn't be compressed.
+func NegotiateContentEncoding(accept_encoding string) string {
+	if accept_encoding == "" {
+		return ""
+	}
+
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(accept_encoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		qvalues[coding] = q
+	}
+
+	best := ""
+	best_q := 0.0
+	for _, encoding := range compressionEncodings {
+		q, ok := qvalues[encoding]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > best_q {
+			best = encoding
+			best_q = q
+		}
+	}
+	return best
+}
+
+type compressEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPoolsLock sync.Mutex
+var encoderPools = map[string]*sync.Pool{}
+
+func encoderPool(encoding string, level int) *sync.Pool {
+	key := fmt.Sprintf("%s:%d", encoding, level)
+
+	encoderPoolsLock.Lock()
+	defer encoderPoolsLock.Unlock()
+
+	pool, ok := encoderPools[key]
+	if !ok {
+		pool = &sync.Pool{
+			New: func() interface{} {
+				var enc compressEncoder
+				var err error
+				if encoding == "gzip" {
+					enc, err = gzip.NewWriterLevel(nil, level)
+				} else {
+					enc, err = flate.NewWriter(nil, level)
+				}
+				if err != nil {
+					panic(err)
+				}
+				return enc
+			},
+		}
+		encoderPools[key] = pool
+	}
+	return pool
+}
+
+// Media types that are already compressed
+func isCompressedContentType(ctype string) bool {
+	ctype = strings.ToLower(strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0]))
+	switch {
+	case strings.HasPrefix(ctype, "image/") && ctype != "image/svg+xml",
+		strings.HasPrefix(ctype, "video/"),
+		strings.HasPrefix(ctype, "audio/"):
+		return true
+	}
+	switch ctype {
+	case "application/gzip", "application/zip", "application/x-gzip",
+		"application/x-compress", "application/x-bzip2", "application/x-xz",
+		"application/zstd", "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+type responseCompression struct {
+	encoding string
+	minSize  int
+	level    int
+	// Held back until we know whether the response is big enough
+	pending []byte
+	decided bool
+	encoder compressEncoder
+	pool    *sync.Pool
+}
+
+// Counts compressed bytes on their way to the client
+type compressedWriter struct {
+	writer *baseResponseWriter
+}
+
+func (self compressedWriter) Write(b []byte) (int, error) {
+	return self.writer.send(b)
+}
+
+// Whether bytes are being held back until we decide to compress
+func (self *baseResponseWriter) compressionPending() bool {
+	return self.compression != nil && !self.compression.decided
+}
+
+// Send the status header, choosing whether to compress first. Anything
+// held back is written out.
+func (self *baseResponseWriter) decideCompression(compress bool) error {
+	c := self.compression
+	c.decided = true
+
+	hdrs := self.ResponseWriter.Header()
+	if compress &&
+		hdrs.Get("Content-Encoding") == "" &&
+		!isCompressedContentType(hdrs.Get("Content-Type")) &&
+		self.status >= 200 && self.status != 204 && self.status != 304 {
+		hdrs.Set("Content-Encoding", c.encoding)
+		hdrs.Del("Content-Length")
+		c.pool = encoderPool(c.encoding, c.level)
+		c.encoder = c.pool.Get().(compressEncoder)
+		c.encoder.Reset(compressedWriter{self})
+	}
+
+	if !self.headOnly {
+		self.ResponseWriter.WriteHeader(self.status)
+	}
+
+	pending := c.pending
+	c.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	if c.encoder != nil {
+		_, err := c.encoder.Write(pending)
+		return err
+	}
+	_, err := self.send(pending)
+	return err
+}
+
+// HEAD responses are compressed too, so their headers and
+// Content-Length match GET's
+func (self *baseResponseWriter) EnableCompression(encoding string, min_size int, level int) {
+	if self.statusWritten || self.compression != nil {
+		return
+	}
+	if encoding != "gzip" && encoding != "deflate" {
+		return
+	}
+	self.compression = &responseCompression{
+		encoding: encoding,
+		minSize:  min_size,
+		level:    level,
+	}
+}
+
+func (self *baseResponseWriter) FinishCompression() error {
+	c := self.compression
+	if c == nil {
+		return nil
+	}
+	if !self.statusWritten {
+		self.writeStatusHeader()
+	}
+	var err error
+	if !c.decided {
+		err = self.decideCompression(false)
+	}
+	if c.encoder != nil {
+		if close_err := c.encoder.Close(); err == nil {
+			err = close_err
+		}
+		c.encoder.Reset(nil)
+		c.pool.Put(c.encoder)
+		c.encoder = nil
+	}
+	return err
+}
+
+func (self *baseResponseWriter) flush() {
+	if self.hold {
+		if !self.statusWritten {
+			self.writeStatusHeader()
+		}
+		self.ReleaseResponse()
+	}
+	c := self.compression
+	if c == nil {
+		return
+	}
+	if !self.statusWritten {
+		self.writeStatusHeader()
+	}
+	if !c.decided {
+		// Can't hold back any longer
+		self.decideCompression(len(c.pending) >= c.minSize)
+	} else if c.encoder != nil {
+		c.encoder.Flush()
+	}
+}
+
+// Flushes anything held back for compression before flushing the
+// underlying writer
+type responseFlusher struct {
+	writer  *baseResponseWriter
+	flusher http.Flusher
+}
+
+func (self responseFlusher) Flush() {
+	self.writer.flush()
+	self.flusher.Flush()
+}
@@ -0,0 +1,27 @@
+package api_router
+
+import "net/http"
+
+type FrameworkRoute interface {
+	RouteVars(*http.Request) map[string]string
+}
+
+// Optionally implemented by a FrameworkRoute that can look up one var
+// without building a map of them all. RequestContext.RouteVar() uses it
+// instead of RouteVars() when it's available.
+type FrameworkRouteVarFinder interface {
+	RouteVar(r *http.Request, name string) (string, bool)
+}
+
+type FrameworkRouter interface {
+	http.Handler
+	NewRoute(method string, path string, fn http.HandlerFunc) FrameworkRoute
+	SubRouterForPath(path string) FrameworkRouter
+	Set404Handler(fn http.HandlerFunc)
+	// Whether any route matches the request, including its method
+	MatchesRequest(r *http.Request) bool
+}
+
+type Framework interface {
+	NewRouter() FrameworkRouter
+}
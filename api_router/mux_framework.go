@@ -18,8 +18,26 @@ type muxRouter struct {
 	*mux.Router
 }
 
+// Wraps 404 handlers so MatchesRequest() can tell them apart from
+// real routes.
+type muxNotFoundHandler struct {
+	http.HandlerFunc
+}
+
 func (self *muxRouter) Set404Handler(fn http.HandlerFunc) {
-	self.Router.NotFoundHandler = fn
+	self.Router.NotFoundHandler = &muxNotFoundHandler{fn}
+}
+
+func (self *muxRouter) MatchesRequest(r *http.Request) bool {
+	var match mux.RouteMatch
+	// Match() also succeeds when only a NotFoundHandler matched. When
+	// that's a sub router's NotFoundHandler, match.Route is even set to
+	// the sub router's path prefix route.
+	if !self.Router.Match(r, &match) {
+		return false
+	}
+	_, not_found := match.Handler.(*muxNotFoundHandler)
+	return !not_found
 }
 
 func (self *muxRouter) NewRoute(method string, path string, fn http.HandlerFunc) FrameworkRoute {
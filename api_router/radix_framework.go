@@ -0,0 +1,593 @@
+package api_router
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// A dependency-free Framework built on a radix tree. Path templates use
+// the same syntax as the mux framework: {name} matches a single path
+// segment and {name:pattern} matches a segment against a regular
+// expression. A trailing {name:pattern} whose pattern can match a '/'
+// (eg, {path:.*}) matches the rest of the path.
+//
+// Like mux, when more than one route matches a request, the one added
+// first wins, with a sub router's routes and 404 handler counting from
+// when the sub router was added. Templates that mux would match
+// differently are rejected when the route is added: a var must be
+// followed by a '/' or the end of the template, and a var whose pattern
+// can match a '/' must end it.
+
+var _radixFramework = &radixFramework{}
+
+type radixFramework struct{}
+
+func (self *radixFramework) NewRouter() FrameworkRouter {
+	tree := &radixTree{}
+	tree.router = &radixRouter{tree: tree}
+	return tree.router
+}
+
+func RadixFramework() Framework {
+	return _radixFramework
+}
+
+func NewRadixRouter() *Router {
+	return NewRouter(_radixFramework)
+}
+
+type radixToken struct {
+	static   string
+	isVar    bool
+	name     string
+	pattern  string
+	regexp   *regexp.Regexp
+	catchAll bool
+}
+
+// Where a route or 404 handler is in the order mux tries them: the
+// index of each sub router it's under, from the top, and then its own
+// index among its router's routes and sub routers. So it's known when
+// it's added, even if later routes are added ahead of it. A nil seq
+// sorts after every other.
+type radixSeq []int
+
+// Sorts after everything added to a router
+const radixNotFoundIndex = int(^uint(0) >> 1)
+
+func (self radixSeq) child(index int) radixSeq {
+	return append(append(make(radixSeq, 0, len(self)+1), self...), index)
+}
+
+func (self radixSeq) before(other radixSeq) bool {
+	if self == nil {
+		return false
+	}
+	if other == nil {
+		return true
+	}
+	for i := 0; i < len(self) && i < len(other); i++ {
+		if self[i] != other[i] {
+			return self[i] < other[i]
+		}
+	}
+	return len(self) < len(other)
+}
+
+type radixRoute struct {
+	handler http.HandlerFunc
+	method  string
+	tokens  []*radixToken
+	numVars int
+	seq     radixSeq
+}
+
+// Returned for routes without vars. It must not be modified.
+var noRadixRouteVars = map[string]string{}
+
+// Calls fn with each var's name and value, by walking our own template
+// over the path, until it returns false. Values are substrings of the
+// path.
+func (self *radixRoute) walkVars(p string, fn func(name, value string) bool) {
+	for _, tok := range self.tokens {
+		if !tok.isVar {
+			if len(p) < len(tok.static) {
+				return
+			}
+			p = p[len(tok.static):]
+			continue
+		}
+		if tok.catchAll {
+			fn(tok.name, p)
+			return
+		}
+		end := strings.IndexByte(p, '/')
+		if end == -1 {
+			end = len(p)
+		}
+		if !fn(tok.name, p[:end]) {
+			return
+		}
+		p = p[end:]
+	}
+}
+
+// The map is the only allocation, and routes without vars don't
+// allocate at all. RequestContext uses RouteVar() instead, which
+// doesn't allocate.
+func (self *radixRoute) RouteVars(r *http.Request) map[string]string {
+	if self.numVars == 0 {
+		return noRadixRouteVars
+	}
+	vars := make(map[string]string, self.numVars)
+	self.walkVars(r.URL.Path, func(name, value string) bool {
+		vars[name] = value
+		return true
+	})
+	return vars
+}
+
+// Implements FrameworkRouteVarFinder
+func (self *radixRoute) RouteVar(r *http.Request, name string) (string, bool) {
+	var value string
+	var found bool
+	if self.numVars != 0 {
+		self.walkVars(r.URL.Path, func(var_name, var_value string) bool {
+			if var_name == name {
+				value, found = var_value, true
+			}
+			return !found
+		})
+	}
+	return value, found
+}
+
+// Of a and b, either of which may be nil, the route mux would try first
+func earlierRadixRoute(a, b *radixRoute) *radixRoute {
+	if a == nil || (b != nil && b.seq.before(a.seq)) {
+		return b
+	}
+	return a
+}
+
+type radixParam struct {
+	name     string
+	pattern  string
+	regexp   *regexp.Regexp
+	catchAll bool
+	// Continuation of the template after this var
+	next *radixNode
+}
+
+type radixNode struct {
+	prefix   string
+	indices  []byte
+	children []*radixNode
+	params   []*radixParam
+	// For templates ending at this node, the route for each method that
+	// mux would try first
+	routes map[string]*radixRoute
+	// The earliest seq of any route at or below this node, so lookups
+	// can skip what can't beat the route they've found
+	minSeq radixSeq
+}
+
+func (self *radixNode) lowerMinSeq(seq radixSeq) {
+	if seq.before(self.minSeq) {
+		self.minSeq = seq
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	max := len(a)
+	if len(b) < max {
+		max = len(b)
+	}
+	i := 0
+	for i < max && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Returns the node at the end of s, relative to this node, creating
+// and splitting nodes as needed. Nodes on the way are updated for a
+// route with seq.
+func (self *radixNode) insertStatic(s string, seq radixSeq) *radixNode {
+	self.lowerMinSeq(seq)
+	if s == "" {
+		return self
+	}
+
+	for i, c := range self.indices {
+		if c != s[0] {
+			continue
+		}
+		child := self.children[i]
+		l := commonPrefixLen(s, child.prefix)
+		if l < len(child.prefix) {
+			split := &radixNode{
+				prefix:   child.prefix[:l],
+				indices:  []byte{child.prefix[l]},
+				children: []*radixNode{child},
+				minSeq:   child.minSeq,
+			}
+			child.prefix = child.prefix[l:]
+			self.children[i] = split
+			child = split
+		}
+		return child.insertStatic(s[l:], seq)
+	}
+
+	child := &radixNode{prefix: s, minSeq: seq}
+	self.indices = append(self.indices, s[0])
+	self.children = append(self.children, child)
+	return child
+}
+
+func (self *radixNode) insertParam(tok *radixToken, seq radixSeq) *radixNode {
+	self.lowerMinSeq(seq)
+	for _, param := range self.params {
+		if param.name == tok.name && param.pattern == tok.pattern {
+			return param.next
+		}
+	}
+	param := &radixParam{
+		name:     tok.name,
+		pattern:  tok.pattern,
+		regexp:   tok.regexp,
+		catchAll: tok.catchAll,
+		next:     &radixNode{},
+	}
+	self.params = append(self.params, param)
+	return param.next
+}
+
+func (self *radixNode) addRoute(rt *radixRoute) {
+	self.lowerMinSeq(rt.seq)
+	if self.routes == nil {
+		self.routes = map[string]*radixRoute{}
+	}
+	self.routes[rt.method] = earlierRadixRoute(self.routes[rt.method], rt)
+}
+
+// Find the route for the path (relative to this node) and method that
+// mux would try first, given the best found so far. This does not
+// allocate.
+func (self *radixNode) lookup(p string, method string, best *radixRoute) *radixRoute {
+	if best != nil && !self.minSeq.before(best.seq) {
+		return best
+	}
+
+	if p == "" {
+		best = earlierRadixRoute(best, self.routes[method])
+		// Catch-alls like {path:.*} may match nothing
+		for _, param := range self.params {
+			if param.catchAll && param.regexp.MatchString("") {
+				best = earlierRadixRoute(best, param.next.routes[method])
+			}
+		}
+		return best
+	}
+
+	c := p[0]
+	for i, idx := range self.indices {
+		if idx != c {
+			continue
+		}
+		child := self.children[i]
+		if strings.HasPrefix(p, child.prefix) {
+			best = child.lookup(p[len(child.prefix):], method, best)
+		}
+		break
+	}
+
+	for _, param := range self.params {
+		if param.catchAll {
+			if param.regexp.MatchString(p) {
+				best = earlierRadixRoute(best, param.next.routes[method])
+			}
+			continue
+		}
+		end := strings.IndexByte(p, '/')
+		if end == -1 {
+			end = len(p)
+		}
+		if end == 0 {
+			continue
+		}
+		if param.regexp != nil && !param.regexp.MatchString(p[:end]) {
+			continue
+		}
+		best = param.next.lookup(p[end:], method, best)
+	}
+
+	return best
+}
+
+// Splits a path template into static strings and vars. Braces inside
+// of var patterns must be balanced, like with mux.
+func parseRadixTemplate(tmpl string) ([]*radixToken, error) {
+	var tokens []*radixToken
+
+	for len(tmpl) != 0 {
+		start := strings.IndexByte(tmpl, '{')
+		if start == -1 {
+			tokens = append(tokens, &radixToken{static: tmpl})
+			break
+		}
+		if start != 0 {
+			tokens = append(tokens, &radixToken{static: tmpl[:start]})
+		}
+
+		level := 0
+		end := -1
+		for i := start; i < len(tmpl); i++ {
+			switch tmpl[i] {
+			case '{':
+				level++
+			case '}':
+				level--
+				if level == 0 {
+					end = i
+				}
+			}
+			if end != -1 {
+				break
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("Unbalanced braces in route template: %s", tmpl)
+		}
+
+		tok := &radixToken{isVar: true}
+		parts := strings.SplitN(tmpl[start+1:end], ":", 2)
+		tok.name = parts[0]
+		if len(parts) == 2 {
+			tok.pattern = parts[1]
+		}
+		if tok.name == "" {
+			return nil, fmt.Errorf("Missing var name in route template: %s", tmpl)
+		}
+		if tok.pattern != "" {
+			re, err := regexp.Compile("^(?:" + tok.pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Bad pattern for var '%s': %s", tok.name, err)
+			}
+			tok.regexp = re
+		}
+
+		tmpl = tmpl[end+1:]
+
+		if tok.regexp != nil && radixPatternMatchesSlash(tok.pattern) {
+			if len(tmpl) != 0 {
+				return nil, fmt.Errorf(
+					"Var '%s' can match '/', so it must end the route: %s",
+					tok.name,
+					tmpl,
+				)
+			}
+			tok.catchAll = true
+		} else if len(tmpl) != 0 && tmpl[0] != '/' {
+			return nil, fmt.Errorf(
+				"Var '%s' must be followed by '/' or the end of the route: %s",
+				tok.name,
+				tmpl,
+			)
+		}
+
+		tokens = append(tokens, tok)
+	}
+
+	return tokens, nil
+}
+
+// Whether a var pattern can match a '/'. mux lets those match across
+// segments.
+func radixPatternMatchesSlash(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return true
+	}
+	var matches func(*syntax.Regexp) bool
+	matches = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+			return true
+		case syntax.OpLiteral:
+			for _, r := range re.Rune {
+				if r == '/' {
+					return true
+				}
+			}
+		case syntax.OpCharClass:
+			for i := 0; i+1 < len(re.Rune); i += 2 {
+				if re.Rune[i] <= '/' && '/' <= re.Rune[i+1] {
+					return true
+				}
+			}
+		}
+		for _, sub := range re.Sub {
+			if matches(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return matches(re)
+}
+
+// A sub router's 404 handler. Like mux, it handles every request under
+// the sub router's prefix that no route tried before it matches.
+type radixNotFound struct {
+	prefix  *regexp.Regexp
+	handler http.HandlerFunc
+	seq     radixSeq
+}
+
+// Shared by a router and all of its sub routers
+type radixTree struct {
+	root   radixNode
+	router *radixRouter
+	// The top router's 404 handler
+	notFound http.HandlerFunc
+	// Sub routers' 404 handlers, by seq
+	notFounds []*radixNotFound
+}
+
+func (self *radixTree) addNotFound(nf *radixNotFound) {
+	i := 0
+	for i < len(self.notFounds) && self.notFounds[i].seq.before(nf.seq) {
+		i++
+	}
+	self.notFounds = append(self.notFounds, nil)
+	copy(self.notFounds[i+1:], self.notFounds[i:])
+	self.notFounds[i] = nf
+}
+
+// The route for the path and method, or nil if there isn't one or a sub
+// router's 404 handler comes first, along with the handler to call.
+func (self *radixTree) match(p string, method string) (*radixRoute, http.HandlerFunc) {
+	rt := self.root.lookup(p, method, nil)
+	for _, nf := range self.notFounds {
+		if rt != nil && rt.seq.before(nf.seq) {
+			break
+		}
+		if nf.prefix.MatchString(p) {
+			return nil, nf.handler
+		}
+	}
+	if rt != nil {
+		return rt, rt.handler
+	}
+	if self.notFound != nil {
+		return nil, self.notFound
+	}
+	return nil, http.NotFound
+}
+
+type radixRouter struct {
+	tree   *radixTree
+	prefix string
+	seq    radixSeq
+	// Routes and sub routers added so far
+	numEntries int
+	notFound   *radixNotFound
+}
+
+func (self *radixRouter) nextSeq() radixSeq {
+	seq := self.seq.child(self.numEntries)
+	self.numEntries++
+	return seq
+}
+
+func (self *radixRouter) NewRoute(method string, path string, fn http.HandlerFunc) FrameworkRoute {
+	tmpl := self.prefix + path
+	tokens, err := parseRadixTemplate(tmpl)
+	if err != nil {
+		panic(err)
+	}
+
+	rt := &radixRoute{
+		handler: fn,
+		method:  method,
+		tokens:  tokens,
+		seq:     self.nextSeq(),
+	}
+
+	node := &self.tree.root
+	for _, tok := range tokens {
+		if tok.isVar {
+			rt.numVars++
+			node = node.insertParam(tok, rt.seq)
+		} else {
+			node = node.insertStatic(tok.static, rt.seq)
+		}
+	}
+	node.addRoute(rt)
+
+	return rt
+}
+
+func (self *radixRouter) SubRouterForPath(path string) FrameworkRouter {
+	return &radixRouter{
+		tree:   self.tree,
+		prefix: self.prefix + path,
+		seq:    self.nextSeq(),
+	}
+}
+
+func (self *radixRouter) Set404Handler(fn http.HandlerFunc) {
+	if self == self.tree.router {
+		self.tree.notFound = fn
+		return
+	}
+
+	tokens, err := parseRadixTemplate(self.prefix)
+	if err != nil {
+		panic(err)
+	}
+
+	re_str := "^"
+	for _, tok := range tokens {
+		if !tok.isVar {
+			re_str += regexp.QuoteMeta(tok.static)
+		} else if tok.pattern != "" {
+			re_str += "(?:" + tok.pattern + ")"
+		} else {
+			re_str += "[^/]+"
+		}
+	}
+
+	if self.notFound != nil {
+		self.notFound.handler = fn
+		return
+	}
+	self.notFound = &radixNotFound{
+		prefix:  regexp.MustCompile(re_str),
+		handler: fn,
+		seq:     self.seq.child(radixNotFoundIndex),
+	}
+	self.tree.addNotFound(self.notFound)
+}
+
+func (self *radixRouter) MatchesRequest(r *http.Request) bool {
+	rt, _ := self.tree.match(r.URL.Path, r.Method)
+	return rt != nil
+}
+
+func (self *radixRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+
+	// Same as mux: redirect to the clean path
+	if clean := cleanRadixPath(p); clean != p {
+		url := *r.URL
+		url.Path = clean
+		w.Header().Set("Location", url.String())
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	_, handler := self.tree.match(p, r.Method)
+	handler(w, r)
+}
+
+// Borrowed from mux/net/http: clean up the path, keeping a trailing
+// slash.
+func cleanRadixPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
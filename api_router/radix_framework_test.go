@@ -0,0 +1,411 @@
+package api_router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type nopResponseWriter struct {
+	hdrs http.Header
+}
+
+func (self *nopResponseWriter) Header() http.Header {
+	return self.hdrs
+}
+
+func (self *nopResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (self *nopResponseWriter) WriteHeader(int) {}
+
+// A framework router whose handlers record what matched
+type testRouter struct {
+	fw_router FrameworkRouter
+	routes    map[string]FrameworkRoute
+	// Set by handlers. mux.Vars() needs the request mux passed to the
+	// handler.
+	matched    string
+	matchedReq *http.Request
+}
+
+func newTestRouter(framework Framework) *testRouter {
+	return &testRouter{
+		fw_router: framework.NewRouter(),
+		routes:    map[string]FrameworkRoute{},
+	}
+}
+
+func (self *testRouter) handler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		self.matched = name
+		self.matchedReq = r
+	}
+}
+
+// Routes are named by their method and full path
+func (self *testRouter) add(fw FrameworkRouter, method, prefix, path string) {
+	name := method + " " + prefix + path
+	self.routes[name] = fw.NewRoute(method, path, self.handler(name))
+}
+
+func (self *testRouter) serve(method, path string) (string, map[string]string) {
+	r := httptest.NewRequest(method, path, nil)
+	self.matched = ""
+	self.matchedReq = nil
+	self.fw_router.ServeHTTP(&nopResponseWriter{hdrs: http.Header{}}, r)
+	rt, ok := self.routes[self.matched]
+	if !ok {
+		return self.matched, nil
+	}
+	return self.matched, rt.RouteVars(self.matchedReq)
+}
+
+type testRequest struct {
+	method string
+	path   string
+}
+
+// Both frameworks must route every request the same way
+func checkParity(t *testing.T, setup func(*testRouter), reqs []*testRequest) {
+	mux_router := newTestRouter(MuxFramework())
+	radix_router := newTestRouter(RadixFramework())
+	setup(mux_router)
+	setup(radix_router)
+
+	for _, req := range reqs {
+		mux_matched, mux_vars := mux_router.serve(req.method, req.path)
+		radix_matched, radix_vars := radix_router.serve(req.method, req.path)
+		if mux_matched != radix_matched {
+			t.Errorf("%s %s: mux matched '%s', radix matched '%s'",
+				req.method, req.path, mux_matched, radix_matched,
+			)
+			continue
+		}
+		if len(mux_vars) != 0 || len(radix_vars) != 0 {
+			if !reflect.DeepEqual(mux_vars, radix_vars) {
+				t.Errorf("%s %s: mux vars %v, radix vars %v",
+					req.method, req.path, mux_vars, radix_vars,
+				)
+			}
+		}
+
+		r := httptest.NewRequest(req.method, req.path, nil)
+		_, mux_route := mux_router.routes[mux_matched]
+		if got := mux_router.fw_router.MatchesRequest(r); got != mux_route {
+			t.Errorf("%s %s: mux MatchesRequest() is %v", req.method, req.path, got)
+		}
+		if got := radix_router.fw_router.MatchesRequest(r); got != mux_route {
+			t.Errorf("%s %s: radix MatchesRequest() is %v", req.method, req.path, got)
+		}
+	}
+}
+
+func TestRadixMatchesMux(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*testRouter)
+		reqs  []*testRequest
+	}{
+		{
+			name: "vars",
+			setup: func(tr *testRouter) {
+				tr.add(tr.fw_router, "GET", "", "/kittens")
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}")
+				tr.add(tr.fw_router, "PUT", "", "/kittens/{id}")
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}/toys/{toy_id:[0-9]+}")
+				tr.add(tr.fw_router, "GET", "", "/files-{name}")
+			},
+			reqs: []*testRequest{
+				{"GET", "/kittens"},
+				{"GET", "/kittens/"},
+				{"GET", "/kittens/abc"},
+				{"PUT", "/kittens/abc"},
+				{"DELETE", "/kittens/abc"},
+				{"GET", "/kittens/abc/toys/42"},
+				{"GET", "/kittens/abc/toys/x42"},
+				{"GET", "/kittens/abc/toys"},
+				{"GET", "/files-report"},
+				{"GET", "/files-"},
+				{"GET", "/nope"},
+			},
+		},
+		{
+			name: "first added wins over static",
+			setup: func(tr *testRouter) {
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}")
+				tr.add(tr.fw_router, "GET", "", "/kittens/new")
+				tr.add(tr.fw_router, "GET", "", "/cats/new")
+				tr.add(tr.fw_router, "GET", "", "/cats/{id}")
+			},
+			reqs: []*testRequest{
+				{"GET", "/kittens/new"},
+				{"GET", "/kittens/abc"},
+				{"GET", "/cats/new"},
+				{"GET", "/cats/abc"},
+			},
+		},
+		{
+			name: "first added wins between vars",
+			setup: func(tr *testRouter) {
+				tr.add(tr.fw_router, "GET", "", "/a/{any}")
+				tr.add(tr.fw_router, "GET", "", "/a/{n:[0-9]+}")
+				tr.add(tr.fw_router, "GET", "", "/b/{n:[0-9]+}")
+				tr.add(tr.fw_router, "GET", "", "/b/{any}")
+				tr.add(tr.fw_router, "GET", "", "/c/{rest:.*}")
+				tr.add(tr.fw_router, "GET", "", "/c/x/{id}")
+			},
+			reqs: []*testRequest{
+				{"GET", "/a/12"},
+				{"GET", "/b/12"},
+				{"GET", "/b/x"},
+				{"GET", "/c/x/1"},
+				{"GET", "/c/"},
+				{"GET", "/c/y/z"},
+			},
+		},
+		{
+			name: "backtracking",
+			setup: func(tr *testRouter) {
+				tr.add(tr.fw_router, "GET", "", "/a/b/c")
+				tr.add(tr.fw_router, "GET", "", "/a/{x}/d")
+				tr.add(tr.fw_router, "POST", "", "/a/b/d")
+			},
+			reqs: []*testRequest{
+				{"GET", "/a/b/c"},
+				{"GET", "/a/b/d"},
+				{"POST", "/a/b/d"},
+				{"POST", "/a/b/c"},
+			},
+		},
+		{
+			name: "sub routers",
+			setup: func(tr *testRouter) {
+				sub := tr.fw_router.SubRouterForPath("/kittens/{id}")
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}/toys")
+				tr.add(sub, "GET", "/kittens/{id}", "/toys")
+				tr.add(sub, "GET", "/kittens/{id}", "/toys/{toy_id}")
+				nested := sub.SubRouterForPath("/photos")
+				tr.add(nested, "GET", "/kittens/{id}/photos", "/{photo_id:[0-9]+}")
+			},
+			reqs: []*testRequest{
+				{"GET", "/kittens/abc/toys"},
+				{"GET", "/kittens/abc/toys/ball"},
+				{"GET", "/kittens/abc/photos/1"},
+				{"GET", "/kittens/abc/photos/x"},
+			},
+		},
+		{
+			name: "sub router 404 handlers",
+			setup: func(tr *testRouter) {
+				tr.fw_router.Set404Handler(tr.handler("404"))
+				sub := tr.fw_router.SubRouterForPath("/kittens")
+				sub.Set404Handler(tr.handler("404 /kittens"))
+				tr.add(sub, "GET", "/kittens", "/{id}")
+				nested := sub.SubRouterForPath("/{id}/toys")
+				nested.Set404Handler(tr.handler("404 /kittens/{id}/toys"))
+				tr.add(nested, "GET", "/kittens/{id}/toys", "/{toy_id}")
+				// After the sub router, so its 404 handler wins
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}/photos")
+				tr.add(tr.fw_router, "GET", "", "/cats")
+			},
+			reqs: []*testRequest{
+				{"GET", "/kittens/abc"},
+				{"POST", "/kittens/abc"},
+				{"GET", "/kittens/abc/photos"},
+				{"GET", "/kittens/abc/toys/ball"},
+				{"GET", "/kittens/abc/toys/ball/x"},
+				{"GET", "/cats"},
+				{"GET", "/dogs"},
+			},
+		},
+		{
+			name: "added to an earlier sub router",
+			setup: func(tr *testRouter) {
+				sub := tr.fw_router.SubRouterForPath("/kittens")
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}")
+				tr.add(tr.fw_router, "GET", "", "/kittens/{id}/toys")
+				// Both count from when the sub router was added
+				tr.add(sub, "GET", "/kittens", "/{name}")
+				sub.Set404Handler(tr.handler("404 /kittens"))
+			},
+			reqs: []*testRequest{
+				{"GET", "/kittens/abc"},
+				{"GET", "/kittens/abc/toys"},
+				{"POST", "/kittens/abc"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkParity(t, test.setup, test.reqs)
+		})
+	}
+}
+
+func TestRadixRejectsTemplates(t *testing.T) {
+	tests := []string{
+		"/kittens/{id",
+		"/kittens/{}",
+		"/kittens/{id:[0-9}",
+		"/kittens/{id}.json",
+		"/kittens/{a}{b}",
+		"/files/{path:.*}/meta",
+		"/files/{path:[a-z/]+}/meta",
+		"/files/{path:a|/b}/meta",
+	}
+	for _, tmpl := range tests {
+		t.Run(tmpl, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Adding %s didn't panic", tmpl)
+				}
+			}()
+			RadixFramework().NewRouter().NewRoute("GET", tmpl, nil)
+		})
+	}
+}
+
+func TestRadixRedirectsToCleanPath(t *testing.T) {
+	fw_router := RadixFramework().NewRouter()
+	fw_router.NewRoute("GET", "/kittens/{id}", func(http.ResponseWriter, *http.Request) {})
+
+	tests := map[string]string{
+		"/kittens//abc":       "/kittens/abc",
+		"/kittens/./abc":      "/kittens/abc",
+		"/cats/../kittens/x/": "/kittens/x/",
+	}
+	for path, location := range tests {
+		w := httptest.NewRecorder()
+		fw_router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != location {
+			t.Errorf("%s: got %d to '%s', want 301 to '%s'",
+				path, w.Code, w.Header().Get("Location"), location,
+			)
+		}
+	}
+}
+
+func TestRadixRouteVarsAllocs(t *testing.T) {
+	fw_router := RadixFramework().NewRouter()
+	static := fw_router.NewRoute("GET", "/kittens", nil)
+	vars := fw_router.NewRoute("GET", "/kittens/{id}", nil)
+
+	r := httptest.NewRequest("GET", "/kittens", nil)
+	if allocs := testing.AllocsPerRun(100, func() { static.RouteVars(r) }); allocs != 0 {
+		t.Errorf("RouteVars() without vars allocated %v times", allocs)
+	}
+
+	r = httptest.NewRequest("GET", "/kittens/abc", nil)
+	if got := vars.RouteVars(r); !reflect.DeepEqual(got, map[string]string{"id": "abc"}) {
+		t.Errorf("RouteVars() is %v", got)
+	}
+
+	finder := vars.(FrameworkRouteVarFinder)
+	if allocs := testing.AllocsPerRun(100, func() { finder.RouteVar(r, "id") }); allocs != 0 {
+		t.Errorf("RouteVar() allocated %v times", allocs)
+	}
+	if val, ok := finder.RouteVar(r, "id"); !ok || val != "abc" {
+		t.Errorf("RouteVar(\"id\") is %q, %v", val, ok)
+	}
+	if _, ok := finder.RouteVar(r, "name"); ok {
+		t.Error("RouteVar(\"name\") found a var that doesn't exist")
+	}
+}
+
+// Benchmarks against a route table similar in size to our larger
+// services
+
+const numBenchResources = 60
+
+// 60 resources * 5 routes on the top router, plus 60 nested routes on
+// sub routers: 360 routes.
+func addBenchRoutes(tr *testRouter) {
+	for i := 0; i < numBenchResources; i++ {
+		res := fmt.Sprintf("/resource%d", i)
+		tr.add(tr.fw_router, "GET", "", res)
+		tr.add(tr.fw_router, "POST", "", res)
+		tr.add(tr.fw_router, "GET", "", res+"/{id}")
+		tr.add(tr.fw_router, "PUT", "", res+"/{id}")
+		tr.add(tr.fw_router, "DELETE", "", res+"/{id}")
+
+		sub := tr.fw_router.SubRouterForPath(res + "/{id}")
+		tr.add(sub, "GET", res+"/{id}", "/children/{child_id:[0-9]+}")
+	}
+	tr.fw_router.Set404Handler(tr.handler(""))
+}
+
+type benchRequests struct {
+	static   []*testRequest
+	vars     []*testRequest
+	notFound []*testRequest
+}
+
+func newBenchRequests() *benchRequests {
+	reqs := &benchRequests{}
+	for i := 0; i < numBenchResources; i++ {
+		res := fmt.Sprintf("/resource%d", i)
+		reqs.static = append(reqs.static,
+			&testRequest{"GET", res},
+			&testRequest{"POST", res},
+		)
+		reqs.vars = append(reqs.vars,
+			&testRequest{"GET", res + "/d3b07384-d9a0-4c9b-8d6e-0b5d4e7a1c2f"},
+			&testRequest{"DELETE", res + "/1234"},
+			&testRequest{"GET", res + "/abc/children/42"},
+		)
+		reqs.notFound = append(reqs.notFound,
+			&testRequest{"GET", res + "/abc/children/notanumber"},
+			&testRequest{"PATCH", res + "/1234"},
+			&testRequest{"GET", res + "/1234/unknown"},
+		)
+	}
+	return reqs
+}
+
+func TestRadixMatchesMuxForBenchRoutes(t *testing.T) {
+	reqs := newBenchRequests()
+	all := append(append(append([]*testRequest{}, reqs.static...), reqs.vars...), reqs.notFound...)
+	checkParity(t, addBenchRoutes, all)
+}
+
+func benchServeHTTP(b *testing.B, framework Framework, treqs []*testRequest) {
+	tr := newTestRouter(framework)
+	addBenchRoutes(tr)
+	reqs := make([]*http.Request, len(treqs))
+	for i, treq := range treqs {
+		reqs[i] = httptest.NewRequest(treq.method, treq.path, nil)
+	}
+	w := &nopResponseWriter{hdrs: http.Header{}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.fw_router.ServeHTTP(w, reqs[i%len(reqs)])
+	}
+}
+
+func benchFrameworks(b *testing.B, treqs []*testRequest) {
+	b.Run("mux", func(b *testing.B) {
+		benchServeHTTP(b, MuxFramework(), treqs)
+	})
+	b.Run("radix", func(b *testing.B) {
+		benchServeHTTP(b, RadixFramework(), treqs)
+	})
+}
+
+func BenchmarkRouterStatic(b *testing.B) {
+	benchFrameworks(b, newBenchRequests().static)
+}
+
+func BenchmarkRouterVars(b *testing.B) {
+	benchFrameworks(b, newBenchRequests().vars)
+}
+
+func BenchmarkRouterNotFound(b *testing.B) {
+	benchFrameworks(b, newBenchRequests().notFound)
+}
@@ -14,6 +14,7 @@ type contextKey struct {
 }
 
 var requestContextCtxKey = &contextKey{"RequestContext"}
+var headRequestCtxKey = &contextKey{"HEADRequest"}
 
 func (self *contextKey) String() string {
 	return "go-api-controller context value " + self.name
@@ -26,6 +27,7 @@ type RequestContext struct {
 	writer              ResponseWriter
 	currentRoute        *Route
 	routeVars           map[string]string
+	routeVarFinder      FrameworkRouteVarFinder
 	statusHeaderWritten bool
 	startTime           time.Time
 }
@@ -41,16 +43,37 @@ func (self *RequestContext) Body() io.ReadCloser {
 	return self.request.Body
 }
 
+// Reads the body and replaces it with a copy, so it can be read again.
+// On error, the replacement returns what was read followed by the same
+// error.
 func (self *RequestContext) BodyCopy() (buf []byte, err error) {
 	body := self.request.Body
 	buf, err = ioutil.ReadAll(body)
 	if err == nil {
 		defer body.Close()
 		self.request.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+		return
+	}
+	self.request.Body = &failedBody{
+		Reader: io.MultiReader(bytes.NewReader(buf), &errReader{err}),
+		Closer: body,
 	}
 	return
 }
 
+type errReader struct {
+	err error
+}
+
+func (self *errReader) Read([]byte) (int, error) {
+	return 0, self.err
+}
+
+type failedBody struct {
+	io.Reader
+	io.Closer
+}
+
 func (self *RequestContext) SetBody(body io.ReadCloser) {
 	self.request.Body = body
 }
@@ -77,6 +100,9 @@ func (self *RequestContext) TimeElapsed() time.Duration {
 }
 
 func (self *RequestContext) RouteVar(name string) (string, bool) {
+	if self.routeVarFinder != nil {
+		return self.routeVarFinder.RouteVar(self.request, name)
+	}
 	val, ok := self.routeVars[name]
 	return val, ok
 }
@@ -112,19 +138,20 @@ func (self *RequestContext) WriteResponseString(data string) (err error) {
 }
 
 func NewContextForRequest(w ResponseWriter, r *http.Request, cur_route *Route) *RequestContext {
-	vars := cur_route.RouteVars(r)
-	if vars == nil {
-		vars = make(map[string]string)
-	}
-
 	req_ctx := &RequestContext{
 		Context:      r.Context(),
 		writer:       w,
 		currentRoute: cur_route,
-		routeVars:    vars,
 		startTime:    time.Now(),
 	}
 
+	// Vars are looked up as they're asked for, if the framework can
+	if finder, ok := cur_route.fwRoute.(FrameworkRouteVarFinder); ok {
+		req_ctx.routeVarFinder = finder
+	} else if req_ctx.routeVars = cur_route.RouteVars(r); req_ctx.routeVars == nil {
+		req_ctx.routeVars = make(map[string]string)
+	}
+
 	req_ctx.request = r.WithContext(req_ctx)
 	return req_ctx
 }
@@ -11,6 +11,8 @@ type Route struct {
 	defaultStatus int
 	routeFn       RouteFn
 	virtual       bool
+	// Constraints declared in the path, like {id:uuid}
+	varConstraints map[string]*RouteVarConstraint
 }
 
 func (self *Route) RouteFn() RouteFn {
@@ -29,6 +31,10 @@ func (self *Route) Path() string {
 	return self.path
 }
 
+func (self *Route) DefaultStatus() int {
+	return self.defaultStatus
+}
+
 func (self *Route) RouteVars(r *http.Request) map[string]string {
 	if self.fwRoute == nil {
 		return make(map[string]string)
@@ -64,13 +70,28 @@ func (self *Route) register() *Route {
 	return self
 }
 
+func (self *Route) VarConstraints() map[string]*RouteVarConstraint {
+	return self.varConstraints
+}
+
+func (self *Route) IsVirtual() bool {
+	return self.virtual
+}
+
 func (self *Route) handleRequest(w http.ResponseWriter, r *http.Request) {
-	ctx := NewContextForRequest(
-		newResponseWriter(w, self.defaultStatus),
-		r,
-		self,
-	)
+	if is_head, _ := r.Context().Value(headRequestCtxKey).(bool); is_head {
+		// A HEAD request being served by this GET route. Restore the
+		// real method and hold back the body.
+		r.Method = "HEAD"
+		writer := newHEADResponseWriter(w, self.defaultStatus)
+		self.routeFn(NewContextForRequest(writer, r, self))
+		writer.finish()
+		return
+	}
+
+	writer, base_writer := newResponseWriter(w, self.defaultStatus)
+	ctx := NewContextForRequest(writer, r, self)
 	self.routeFn(ctx)
 	// Ensure we've set status, even if no body was written
-	ctx.writer.WriteStatusHeader()
+	base_writer.finish()
 }
@@ -0,0 +1,167 @@
+package api_router
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Constraint on a route var, declared in the path like {id:uuid},
+// {n:int}, {flag:bool}, {at:time}, or {color:enum(red|green|blue)}.
+// Any other {name:pattern} is passed to the framework as-is.
+type RouteVarConstraint struct {
+	// One of "uuid", "int", "bool", "time", "enum"
+	Type string
+	// Allowed values for "enum"
+	Values []string
+}
+
+func (self *RouteVarConstraint) String() string {
+	if self.Type == "enum" {
+		return "enum(" + strings.Join(self.Values, "|") + ")"
+	}
+	return self.Type
+}
+
+func (self *RouteVarConstraint) Check(val string) error {
+	switch self.Type {
+	case "uuid":
+		if !isUUIDString(val) {
+			return fmt.Errorf("'%s' is not a valid uuid", val)
+		}
+	case "int":
+		if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return fmt.Errorf("'%s' is not a valid integer", val)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("'%s' is not a valid boolean", val)
+		}
+	case "time":
+		if _, err := time.Parse(time.RFC3339, val); err != nil {
+			return fmt.Errorf("'%s' is not a valid RFC 3339 time", val)
+		}
+	case "enum":
+		for _, allowed := range self.Values {
+			if val == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"'%s' is not one of: %s",
+			val,
+			strings.Join(self.Values, ", "),
+		)
+	}
+	return nil
+}
+
+type RouteVarError struct {
+	Name       string
+	Value      string
+	Constraint *RouteVarConstraint
+	Err        error
+}
+
+func (self *RouteVarError) Error() string {
+	return fmt.Sprintf("Invalid value for route var '%s': %s", self.Name, self.Err)
+}
+
+type InvalidRouteVarHandler func(context.Context, *RouteVarError)
+
+func (self InvalidRouteVarHandler) InvalidRouteVar(ctx context.Context, err *RouteVarError) {
+	self(ctx, err)
+}
+
+var routeVarRegexp = regexp.MustCompile(`\{([^{}:]+):(uuid|int|bool|time|enum\(([^(){}]*)\))\}`)
+
+// Strips known constraints out of a path, returning the path to give to
+// the framework and the constraints found.
+func parseRouteVarConstraints(path string) (string, map[string]*RouteVarConstraint) {
+	constraints := map[string]*RouteVarConstraint{}
+
+	fw_path := routeVarRegexp.ReplaceAllStringFunc(path, func(s string) string {
+		m := routeVarRegexp.FindStringSubmatch(s)
+		constraint := &RouteVarConstraint{Type: m[2]}
+		if strings.HasPrefix(m[2], "enum(") {
+			constraint.Type = "enum"
+			constraint.Values = strings.Split(m[3], "|")
+		}
+		constraints[m[1]] = constraint
+		return "{" + m[1] + "}"
+	})
+
+	return fw_path, constraints
+}
+
+func isUUIDString(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func mergeRouteVarConstraints(a, b map[string]*RouteVarConstraint) map[string]*RouteVarConstraint {
+	merged := make(map[string]*RouteVarConstraint, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Check route vars against the route's constraints before calling next.
+func (self *Route) checkRouteVarsFn(next RouteFn) RouteFn {
+	// Sort so the same var is always reported first
+	names := make([]string, 0, len(self.varConstraints))
+	for name := range self.varConstraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return func(ctx context.Context) {
+		rctx := RequestContextFromContext(ctx)
+		for _, name := range names {
+			constraint := self.varConstraints[name]
+			val, ok := rctx.RouteVar(name)
+			if !ok {
+				continue
+			}
+			if err := constraint.Check(val); err != nil {
+				var_err := &RouteVarError{
+					Name:       name,
+					Value:      val,
+					Constraint: constraint,
+					Err:        err,
+				}
+				if hdlr := self.router.topRouter.invalidRouteVarHandler; hdlr != nil {
+					hdlr.InvalidRouteVar(ctx, var_err)
+					return
+				}
+				rctx.SetStatus(400)
+				rctx.WriteResponseString(var_err.Error())
+				return
+			}
+		}
+		next(ctx)
+	}
+}
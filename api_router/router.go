@@ -0,0 +1,310 @@
+package api_router
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type RouteFn func(context.Context)
+type NewRouteNotifier func(*Route, ...interface{})
+
+type Router struct {
+	basePath         string
+	fwRouter         FrameworkRouter
+	topRouter        *Router
+	newRouteNotifier NewRouteNotifier
+	routes           []*Route
+	// Constraints from the path prefix of a sub router
+	varConstraints map[string]*RouteVarConstraint
+	// Default route options for a group, most specific first
+	opts []interface{}
+	// The following are only used on the top router
+	methods                map[string]bool
+	notFoundRoute          *Route
+	methodNotAllowedRoute  *Route
+	optionsRoute           *Route
+	invalidRouteVarHandler InvalidRouteVarHandler
+}
+
+func (self *Router) SetNewRouteNotifier(route_notifier NewRouteNotifier) *Router {
+	self.newRouteNotifier = route_notifier
+	return self
+}
+
+// Route options for routes registered on this router, most specific
+// first
+func (self *Router) RouteOptions() []interface{} {
+	return append([]interface{}{}, self.opts...)
+}
+
+// Registers a route. The notifier is passed the route's own options,
+// followed by any inherited from groups, most specific first. Consumers
+// should use the first option they find of a given type, so a route can
+// override its group.
+func (self *Router) NewRoute(method string, path string, fn RouteFn, opts ...interface{}) *Route {
+	path, constraints := parseRouteVarConstraints(path)
+	if len(self.opts) != 0 {
+		opts = append(append(make([]interface{}, 0, len(opts)+len(self.opts)), opts...), self.opts...)
+	}
+
+	rt := &Route{
+		router:         self,
+		method:         method,
+		path:           path,
+		fullPath:       combinePaths(self.basePath, path),
+		routeFn:        fn,
+		varConstraints: mergeRouteVarConstraints(self.varConstraints, constraints),
+	}
+	if len(rt.varConstraints) != 0 {
+		// Checked inside of any middleware the notifier adds, right
+		// before the real route handler.
+		rt.routeFn = rt.checkRouteVarsFn(fn)
+	}
+	rt.register()
+	self.topRouter.routes = append(self.topRouter.routes, rt)
+	self.topRouter.methods[method] = true
+	if self.newRouteNotifier != nil {
+		self.newRouteNotifier(rt, opts...)
+	}
+	return rt
+}
+
+func (self *Router) newVirtualRoute(name string, fn RouteFn, default_status int) *Route {
+	rt := &Route{
+		router:        self,
+		method:        "ANY",
+		path:          name,
+		fullPath:      name,
+		routeFn:       fn,
+		defaultStatus: default_status,
+		virtual:       true,
+	}
+
+	if self.newRouteNotifier != nil {
+		self.newRouteNotifier(rt)
+	}
+
+	return rt
+}
+
+// Called when no route matches the path.
+func (self *Router) Set404Handler(fn RouteFn) *Route {
+	rt := self.newVirtualRoute("<404_Handler>", fn, 404)
+	if self.topRouter == self {
+		self.notFoundRoute = rt
+	} else {
+		self.fwRouter.Set404Handler(self.handleUnmatched(rt))
+	}
+	return rt
+}
+
+// Called when a route matches the path, but not the method. The Allow
+// header is set before this is called.
+func (self *Router) Set405Handler(fn RouteFn) *Route {
+	rt := self.newVirtualRoute("<405_Handler>", fn, 405)
+	self.topRouter.methodNotAllowedRoute = rt
+	return rt
+}
+
+// Called for OPTIONS requests on paths that have no explicit OPTIONS
+// route. The Allow header is set before this is called. If no handler
+// is set, an empty 204 is returned.
+func (self *Router) SetOPTIONSHandler(fn RouteFn) *Route {
+	rt := self.newVirtualRoute("<OPTIONS_Handler>", fn, 204)
+	self.topRouter.optionsRoute = rt
+	return rt
+}
+
+// Methods that would match this request's path, sorted.
+func (self *Router) AllowedMethods(r *http.Request) []string {
+	top := self.topRouter
+	allowed := make([]string, 0, len(top.methods)+2)
+	req := *r
+
+	for method := range top.methods {
+		req.Method = method
+		if top.fwRouter.MatchesRequest(&req) {
+			allowed = append(allowed, method)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return allowed
+	}
+
+	has_head := false
+	has_get := false
+	has_options := false
+	for _, method := range allowed {
+		switch method {
+		case "HEAD":
+			has_head = true
+		case "GET":
+			has_get = true
+		case "OPTIONS":
+			has_options = true
+		}
+	}
+
+	if has_get && !has_head {
+		allowed = append(allowed, "HEAD")
+	}
+	if !has_options {
+		allowed = append(allowed, "OPTIONS")
+	}
+
+	sort.Strings(allowed)
+	return allowed
+}
+
+var unmatchedFallbackCtxKey = &contextKey{"UnmatchedFallback"}
+
+// Returns a copy of r that's passed to fallback, rather than the 404
+// handler, if no route matches its path. This allows trying a rewritten
+// path first without looking it up twice.
+func WithUnmatchedFallback(r *http.Request, fallback http.Handler) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), unmatchedFallbackCtxKey, fallback))
+}
+
+func (self *Router) handleUnmatched(not_found_route *Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		top := self.topRouter
+
+		allowed := top.AllowedMethods(r)
+		if len(allowed) == 0 {
+			if fallback, ok := r.Context().Value(unmatchedFallbackCtxKey).(http.Handler); ok {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			if not_found_route == nil {
+				http.NotFound(w, r)
+				return
+			}
+			not_found_route.handleRequest(w, r)
+			return
+		}
+
+		if r.Method == "HEAD" {
+			for _, method := range allowed {
+				if method == "GET" {
+					// Re-dispatch as GET so the GET route is found. The
+					// route will switch the method back and suppress the
+					// body.
+					get_req := r.WithContext(
+						context.WithValue(r.Context(), headRequestCtxKey, true),
+					)
+					get_req.Method = "GET"
+					top.fwRouter.ServeHTTP(w, get_req)
+					return
+				}
+			}
+		}
+
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		if r.Method == "OPTIONS" {
+			if top.optionsRoute == nil {
+				w.WriteHeader(204)
+				return
+			}
+			top.optionsRoute.handleRequest(w, r)
+			return
+		}
+
+		if top.methodNotAllowedRoute == nil {
+			w.WriteHeader(405)
+			return
+		}
+		top.methodNotAllowedRoute.handleRequest(w, r)
+	}
+}
+
+// Called when a route var doesn't satisfy a constraint declared in the
+// route's path. If not set, a plain 400 is returned.
+func (self *Router) SetInvalidRouteVarHandler(fn InvalidRouteVarHandler) *Router {
+	self.topRouter.invalidRouteVarHandler = fn
+	return self
+}
+
+func (self *Router) SubRouterForPath(path string) *Router {
+	path, constraints := parseRouteVarConstraints(path)
+	return &Router{
+		basePath:         combinePaths(self.basePath, path),
+		fwRouter:         self.fwRouter.SubRouterForPath(path),
+		topRouter:        self.topRouter,
+		newRouteNotifier: self.newRouteNotifier,
+		varConstraints:   mergeRouteVarConstraints(self.varConstraints, constraints),
+		opts:             self.opts,
+	}
+}
+
+// A sub router whose routes inherit opts, in addition to any options
+// inherited from this router. Groups can be nested.
+func (self *Router) Group(path string, opts ...interface{}) *Router {
+	sr := self.SubRouterForPath(path)
+	sr.opts = append(append(make([]interface{}, 0, len(opts)+len(self.opts)), opts...), self.opts...)
+	return sr
+}
+
+// Implements http.Handler interface
+func (self *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.fwRouter.ServeHTTP(w, r)
+}
+
+func (self *Router) DELETE(path string, fn RouteFn, opts ...interface{}) *Route {
+	return self.NewRoute("DELETE", path, fn, opts...)
+}
+
+func (self *Router) GET(path string, fn RouteFn, opts ...interface{}) *Route {
+	return self.NewRoute("GET", path, fn, opts...)
+}
+
+func (self *Router) HEAD(path string, fn RouteFn, opts ...interface{}) *Route {
+	return self.NewRoute("HEAD", path, fn, opts...)
+}
+
+func (self *Router) PATCH(path string, fn RouteFn, opts ...interface{}) *Route {
+	return self.NewRoute("PATCH", path, fn, opts...)
+}
+
+func (self *Router) POST(path string, fn RouteFn, opts ...interface{}) *Route {
+	return self.NewRoute("POST", path, fn, opts...)
+}
+
+func (self *Router) PUT(path string, fn RouteFn, opts ...interface{}) *Route {
+	return self.NewRoute("PUT", path, fn, opts...)
+}
+
+func (self *Router) RequestContext(ctx context.Context) *RequestContext {
+	return RequestContextFromContext(ctx)
+}
+
+func NewRouter(framework Framework) *Router {
+	r := &Router{
+		basePath: "/",
+		fwRouter: framework.NewRouter(),
+		routes:   []*Route{},
+		methods:  map[string]bool{},
+	}
+	r.topRouter = r
+	r.fwRouter.Set404Handler(func(w http.ResponseWriter, req *http.Request) {
+		r.handleUnmatched(r.notFoundRoute)(w, req)
+	})
+	return r
+}
+
+func combinePaths(basepath string, path string) string {
+	fullpath := basepath
+	basepath_len := len(basepath)
+	if basepath_len == 0 || basepath[basepath_len-1:] != "/" {
+		fullpath += "/"
+	}
+	if len(path) != 0 && path[:1] == "/" {
+		fullpath += path[1:]
+	} else {
+		fullpath += path
+	}
+	return fullpath
+}
@@ -0,0 +1,345 @@
+package api_router
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type ResponseWriter interface {
+	http.ResponseWriter
+	SetStatus(int)
+	WriteStatusHeader()
+	Status() int
+	// Bytes sent to the client, after any compression
+	Size() int
+	// Bytes written, before any compression
+	UncompressedSize() int
+	// Uncompressed
+	ResponseCopy() []byte
+	// Stop keeping a copy of the response, like for streamed responses
+	DisableResponseCopy()
+	// Compress the response with encoding ("gzip" or "deflate") if it
+	// ends up being at least min_size bytes. The response is held back
+	// until then, or until it's flushed or FinishCompression() is
+	// called. Must be called before anything is written.
+	EnableCompression(encoding string, min_size int, level int)
+	// Write out anything held back and end compression. Called once the
+	// response is complete.
+	FinishCompression() error
+	// Hold back the response, status header included, until
+	// ReleaseResponse() or DiscardResponse(). Flushing releases it. Must
+	// be called before anything is written.
+	HoldResponse()
+	// Send what's been held back and stop holding
+	ReleaseResponse() error
+	// Throw away what's been held back, status included, and stop
+	// holding, so a different response can be written. Headers are
+	// kept.
+	DiscardResponse()
+}
+
+type baseResponseWriter struct {
+	http.ResponseWriter
+	defaultStatus int
+	statusWritten bool
+	status        int
+	size          int
+	// Before compression
+	uncompressedSize int
+	response         []byte
+	noCopy           bool
+	compression      *responseCompression
+	// For HEAD requests: count the body, but don't send it. The real
+	// status header is sent in finish(), once Content-Length is known.
+	headOnly bool
+	// See HoldResponse()
+	hold bool
+	held []byte
+}
+
+func (self *baseResponseWriter) writeStatusHeader() {
+	if self.status == 0 {
+		self.status = self.defaultStatus
+	}
+	if !self.headOnly && !self.compressionPending() && !self.hold {
+		self.ResponseWriter.WriteHeader(self.status)
+	}
+	self.statusWritten = true
+}
+
+func (self *baseResponseWriter) finish() {
+	if !self.statusWritten {
+		self.writeStatusHeader()
+	}
+	self.ReleaseResponse()
+	self.FinishCompression()
+	if self.headOnly {
+		hdrs := self.ResponseWriter.Header()
+		if hdrs.Get("Content-Length") == "" {
+			hdrs.Set("Content-Length", strconv.Itoa(self.size))
+		}
+		self.ResponseWriter.WriteHeader(self.status)
+	}
+}
+
+func (self *baseResponseWriter) Write(b []byte) (int, error) {
+	if !self.statusWritten {
+		self.writeStatusHeader()
+	}
+	if !self.noCopy {
+		self.response = append(self.response, b...)
+	}
+	self.uncompressedSize += len(b)
+	if self.hold {
+		self.held = append(self.held, b...)
+		return len(b), nil
+	}
+	return self.write(b)
+}
+
+// Write after the response has been accounted for
+func (self *baseResponseWriter) write(b []byte) (int, error) {
+	if c := self.compression; c != nil {
+		if !c.decided {
+			c.pending = append(c.pending, b...)
+			if len(c.pending) < c.minSize {
+				return len(b), nil
+			}
+			if err := self.decideCompression(true); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		if c.encoder != nil {
+			if _, err := c.encoder.Write(b); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+	return self.send(b)
+}
+
+// Send (possibly compressed) bytes to the client. For HEAD, they're only
+// counted.
+func (self *baseResponseWriter) send(b []byte) (int, error) {
+	if self.headOnly {
+		self.size += len(b)
+		return len(b), nil
+	}
+	size, err := self.ResponseWriter.Write(b)
+	self.size += size
+	return size, err
+}
+
+func (self *baseResponseWriter) WriteStatusHeader() {
+	if !self.statusWritten {
+		self.writeStatusHeader()
+	}
+}
+
+func (self *baseResponseWriter) WriteHeader(s int) {
+	if !self.statusWritten {
+		self.status = s
+		self.writeStatusHeader()
+	}
+}
+
+func (self *baseResponseWriter) HoldResponse() {
+	if self.statusWritten || self.headOnly {
+		// HEAD responses are held until finish() anyway
+		return
+	}
+	self.hold = true
+}
+
+func (self *baseResponseWriter) ReleaseResponse() error {
+	if !self.hold {
+		return nil
+	}
+	self.hold = false
+	if !self.statusWritten {
+		return nil
+	}
+	if !self.compressionPending() {
+		self.ResponseWriter.WriteHeader(self.status)
+	}
+	held := self.held
+	self.held = nil
+	if len(held) == 0 {
+		return nil
+	}
+	_, err := self.write(held)
+	return err
+}
+
+func (self *baseResponseWriter) DiscardResponse() {
+	if !self.hold {
+		return
+	}
+	self.hold = false
+	self.held = nil
+	self.statusWritten = false
+	self.status = 0
+	self.uncompressedSize = 0
+	if !self.noCopy {
+		self.response = self.response[:0]
+	}
+}
+
+func (self *baseResponseWriter) Status() int {
+	return self.status
+}
+
+func (self *baseResponseWriter) Size() int {
+	return self.size
+}
+
+func (self *baseResponseWriter) UncompressedSize() int {
+	return self.uncompressedSize
+}
+
+func (self *baseResponseWriter) SetStatus(status int) {
+	if !self.statusWritten {
+		self.status = status
+	}
+}
+
+func (self *baseResponseWriter) ResponseCopy() []byte {
+	return self.response
+}
+
+func (self *baseResponseWriter) DisableResponseCopy() {
+	self.noCopy = true
+	self.response = nil
+}
+
+type flushWriter struct {
+	ResponseWriter
+	http.Flusher
+}
+
+type hijackWriter struct {
+	ResponseWriter
+	http.Hijacker
+}
+
+type closeNotifyWriter struct {
+	ResponseWriter
+	http.CloseNotifier
+}
+
+type hijackFlushWriter struct {
+	ResponseWriter
+	http.Flusher
+	http.Hijacker
+}
+
+type hijackCloseNotifyWriter struct {
+	ResponseWriter
+	http.Hijacker
+	http.CloseNotifier
+}
+
+type closeNotifyFlushWriter struct {
+	ResponseWriter
+	http.CloseNotifier
+	http.Flusher
+}
+
+type allTheThingsWriter struct {
+	ResponseWriter
+	http.Flusher
+	http.Hijacker
+	http.CloseNotifier
+}
+
+// Flushing and hijacking are left out on purpose: either would send
+// headers before we know the Content-Length.
+func newHEADResponseWriter(w http.ResponseWriter, default_status int) *baseResponseWriter {
+	return &baseResponseWriter{
+		ResponseWriter: w,
+		defaultStatus:  default_status,
+		response:       make([]byte, 0, 0),
+		headOnly:       true,
+	}
+}
+
+func newResponseWriter(w http.ResponseWriter, default_status int) (ResponseWriter, *baseResponseWriter) {
+	base_writer := &baseResponseWriter{
+		ResponseWriter: w,
+		defaultStatus:  default_status,
+		response:       make([]byte, 0, 0),
+	}
+	return wrapResponseWriter(base_writer), base_writer
+}
+
+// Adds whichever of Flusher, Hijacker, and CloseNotifier the underlying
+// writer implements
+func wrapResponseWriter(base_writer *baseResponseWriter) ResponseWriter {
+	w := base_writer.ResponseWriter
+
+	var flusher http.Flusher
+	underlying_flusher, flusher_ok := w.(http.Flusher)
+	if flusher_ok {
+		flusher = responseFlusher{base_writer, underlying_flusher}
+	}
+	hijacker, hijacker_ok := w.(http.Hijacker)
+	close_notifier, close_notifier_ok := w.(http.CloseNotifier)
+
+	if flusher_ok {
+		if hijacker_ok && close_notifier_ok {
+			return allTheThingsWriter{
+				base_writer,
+				flusher,
+				hijacker,
+				close_notifier,
+			}
+		}
+
+		if close_notifier_ok {
+			return closeNotifyFlushWriter{
+				base_writer,
+				close_notifier,
+				flusher,
+			}
+		}
+
+		if hijacker_ok {
+			return hijackFlushWriter{
+				base_writer,
+				flusher,
+				hijacker,
+			}
+		}
+
+		return flushWriter{
+			base_writer,
+			flusher,
+		}
+	}
+
+	if close_notifier_ok {
+		if hijacker_ok {
+			return hijackCloseNotifyWriter{
+				base_writer,
+				hijacker,
+				close_notifier,
+			}
+		}
+
+		return closeNotifyWriter{
+			base_writer,
+			close_notifier,
+		}
+	}
+
+	if hijacker_ok {
+		return hijackWriter{
+			base_writer,
+			hijacker,
+		}
+	}
+
+	return base_writer
+}
@@ -3,11 +3,17 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/tilteng/go-api-framework/api_framework"
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/tilteng/go-api-framework/jsonschema_mw"
+	"github.com/tilteng/go-api-framework/serializers_mw"
 	"github.com/tilteng/go-app-context/app_context"
 	"github.com/tilteng/go-errors/errors"
 	"github.com/tilteng/go-request-tracing/request_tracing"
@@ -21,13 +27,10 @@ type KittensController struct {
 // Track our created kittens in memory for this example
 var kittens = map[string]*Kitten{}
 
+// Kitten ids in the order they were created, for paging
+var kittenIds []string
+
 // ErrorClasses
-var ErrInvalidKittenID = errors.NewErrorClass(
-	"ErrInvalidKittenID",
-	"ERR_ID_INVALID_KITTEN_ID",
-	400,
-	"Invalid kitten id specified",
-)
 var ErrKittenNotFound = errors.NewErrorClass(
 	"ErrKittenNotFound",
 	"ERR_ID_KITTEN_NOT_FOUND",
@@ -35,46 +38,61 @@ var ErrKittenNotFound = errors.NewErrorClass(
 	"No kitten found with that id",
 )
 
-// Used for deserializing POST data. jsonapi spec says you should use
-// { "data": { "attributes": { ... } } }
-type createKittenBody struct {
-	Data kittenData `json:"data"`
+// A JSON:API resource. `jsonapi` tags are used for requests and
+// responses, and `json` tags for streaming.
+type Kitten struct {
+	Id           *api_framework.UUID `jsonapi:"primary,kittens" json:"id,omitempty"`
+	Name         string              `jsonapi:"attr,name" json:"name"`
+	Color        string              `jsonapi:"attr,color,omitempty" json:"color,omitempty"`
+	PhotoCaption string              `jsonapi:"attr,photo_caption,omitempty" json:"photo_caption,omitempty"`
+	PhotoSize    int64               `jsonapi:"attr,photo_size,omitempty" json:"photo_size,omitempty"`
 }
-type kittenData struct {
-	Kitten Kitten `json:"attributes"`
+
+// Used for deserializing multipart/form-data photo uploads. Fields are
+// matched by `form` tag.
+type kittenPhotoForm struct {
+	Caption string                   `form:"caption"`
+	Photo   *serializers_mw.FormFile `form:"photo"`
 }
 
-// Used for API responses
-type Kitten struct {
-	Id    *api_framework.UUID `json:"id,omitempty"`
-	Name  string              `json:"name"`
-	Color string              `json:"color,omitempty"`
+// Filled in by Controller.Bind(), from the route var, a header, and
+// the form
+type putKittenPhotoRequest struct {
+	Id     api_framework.UUID `path:"id"`
+	DryRun bool               `header:"X-Dry-Run" default:"false"`
+	Form   kittenPhotoForm    `body:",required"`
 }
 
 func (self *KittensController) AddKitten(ctx context.Context) {
 	rctx := self.RequestContext(ctx)
 
-	body_obj := &createKittenBody{}
+	kitten := &Kitten{}
 	// ReadBody() is a method on the Controller struct. It handles
-	// deserializing the body into whatever object you pass. If you're
-	// using the json schema middleware, the body has already been validated
+	// deserializing the body into whatever object you pass. Structs with
+	// `jsonapi` tags are read from a JSON:API document. If you're using
+	// the json schema middleware, the body has already been validated
 	// against the schema by this point.
-	self.ReadBody(ctx, &body_obj)
+	if read_err := self.ReadBody(ctx, kitten); read_err != nil {
+		self.WriteResponse(rctx, read_err)
+		return
+	}
 
-	kitten := &body_obj.Data.Kitten
 	kitten.Id = self.GenUUID()
 	if kitten.Id == nil {
 		panic("uuid generation failed")
 	}
 	kittens[kitten.Id.String()] = kitten
+	kittenIds = append(kittenIds, kitten.Id.String())
 
 	rctx.LogInfof("Created kitten with ID %s", kitten.Id)
 
 	// WriteResponse() is a method on the Controller struct. It handles
 	// serializing your data according to Accept: header and returing the
-	// response. POST routes automatically send back a 201 status code.
-	// See GET example below to see how you can return a differnt code.
-	self.WriteResponse(ctx, body_obj)
+	// response. Structs with `jsonapi` tags are sent as a JSON:API
+	// document with self links. POST routes automatically send back a 201
+	// status code. See GET example below to see how you can return a
+	// differnt code.
+	self.WriteResponse(ctx, kitten)
 }
 
 func (self *KittensController) GetKitten(ctx context.Context) {
@@ -83,33 +101,203 @@ func (self *KittensController) GetKitten(ctx context.Context) {
 	// to grab route vars, etc.
 	rctx := self.RequestContext(ctx)
 
-	// The route was defined as /kittens/{id}. This is how you pull the
-	// ID. I'm considering making a convenience method on Controller that
-	// combines the above call with this call.
-	id, _ := rctx.RouteVar("id")
-
-	uuid := self.UUIDFromString(id)
-	if uuid == nil {
+	// The route was defined as /kittens/{id:uuid}, so the router has
+	// already returned a 400 error if the id isn't a uuid.
+	// RouteVarUUID() converts it for us. Conversion errors can be passed
+	// straight to WriteResponse().
+	uuid, err := rctx.RouteVarUUID("id")
+	if err != nil {
+		self.WriteResponse(rctx, err)
+		return
+	}
+	kitten, ok := kittens[uuid.String()]
+	if !ok {
 		self.WriteResponse(
 			rctx,
-			ErrInvalidKittenID.New(rctx, "kitten id should be a uuid4 string"),
+			ErrKittenNotFound.New(
+				rctx,
+				"kitten id '"+uuid.String()+"' does not exist",
+			),
 		)
 		return
 	}
-	kitten, ok := kittens[uuid.String()]
+	self.WriteResponse(rctx, kitten)
+}
+
+func indexOf(ids []string, id string) int {
+	for i, kitten_id := range ids {
+		if kitten_id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Kitten ids matching filter[...] query parameters. With a database,
+// FilterQuery.SQL() gives WHERE and ORDER BY clauses to use with
+// AppContext.DB() instead.
+func filterKittens(filter_query *api_framework.FilterQuery) []string {
+	ids := []string{}
+	for _, id := range kittenIds {
+		kitten := kittens[id]
+		matches := true
+		for _, filter := range filter_query.Filters {
+			value := kitten.Name
+			if filter.Field == "color" {
+				value = kitten.Color
+			}
+			switch filter.Op {
+			case api_framework.FilterEq:
+				matches = matches && value == filter.Value
+			case api_framework.FilterIn:
+				found := false
+				for _, v := range filter.Value.([]interface{}) {
+					found = found || value == v
+				}
+				matches = matches && found
+			case api_framework.FilterPrefix:
+				matches = matches && strings.HasPrefix(value, filter.Value.(string))
+			}
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (self *KittensController) ListKittens(ctx context.Context) {
+	rctx := self.RequestContext(ctx)
+
+	// Page() reads page[size], page[after], and page[before]. Cursors
+	// are signed, so a bad one gets a 400 here.
+	page, page_err := rctx.Page()
+	if page_err != nil {
+		self.WriteResponse(rctx, page_err)
+		return
+	}
+	// filter[...] was checked against the route's FilterOpts before we
+	// were called
+	ids := filterKittens(rctx.FilterQuery())
+	start := 0
+	end := len(ids)
+	switch {
+	case page.After != "":
+		start = indexOf(ids, page.After) + 1
+	case page.Before != "":
+		if end = indexOf(ids, page.Before); end < 0 {
+			end = 0
+		}
+		if start = end - page.Size; start < 0 {
+			start = 0
+		}
+	}
+	if end > start+page.Size {
+		end = start + page.Size
+	}
+	// These become links in the Link: header
+	if end > start && end < len(ids) {
+		page.SetNextCursor(ids[end-1])
+	}
+	if start > 0 {
+		page.SetPrevCursor(ids[start])
+	}
+
+	// heartbeat= was checked against schemas/list-kittens-query.json
+	// before we were called, so binding it can't fail
+	var params struct {
+		Heartbeat int `query:"heartbeat" default:"15"`
+	}
+	if errs := self.Bind(ctx, &params); errs != nil {
+		self.WriteResponse(rctx, errs)
+		return
+	}
+
+	// Stream() sends records one at a time, flushing as it goes. It uses
+	// server-sent events if the client asked for text/event-stream, and
+	// NDJSON otherwise. Send() fails once the client goes away.
+	stream := self.Stream(ctx).SetHeartbeat(time.Duration(params.Heartbeat) * time.Second)
+	for _, id := range ids[start:end] {
+		kitten := kittens[id]
+		if err := stream.SendEvent(&api_framework.StreamEvent{
+			ID:    kitten.Id.String(),
+			Event: "kitten",
+			Data:  kitten,
+		}); err != nil {
+			return
+		}
+	}
+}
+
+func (self *KittensController) PutKittenPhoto(ctx context.Context) {
+	rctx := self.RequestContext(ctx)
+
+	// Uploaded files are kept in memory or spilled to a temp file,
+	// depending on size. Either way, they're removed once the request
+	// is finished. Every problem with the request comes back at once.
+	req := &putKittenPhotoRequest{}
+	if errs := self.Bind(ctx, req); errs != nil {
+		self.WriteResponse(rctx, errs)
+		return
+	}
+	kitten, ok := kittens[req.Id.String()]
 	if !ok {
 		self.WriteResponse(
 			rctx,
 			ErrKittenNotFound.New(
 				rctx,
-				"kitten id '"+uuid.String()+"' does not exist",
+				"kitten id '"+req.Id.String()+"' does not exist",
 			),
 		)
 		return
 	}
-	self.WriteResponse(rctx, &createKittenBody{
-		Data: kittenData{
-			Kitten: *kitten,
+
+	form := &req.Form
+	if form.Photo == nil {
+		self.WriteResponse(rctx, api_framework.ErrInvalidRequestBody.New(rctx, "photo is required"))
+		return
+	}
+	if ctype := form.Photo.ContentType(); ctype != "image/jpeg" && ctype != "image/png" {
+		self.WriteResponse(rctx, api_framework.ErrInvalidRequestBody.New(rctx, "photo must be image/jpeg or image/png"))
+		return
+	}
+	photo, open_err := form.Photo.Open()
+	if open_err != nil {
+		panic(open_err)
+	}
+	defer photo.Close()
+	// A real API would store the photo somewhere
+	size, copy_err := io.Copy(ioutil.Discard, photo)
+	if copy_err != nil {
+		panic(copy_err)
+	}
+
+	if req.DryRun {
+		self.WriteResponse(rctx, kitten)
+		return
+	}
+	kitten.PhotoCaption = form.Caption
+	kitten.PhotoSize = size
+	self.WriteResponse(rctx, kitten)
+}
+
+func (self *KittensController) GetStatsV1(ctx context.Context) {
+	rctx := self.RequestContext(ctx)
+	self.WriteResponse(rctx, map[string]int{"count": len(kittens)})
+}
+
+func (self *KittensController) GetStats(ctx context.Context) {
+	rctx := self.RequestContext(ctx)
+	with_photos := 0
+	for _, kitten := range kittens {
+		if kitten.PhotoSize != 0 {
+			with_photos++
+		}
+	}
+	self.WriteResponse(rctx, map[string]interface{}{
+		"kittens": map[string]int{
+			"count":       len(kittens),
+			"with_photos": with_photos,
 		},
 	})
 }
@@ -119,17 +307,100 @@ func registerKittens(c *api_framework.Controller) (err error) {
 	c.POST("/kittens", kittens.AddKitten,
 		// Optional arguments. If you're using the json schema middleware,
 		// it will look for a *JSONSchemaOpts struct with Name set to
-		// something other than "". `Name` should be the name of a file
-		// under the JSONSchemaFilePath (see controller_opts) excluding its
-		// .json suffix. When this route is called, the body of data will
-		// be validated against the schema found in the json file.
+		// something other than "". `Name` should be the path of a file
+		// relative to the JSONSchemaFilePath (see controller_opts)
+		// excluding its .json suffix, like "v1/kitten". When this route
+		// is called, the body of data will be validated against the
+		// schema found in the json file. Schemas can $ref each other, like
+		// schemas/kitten.json does common/uuid.json.
 		c.JSONSchemaOpts("create-kitten"),
+		// Optional description of the route for the OpenAPI document
+		c.OpenAPIOpts("Create a kitten", ""),
+	)
+	c.GET("/kittens", kittens.ListKittens,
+		c.OpenAPIOpts("Stream kittens a page at a time", ""),
+		// Query parameters and headers can be validated too. Values are
+		// converted to the types the schema declares first.
+		&jsonschema_mw.JSONSchemaOpts{QuerySchema: "list-kittens-query"},
+		&api_framework.PaginationOpts{
+			Strategy: api_framework.CursorPagination,
+			MaxSize:  50,
+		},
+		// filter[...] and sort= parameters we accept. Others get a 400.
+		&api_framework.FilterOpts{
+			Fields: map[string]*api_framework.FilterField{
+				"color": {
+					Ops: []api_framework.FilterOp{api_framework.FilterEq, api_framework.FilterIn},
+				},
+				"name": {
+					Ops: []api_framework.FilterOp{api_framework.FilterEq, api_framework.FilterPrefix},
+				},
+			},
+		},
+		// Streams are flushed a record at a time, which compresses
+		// poorly
+		c.NoCompressionOpts(),
+	)
+	// For more efficient routing, you can create a group for a sub-path.
+	// Every route in the group gets the group's options, unless the
+	// route passes its own. Groups can also have their own middleware
+	// and can be nested.
+	kittens_group := c.Group("/kittens", &api_framework.OpenAPIOpts{
+		Tags: []string{"kittens"},
+	})
+	kittens_group.Use("no-store", api_framework.MiddlewareFn(
+		func(next api_router.RouteFn) api_router.RouteFn {
+			return func(ctx context.Context) {
+				rctx := c.RequestContext(ctx)
+				rctx.SetResponseHeader("Cache-Control", "no-store")
+				next(ctx)
+			}
+		},
+	))
+	// ...and then define routes on that group. This is actually
+	// "/kittens/{id}". The ":uuid" constraint is checked before our
+	// handler is called. "int", "bool", "time", and "enum(a|b)" are
+	// also supported.
+	kittens_group.GET("/{id:uuid}", kittens.GetKitten,
+		// include= and fields[TYPE]= are checked against Kitten before
+		// our handler is called. Unknown names get a 400.
+		c.JSONAPIOpts(&Kitten{}),
+		// Responses are checked against schemas/kitten.json when
+		// ControllerOpts.ResponseValidation is enabled. 0 would cover
+		// any status not listed.
+		&jsonschema_mw.JSONSchemaOpts{
+			ResponseSchemas: map[int]string{200: "kitten"},
+		},
+		&api_framework.OpenAPIOpts{
+			Summary: "Fetch a kitten by id",
+			// Error responses this route can return, beyond the defaults
+			Errors: []*errors.ErrorClass{ErrKittenNotFound},
+		},
+	)
+	// Routes can differ between API versions. These are served at
+	// /v1/stats and /v2/stats, and /stats goes to the version asked
+	// for, or the latest. Routes that aren't versioned, like the ones
+	// above, are served whatever version is asked for.
+	c.APIVersion("1").GET("/stats", kittens.GetStatsV1,
+		c.OpenAPIOpts("Count kittens", ""),
+	)
+	c.APIVersion("2").GET("/stats", kittens.GetStats,
+		c.OpenAPIOpts("Count kittens, and those with photos", ""),
+	)
+	// Form bodies are validated against the schema too. Fields are
+	// converted to the types the schema declares. Files aren't
+	// validated, so they're never read into memory for it; check them
+	// in the handler.
+	kittens_group.PUT("/{id:uuid}/photo", kittens.PutKittenPhoto,
+		c.JSONSchemaOpts("kitten-photo"),
+		// Bodies are limited to ControllerOpts.MaxBodySize unless a
+		// route says otherwise. Too large gets a 413.
+		c.BodyLimitOpts(6<<20),
+		&api_framework.OpenAPIOpts{
+			Summary: "Upload a photo of a kitten",
+			Errors:  []*errors.ErrorClass{ErrKittenNotFound},
+		},
 	)
-	// For more efficient routing, you can create a sub-path
-	kittens_router := c.SubRouterForPath("/kittens")
-	// ...and then define routes on that subpath.. This is actually
-	// "/kittens/{id}"
-	kittens_router.GET("/{id}", kittens.GetKitten)
 	return
 }
 
@@ -174,13 +445,72 @@ func main() {
 	controller_opts.JSONSchemaFilePath = json_file_path
 	// HTTP path where to make json schemas available
 	controller_opts.JSONSchemaRoutePath = "/schemas"
+	// HTTP path where to make an OpenAPI document available
+	controller_opts.OpenAPIRoutePath = "/openapi.json"
 	// If set, where output for apache-style logging goes
 	controller_opts.ApacheLogWriter = os.Stderr
 	// Set the request trace manager
 	controller_opts.RequestTraceManager = req_trace_manager
+	// Port for Run() to listen on. Defaults to AppContext.ServicePort()
+	controller_opts.ServicePort = port
+	// Media types we accept and return. The first is the default. Form
+	// types can only be consumed.
+	controller_opts.ConsumesContent = []string{"application/json", api_framework.JSONAPIMediaType, "application/msgpack", "multipart/form-data"}
+	// Compress responses of 1 KiB or more, if Accept-Encoding allows
+	controller_opts.Compression = &api_framework.CompressionOpts{MinSize: 1024}
+	controller_opts.ProducesContent = []string{"application/json", api_framework.JSONAPIMediaType, "application/msgpack", "application/x-ndjson", "text/event-stream"}
+	// GET /kittens can stream for as long as the client stays, and the
+	// write timeout would cut it off after 60 seconds
+	controller_opts.ServerWriteTimeout = 0
+	// Versioned routes are served under /v1 and /v2. Without the prefix,
+	// a request gets the version in X-API-Version, or else the latest.
+	// Responses from v1 get a Deprecation header.
+	controller_opts.APIVersioning = &api_framework.APIVersioningOpts{
+		Versions: []string{"1", "2"},
+		DeprecatedVersions: map[string]time.Time{
+			"1": time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+		Header: "X-API-Version",
+	}
+	// Reject JSON bodies with trailing garbage or deep nesting. Routes
+	// can be stricter with controller.StrictJSONDecodeOpts().
+	controller_opts.JSONDecodeOpts = &serializers_mw.JSONDecodeOpts{
+		MaxDepth:             32,
+		DisallowTrailingData: true,
+	}
+
+	// Check responses against their schemas. Failing them outright
+	// catches mistakes early. Production only samples and reports.
+	controller_opts.ResponseValidation = &api_framework.ResponseValidationOpts{
+		Mode: api_framework.ResponseValidationStrict,
+	}
+	// Pick up schema changes without a restart while developing
+	controller_opts.JSONSchemaReloadInterval = 2 * time.Second
+	if os.Getenv("APP_ENV") == "production" {
+		controller_opts.ResponseValidation.Mode = api_framework.ResponseValidationReport
+		controller_opts.ResponseValidation.SampleRate = 0.01
+		controller_opts.JSONSchemaReloadInterval = 0
+	}
 
 	controller := api_framework.NewController(controller_opts)
 
+	// Middleware can be added relative to the built-in stages. This one
+	// runs inside the panic handler, so a panic here still results in a
+	// proper error response. Routes may skip it by passing
+	// controller.SkipMiddlewareOpts("cors"). It has to be added before
+	// Init(), so it also covers the 404, 405, and OPTIONS responses.
+	controller.UseAfter(
+		api_framework.MiddlewareStagePanicHandler,
+		"cors",
+		api_framework.MiddlewareFn(func(next api_router.RouteFn) api_router.RouteFn {
+			return func(ctx context.Context) {
+				rctx := controller.RequestContext(ctx)
+				rctx.SetResponseHeader("Access-Control-Allow-Origin", "*")
+				next(ctx)
+			}
+		}),
+	)
+
 	// Need a context to start
 	ctx := context.Background()
 
@@ -194,13 +524,18 @@ func main() {
 		panic(err)
 	}
 
-	logger.LogInfo(ctx, fmt.Sprintf("Server started on port %d", port))
-
-	err = http.ListenAndServe(
-		fmt.Sprintf(":%d", port),
-		controller,
-	)
+	// Run() serves requests until SIGINT/SIGTERM is received. It then stops
+	// accepting connections, waits up to ShutdownTimeout for in-flight
+	// requests to finish, and calls any shutdown hooks.
+	controller.AddShutdownHook(api_framework.ShutdownHookFn(
+		func(ctx context.Context) error {
+			logger.LogInfof(ctx, "Goodbye from %d kittens", len(kittens))
+			return nil
+		},
+	))
 
-	logger.LogError(ctx, err)
-	panic(err)
+	if err := controller.Run(ctx); err != nil {
+		logger.LogError(ctx, err)
+		os.Exit(1)
+	}
 }
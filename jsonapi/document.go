@@ -0,0 +1,168 @@
+// Package jsonapi builds and parses JSON:API (https://jsonapi.org)
+// documents. Structs describe resources with `jsonapi` tags:
+//
+//	type Kitten struct {
+//		ID    string  `jsonapi:"primary,kittens"`
+//		Name  string  `jsonapi:"attr,name"`
+//		Color string  `jsonapi:"attr,color,omitempty"`
+//		Owner *Person `jsonapi:"relation,owner,omitempty"`
+//		Meta  Meta    `jsonapi:"meta"`
+//		Links Links   `jsonapi:"links"`
+//	}
+//
+// Attributes are encoded with encoding/json, so `json` tags and
+// json.Marshaler types work inside them. Relationships are pointers to,
+// or slices of pointers to, other tagged structs.
+package jsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+const MediaType = "application/vnd.api+json"
+
+type Meta map[string]interface{}
+
+// Values are a string URL or a *Link
+type Links map[string]interface{}
+
+type Link struct {
+	Href string `json:"href"`
+	Meta Meta   `json:"meta,omitempty"`
+}
+
+// A top-level document. Data is a *Resource, []*Resource, or nil.
+type Document struct {
+	Data     interface{} `json:"data"`
+	Included []*Resource `json:"included,omitempty"`
+	Links    Links       `json:"links,omitempty"`
+	Meta     Meta        `json:"meta,omitempty"`
+}
+
+type Resource struct {
+	Type          string                     `json:"type"`
+	ID            string                     `json:"id,omitempty"`
+	Attributes    map[string]json.RawMessage `json:"attributes,omitempty"`
+	Relationships map[string]*Relationship   `json:"relationships,omitempty"`
+	Links         Links                      `json:"links,omitempty"`
+	Meta          Meta                       `json:"meta,omitempty"`
+}
+
+type ResourceIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Meta Meta   `json:"meta,omitempty"`
+}
+
+// Data is a *ResourceIdentifier, []*ResourceIdentifier, or nil for an
+// empty to-one relationship.
+type Relationship struct {
+	Data  interface{} `json:"data"`
+	Links Links       `json:"links,omitempty"`
+	Meta  Meta        `json:"meta,omitempty"`
+}
+
+func isJSONNull(data []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(data), []byte("null"))
+}
+
+func isJSONArray(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) != 0 && data[0] == '['
+}
+
+// Whether this document holds a collection rather than a single resource
+func (self *Document) IsCollection() bool {
+	_, ok := self.Data.([]*Resource)
+	return ok
+}
+
+// The primary resources, whether there's one or many
+func (self *Document) Resources() []*Resource {
+	switch data := self.Data.(type) {
+	case *Resource:
+		if data != nil {
+			return []*Resource{data}
+		}
+	case []*Resource:
+		return data
+	}
+	return nil
+}
+
+func (self *Document) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Data     json.RawMessage `json:"data"`
+		Included []*Resource     `json:"included"`
+		Links    Links           `json:"links"`
+		Meta     Meta            `json:"meta"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Data == nil {
+		return errors.New("jsonapi: document has no data")
+	}
+
+	self.Included = raw.Included
+	self.Links = raw.Links
+	self.Meta = raw.Meta
+
+	switch {
+	case isJSONNull(raw.Data):
+		self.Data = nil
+	case isJSONArray(raw.Data):
+		var resources []*Resource
+		if err := json.Unmarshal(raw.Data, &resources); err != nil {
+			return err
+		}
+		if resources == nil {
+			resources = []*Resource{}
+		}
+		self.Data = resources
+	default:
+		resource := &Resource{}
+		if err := json.Unmarshal(raw.Data, resource); err != nil {
+			return err
+		}
+		self.Data = resource
+	}
+	return nil
+}
+
+func (self *Relationship) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Data  json.RawMessage `json:"data"`
+		Links Links           `json:"links"`
+		Meta  Meta            `json:"meta"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	self.Links = raw.Links
+	self.Meta = raw.Meta
+
+	switch {
+	case raw.Data == nil, isJSONNull(raw.Data):
+		self.Data = nil
+	case isJSONArray(raw.Data):
+		var ids []*ResourceIdentifier
+		if err := json.Unmarshal(raw.Data, &ids); err != nil {
+			return err
+		}
+		if ids == nil {
+			ids = []*ResourceIdentifier{}
+		}
+		self.Data = ids
+	default:
+		id := &ResourceIdentifier{}
+		if err := json.Unmarshal(raw.Data, id); err != nil {
+			return err
+		}
+		self.Data = id
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package jsonapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type MarshalOpts struct {
+	// Self links are built from this, like
+	// https://api.example.com/kittens/<id>. No links if "".
+	BaseURL string
+	// Relationship paths whose resources go in "included", like "owner"
+	// or "owner.friends"
+	Include []string
+	// Sparse fieldsets: the attributes and relationships to keep, by
+	// resource type. Types not listed keep everything.
+	Fields map[string][]string
+}
+
+// Implemented by resources that want links besides their self link.
+// These take precedence over the default links.
+type Linkable interface {
+	JSONAPILinks(base_url string) Links
+}
+
+// Relationship paths to include, as a tree
+type includeTree map[string]includeTree
+
+func newIncludeTree(paths []string) includeTree {
+	tree := includeTree{}
+	for _, path := range paths {
+		node := tree
+		for _, name := range strings.Split(path, ".") {
+			if name == "" {
+				continue
+			}
+			child, ok := node[name]
+			if !ok {
+				child = includeTree{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+type marshaler struct {
+	opts     *MarshalOpts
+	baseURL  string
+	fields   map[string]map[string]bool
+	included map[string]*Resource
+	// In the order they were added
+	includedList []*Resource
+	primary      map[string]bool
+}
+
+func (self *marshaler) keepField(typ, name string) bool {
+	fields, ok := self.fields[typ]
+	return !ok || fields[name]
+}
+
+func resourceKey(typ, id string) string {
+	return typ + "\x00" + id
+}
+
+// Build a document from v: a tagged struct, a pointer to one, or a
+// slice of either. A nil pointer gives "data": null.
+func Marshal(v interface{}, opts *MarshalOpts) (*Document, error) {
+	if opts == nil {
+		opts = &MarshalOpts{}
+	}
+	m := &marshaler{
+		opts:     opts,
+		baseURL:  strings.TrimRight(opts.BaseURL, "/"),
+		fields:   map[string]map[string]bool{},
+		included: map[string]*Resource{},
+		primary:  map[string]bool{},
+	}
+	for typ, names := range opts.Fields {
+		m.fields[typ] = map[string]bool{}
+		for _, name := range names {
+			m.fields[typ][name] = true
+		}
+	}
+	tree := newIncludeTree(opts.Include)
+
+	doc := &Document{}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return doc, nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		resources := make([]*Resource, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			resource, err := m.marshalValue(rv.Index(i), tree)
+			if err != nil {
+				return nil, err
+			}
+			if resource != nil {
+				resources = append(resources, resource)
+			}
+		}
+		doc.Data = resources
+	default:
+		resource, err := m.marshalValue(rv, tree)
+		if err != nil {
+			return nil, err
+		}
+		if resource == nil {
+			return nil, fmt.Errorf("jsonapi: %s is not a resource", rv.Type())
+		}
+		doc.Data = resource
+	}
+
+	for _, resource := range doc.Resources() {
+		m.primary[resourceKey(resource.Type, resource.ID)] = true
+	}
+	for _, resource := range m.includedList {
+		if !m.primary[resourceKey(resource.Type, resource.ID)] {
+			doc.Included = append(doc.Included, resource)
+		}
+	}
+
+	return doc, nil
+}
+
+// Returns nil for a nil pointer
+func (self *marshaler) marshalValue(rv reflect.Value, tree includeTree) (*Resource, error) {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	info, err := getTypeInfo(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("jsonapi: %s is not a resource", rv.Type())
+	}
+	return self.marshalResource(rv, info, tree)
+}
+
+func (self *marshaler) resourceURL(typ, id string) string {
+	return self.baseURL + "/" + typ + "/" + id
+}
+
+func (self *marshaler) marshalResource(rv reflect.Value, info *typeInfo, tree includeTree) (*Resource, error) {
+	id, err := formatID(fieldByIndex(rv, info.primary.index))
+	if err != nil {
+		return nil, err
+	}
+	resource := &Resource{Type: info.resourceType, ID: id}
+
+	for name := range tree {
+		if info.relation(name) == nil {
+			return nil, fmt.Errorf("jsonapi: '%s' is not a relationship of %s", name, info.resourceType)
+		}
+	}
+
+	for _, field := range info.attrs {
+		if !self.keepField(info.resourceType, field.name) {
+			continue
+		}
+		fv := fieldByIndex(rv, field.index)
+		if !fv.IsValid() || (field.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		data, err := json.Marshal(fv.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("jsonapi: attribute '%s': %s", field.name, err)
+		}
+		if resource.Attributes == nil {
+			resource.Attributes = map[string]json.RawMessage{}
+		}
+		resource.Attributes[field.name] = data
+	}
+
+	for _, field := range info.relations {
+		fv := fieldByIndex(rv, field.index)
+		if !fv.IsValid() {
+			continue
+		}
+		rel, err := self.marshalRelationship(resource, field, fv, tree[field.name])
+		if err != nil {
+			return nil, err
+		}
+		// Related resources are still included when the relationship
+		// itself isn't wanted
+		if rel == nil || !self.keepField(info.resourceType, field.name) {
+			continue
+		}
+		if resource.Relationships == nil {
+			resource.Relationships = map[string]*Relationship{}
+		}
+		resource.Relationships[field.name] = rel
+	}
+
+	if info.meta != nil {
+		if fv := fieldByIndex(rv, info.meta.index); fv.IsValid() {
+			resource.Meta = toMeta(fv)
+		}
+	}
+
+	if self.baseURL != "" && id != "" {
+		resource.Links = Links{"self": self.resourceURL(resource.Type, id)}
+	}
+	if info.links != nil {
+		if fv := fieldByIndex(rv, info.links.index); fv.IsValid() {
+			resource.Links = mergeLinks(resource.Links, toLinks(fv))
+		}
+	}
+	if rv.CanAddr() {
+		if linkable, ok := rv.Addr().Interface().(Linkable); ok {
+			resource.Links = mergeLinks(resource.Links, linkable.JSONAPILinks(self.baseURL))
+		}
+	} else if linkable, ok := rv.Interface().(Linkable); ok {
+		resource.Links = mergeLinks(resource.Links, linkable.JSONAPILinks(self.baseURL))
+	}
+
+	return resource, nil
+}
+
+// Returns nil if the relationship should be left out
+func (self *marshaler) marshalRelationship(resource *Resource, field *fieldInfo, fv reflect.Value, subtree includeTree) (*Relationship, error) {
+	rel := &Relationship{}
+
+	if isToMany(field.typ) {
+		if field.omitEmpty && fv.Len() == 0 {
+			return nil, nil
+		}
+		ids := make([]*ResourceIdentifier, 0, fv.Len())
+		for i := 0; i < fv.Len(); i++ {
+			id, err := self.marshalRelated(fv.Index(i), subtree)
+			if err != nil {
+				return nil, err
+			}
+			if id != nil {
+				ids = append(ids, id)
+			}
+		}
+		rel.Data = ids
+	} else {
+		if field.omitEmpty && fv.IsNil() {
+			return nil, nil
+		}
+		id, err := self.marshalRelated(fv, subtree)
+		if err != nil {
+			return nil, err
+		}
+		if id != nil {
+			rel.Data = id
+		}
+	}
+
+	if self.baseURL != "" && resource.ID != "" {
+		url := self.resourceURL(resource.Type, resource.ID)
+		rel.Links = Links{
+			"self":    url + "/relationships/" + field.name,
+			"related": url + "/" + field.name,
+		}
+	}
+	return rel, nil
+}
+
+// Returns the identifier for a related resource, adding it to included
+// if subtree isn't nil
+func (self *marshaler) marshalRelated(rv reflect.Value, subtree includeTree) (*ResourceIdentifier, error) {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	info, err := getTypeInfo(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("jsonapi: %s is not a resource", rv.Type())
+	}
+	id, err := formatID(fieldByIndex(rv, info.primary.index))
+	if err != nil {
+		return nil, err
+	}
+
+	if subtree != nil {
+		key := resourceKey(info.resourceType, id)
+		if _, ok := self.included[key]; !ok {
+			// Reserve the key first, in case of cycles
+			self.included[key] = nil
+			resource, err := self.marshalResource(rv, info, subtree)
+			if err != nil {
+				return nil, err
+			}
+			self.included[key] = resource
+			self.includedList = append(self.includedList, resource)
+		}
+	}
+
+	return &ResourceIdentifier{Type: info.resourceType, ID: id}, nil
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+func formatID(fv reflect.Value) (string, error) {
+	if !fv.IsValid() {
+		return "", nil
+	}
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return "", nil
+		}
+	}
+
+	if fv.Type().Implements(textMarshalerType) {
+		text, err := fv.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	if fv.Type().Implements(stringerType) {
+		return fv.Interface().(fmt.Stringer).String(), nil
+	}
+	if fv.Kind() == reflect.Ptr {
+		fv = fv.Elem()
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		return fv.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(fv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(fv.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("jsonapi: can't use %s as an id", fv.Type())
+}
+
+// Same rules as encoding/json's omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func toMeta(fv reflect.Value) Meta {
+	if fv.Kind() != reflect.Map || fv.Len() == 0 {
+		return nil
+	}
+	meta := Meta{}
+	for _, key := range fv.MapKeys() {
+		meta[fmt.Sprint(key.Interface())] = fv.MapIndex(key).Interface()
+	}
+	return meta
+}
+
+func toLinks(fv reflect.Value) Links {
+	if fv.Kind() != reflect.Map || fv.Len() == 0 {
+		return nil
+	}
+	links := Links{}
+	for _, key := range fv.MapKeys() {
+		links[fmt.Sprint(key.Interface())] = fv.MapIndex(key).Interface()
+	}
+	return links
+}
+
+func mergeLinks(links Links, more Links) Links {
+	if len(more) == 0 {
+		return links
+	}
+	if links == nil {
+		links = Links{}
+	}
+	for k, v := range more {
+		links[k] = v
+	}
+	return links
+}
@@ -0,0 +1,206 @@
+package jsonapi
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Sparse fieldsets and includes from the query string. Ie,
+// ?fields[kittens]=name,owner&include=owner.friends
+type Query struct {
+	// Relationship paths, like "owner.friends"
+	Include []string
+	// Attributes and relationships to return, by resource type. An empty
+	// list means none.
+	Fields map[string][]string
+}
+
+// A query parameter we can't use. Parameter is the name as it appeared,
+// like "fields[kittens]".
+type QueryError struct {
+	Parameter string
+	Message   string
+}
+
+func (self *QueryError) Error() string {
+	return self.Message
+}
+
+// Sorted, so the same query always fails with the same error
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Parse include= and fields[TYPE]= out of query values. Other parameters
+// are ignored.
+func ParseQuery(values url.Values) (*Query, error) {
+	query := &Query{}
+
+	if includes, ok := values["include"]; ok {
+		for _, include := range includes {
+			for _, path := range splitList(include) {
+				for _, name := range strings.Split(path, ".") {
+					if name == "" {
+						return nil, &QueryError{
+							Parameter: "include",
+							Message:   fmt.Sprintf("Invalid include path '%s'", path),
+						}
+					}
+				}
+				query.Include = append(query.Include, path)
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(values) {
+		if key != "fields" && !strings.HasPrefix(key, "fields[") {
+			continue
+		}
+		if !strings.HasSuffix(key, "]") || len(key) <= len("fields[]") {
+			return nil, &QueryError{
+				Parameter: key,
+				Message:   fmt.Sprintf("Invalid fields parameter '%s', should be fields[TYPE]", key),
+			}
+		}
+		typ := key[len("fields[") : len(key)-1]
+		if query.Fields == nil {
+			query.Fields = map[string][]string{}
+		}
+		fields := []string{}
+		for _, value := range values[key] {
+			fields = append(fields, splitList(value)...)
+		}
+		query.Fields[typ] = fields
+	}
+
+	return query, nil
+}
+
+// Whether path, or a path through it, was asked to be included
+func (self *Query) Includes(path string) bool {
+	if self == nil {
+		return false
+	}
+	for _, include := range self.Include {
+		if include == path || strings.HasPrefix(include, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Make sure includes and fieldsets name relationships and attributes
+// that exist, starting from v's resource type. v is a tagged struct, a
+// pointer to one, or a slice of them. Returns a *QueryError.
+func (self *Query) Validate(v interface{}) error {
+	t := reflect.TypeOf(v)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		t = t.Elem()
+	}
+	if t == nil {
+		return fmt.Errorf("jsonapi: can't validate a query against nil")
+	}
+	info, err := getTypeInfo(t)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("jsonapi: %s is not a resource", t)
+	}
+
+	for _, path := range self.Include {
+		cur := info
+		for _, name := range strings.Split(path, ".") {
+			field := cur.relation(name)
+			if field == nil {
+				return &QueryError{
+					Parameter: "include",
+					Message: fmt.Sprintf(
+						"Can't include '%s': '%s' is not a relationship of %s",
+						path,
+						name,
+						cur.resourceType,
+					),
+				}
+			}
+			if cur, err = getTypeInfo(relatedType(field.typ)); err != nil {
+				return err
+			}
+			if cur == nil {
+				return fmt.Errorf("jsonapi: %s is not a resource", relatedType(field.typ))
+			}
+		}
+	}
+
+	if len(self.Fields) == 0 {
+		return nil
+	}
+
+	types, err := reachableTypes(info)
+	if err != nil {
+		return err
+	}
+
+	for _, typ := range sortedKeys(self.Fields) {
+		param := "fields[" + typ + "]"
+		typ_info, ok := types[typ]
+		if !ok {
+			return &QueryError{
+				Parameter: param,
+				Message:   fmt.Sprintf("Unknown resource type '%s'", typ),
+			}
+		}
+		for _, name := range self.Fields[typ] {
+			if typ_info.attr(name) == nil && typ_info.relation(name) == nil {
+				return &QueryError{
+					Parameter: param,
+					Message:   fmt.Sprintf("'%s' is not a field of %s", name, typ),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Every resource type reachable through relationships, by type name
+func reachableTypes(info *typeInfo) (map[string]*typeInfo, error) {
+	types := map[string]*typeInfo{info.resourceType: info}
+	queue := []*typeInfo{info}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, field := range cur.relations {
+			related, err := getTypeInfo(relatedType(field.typ))
+			if err != nil {
+				return nil, err
+			}
+			if related == nil {
+				continue
+			}
+			if _, ok := types[related.resourceType]; !ok {
+				types[related.resourceType] = related
+				queue = append(queue, related)
+			}
+		}
+	}
+	return types, nil
+}
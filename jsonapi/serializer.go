@@ -0,0 +1,9 @@
+package jsonapi
+
+import (
+	"github.com/tilteng/go-api-framework/serializers_mw"
+)
+
+func init() {
+	serializers_mw.RegisterSerializer(serializers_mw.NewJSONSerializer(MediaType))
+}
@@ -0,0 +1,244 @@
+package jsonapi
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type fieldKind int
+
+const (
+	fieldPrimary fieldKind = iota
+	fieldAttr
+	fieldRelation
+	fieldMeta
+	fieldLinks
+)
+
+type fieldInfo struct {
+	kind      fieldKind
+	name      string
+	omitEmpty bool
+	index     []int
+	typ       reflect.Type
+}
+
+// What we know about a tagged struct type
+type typeInfo struct {
+	resourceType string
+	primary      *fieldInfo
+	attrs        []*fieldInfo
+	relations    []*fieldInfo
+	meta         *fieldInfo
+	links        *fieldInfo
+}
+
+func (self *typeInfo) attr(name string) *fieldInfo {
+	for _, field := range self.attrs {
+		if field.name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+func (self *typeInfo) relation(name string) *fieldInfo {
+	for _, field := range self.relations {
+		if field.name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+var typeInfoLock sync.RWMutex
+var typeInfoCache = map[reflect.Type]*typeInfo{}
+
+// Returns nil if t isn't a struct with a primary field
+func getTypeInfo(t reflect.Type) (*typeInfo, error) {
+	typeInfoLock.RLock()
+	info, ok := typeInfoCache[t]
+	typeInfoLock.RUnlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err := newTypeInfo(t)
+	if err != nil {
+		return nil, err
+	}
+
+	typeInfoLock.Lock()
+	typeInfoCache[t] = info
+	typeInfoLock.Unlock()
+	return info, nil
+}
+
+func newTypeInfo(t reflect.Type) (*typeInfo, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	info := &typeInfo{}
+	seen := map[string]bool{}
+
+	var walk func(reflect.Type, []int) error
+	walk = func(t reflect.Type, parent_index []int) error {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			index := append(append([]int{}, parent_index...), i)
+
+			tag, ok := sf.Tag.Lookup("jsonapi")
+			if !ok {
+				// Embedded structs are flattened
+				if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+					if err := walk(sf.Type, index); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if tag == "-" || sf.PkgPath != "" {
+				continue
+			}
+
+			parts := strings.Split(tag, ",")
+			field := &fieldInfo{index: index, typ: sf.Type}
+			if len(parts) > 1 {
+				field.name = parts[1]
+				for _, opt := range parts[2:] {
+					if opt == "omitempty" {
+						field.omitEmpty = true
+					}
+				}
+			}
+
+			switch parts[0] {
+			case "primary":
+				if info.primary != nil {
+					return fmt.Errorf("jsonapi: %s has more than one primary field", t)
+				}
+				if field.name == "" {
+					return fmt.Errorf("jsonapi: primary field %s.%s needs a resource type", t, sf.Name)
+				}
+				field.kind = fieldPrimary
+				info.primary = field
+				info.resourceType = field.name
+				continue
+			case "attr":
+				field.kind = fieldAttr
+			case "relation":
+				field.kind = fieldRelation
+				if relatedType(sf.Type) == nil {
+					return fmt.Errorf("jsonapi: relation %s.%s must be a struct pointer or a slice of them", t, sf.Name)
+				}
+			case "meta":
+				field.kind = fieldMeta
+				info.meta = field
+				continue
+			case "links":
+				field.kind = fieldLinks
+				info.links = field
+				continue
+			default:
+				return fmt.Errorf("jsonapi: unknown tag '%s' on %s.%s", parts[0], t, sf.Name)
+			}
+
+			if field.name == "" {
+				return fmt.Errorf("jsonapi: %s.%s needs a name", t, sf.Name)
+			}
+			// Attributes and relationships share a namespace, and
+			// can't be named type or id
+			if field.name == "type" || field.name == "id" || seen[field.name] {
+				return fmt.Errorf("jsonapi: field name '%s' on %s can't be used", field.name, t)
+			}
+			seen[field.name] = true
+
+			if field.kind == fieldAttr {
+				info.attrs = append(info.attrs, field)
+			} else {
+				info.relations = append(info.relations, field)
+			}
+		}
+		return nil
+	}
+
+	if err := walk(t, nil); err != nil {
+		return nil, err
+	}
+	if info.primary == nil {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// The struct type a relation field points to, or nil
+func relatedType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+func isToMany(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice || t.Kind() == reflect.Array
+}
+
+// Follows the field index through embedded structs. Returns an invalid
+// Value if a nil embedded pointer is in the way.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// Whether v, or the element type of a slice v, is a tagged resource
+// struct
+func IsResource(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	info, err := getTypeInfo(t)
+	return err == nil && info != nil
+}
+
+// The resource type for a tagged struct, or "" if v isn't one
+func ResourceType(v interface{}) string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return ""
+	}
+	info, err := getTypeInfo(t)
+	if err != nil || info == nil {
+		return ""
+	}
+	return info.resourceType
+}
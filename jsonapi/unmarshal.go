@@ -0,0 +1,224 @@
+package jsonapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Fill in v, a pointer to a tagged struct or to a slice of them, from
+// a JSON:API document
+func Unmarshal(data []byte, v interface{}) error {
+	doc := &Document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return err
+	}
+	return UnmarshalDocument(doc, v)
+}
+
+// Same as Unmarshal, for a document that's already been parsed
+func UnmarshalDocument(doc *Document, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("jsonapi: can't unmarshal into %T", v)
+	}
+	rv = rv.Elem()
+
+	if rv.Kind() == reflect.Slice {
+		resources, ok := doc.Data.([]*Resource)
+		if !ok {
+			return errors.New("jsonapi: expected a collection of resources")
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(resources), len(resources))
+		for i, resource := range resources {
+			if err := unmarshalInto(resource, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+	}
+
+	resource, ok := doc.Data.(*Resource)
+	if !ok {
+		if doc.Data == nil {
+			return errors.New("jsonapi: document data is null")
+		}
+		return errors.New("jsonapi: expected a single resource")
+	}
+	return unmarshalInto(resource, rv)
+}
+
+// rv is a struct or a pointer to one, which is allocated if nil
+func unmarshalInto(resource *Resource, rv reflect.Value) error {
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	info, err := getTypeInfo(rv.Type())
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("jsonapi: %s is not a resource", rv.Type())
+	}
+	return unmarshalResource(resource, rv, info)
+}
+
+func unmarshalResource(resource *Resource, rv reflect.Value, info *typeInfo) error {
+	if resource.Type != info.resourceType {
+		return fmt.Errorf(
+			"jsonapi: resource type '%s' does not match '%s'",
+			resource.Type,
+			info.resourceType,
+		)
+	}
+
+	if resource.ID != "" {
+		if err := parseID(resource.ID, rv.FieldByIndex(info.primary.index)); err != nil {
+			return err
+		}
+	}
+
+	// Attributes and relationships we don't know about are ignored
+	for name, raw := range resource.Attributes {
+		field := info.attr(name)
+		if field == nil {
+			continue
+		}
+		fv := rv.FieldByIndex(field.index)
+		if err := json.Unmarshal(raw, fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("jsonapi: attribute '%s': %s", name, err)
+		}
+	}
+
+	for name, rel := range resource.Relationships {
+		field := info.relation(name)
+		if field == nil || rel == nil {
+			continue
+		}
+		if err := unmarshalRelationship(rel, rv.FieldByIndex(field.index), field); err != nil {
+			return err
+		}
+	}
+
+	if info.meta != nil && len(resource.Meta) != 0 {
+		setMap(rv.FieldByIndex(info.meta.index), resource.Meta)
+	}
+
+	return nil
+}
+
+func unmarshalRelationship(rel *Relationship, fv reflect.Value, field *fieldInfo) error {
+	switch data := rel.Data.(type) {
+	case nil:
+		fv.Set(reflect.Zero(fv.Type()))
+	case *ResourceIdentifier:
+		if isToMany(field.typ) {
+			return fmt.Errorf("jsonapi: relationship '%s' must be an array", field.name)
+		}
+		return unmarshalIdentifier(data, fv)
+	case []*ResourceIdentifier:
+		if !isToMany(field.typ) {
+			return fmt.Errorf("jsonapi: relationship '%s' can't be an array", field.name)
+		}
+		if fv.Kind() == reflect.Array {
+			return fmt.Errorf("jsonapi: can't unmarshal relationship '%s' into an array", field.name)
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(data), len(data))
+		for i, id := range data {
+			if err := unmarshalIdentifier(id, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+	}
+	return nil
+}
+
+// Allocates the related resource with just its id set
+func unmarshalIdentifier(id *ResourceIdentifier, fv reflect.Value) error {
+	if fv.Kind() == reflect.Ptr {
+		fv.Set(reflect.New(fv.Type().Elem()))
+		fv = fv.Elem()
+	}
+	info, err := getTypeInfo(fv.Type())
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("jsonapi: %s is not a resource", fv.Type())
+	}
+	if id.Type != info.resourceType {
+		return fmt.Errorf(
+			"jsonapi: related resource type '%s' does not match '%s'",
+			id.Type,
+			info.resourceType,
+		)
+	}
+	return parseID(id.ID, fv.FieldByIndex(info.primary.index))
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func parseID(id string, fv reflect.Value) error {
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		fv = fv.Elem()
+	}
+
+	if fv.Addr().Type().Implements(textUnmarshalerType) {
+		if err := fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(id)); err != nil {
+			return fmt.Errorf("jsonapi: invalid id '%s': %s", id, err)
+		}
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(id)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(id, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("jsonapi: invalid id '%s'", id)
+		}
+		fv.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(id, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("jsonapi: invalid id '%s'", id)
+		}
+		fv.SetUint(n)
+		return nil
+	}
+	return fmt.Errorf("jsonapi: can't use %s as an id", fv.Type())
+}
+
+// Copies a meta or links map into a field of any map[string]... type
+func setMap(fv reflect.Value, m map[string]interface{}) {
+	if fv.Kind() != reflect.Map || fv.Type().Key().Kind() != reflect.String {
+		return
+	}
+	elem_type := fv.Type().Elem()
+	out := reflect.MakeMap(fv.Type())
+	for k, v := range m {
+		if v == nil {
+			continue
+		}
+		val := reflect.ValueOf(v)
+		if !val.Type().AssignableTo(elem_type) {
+			continue
+		}
+		out.SetMapIndex(reflect.ValueOf(k).Convert(fv.Type().Key()), val)
+	}
+	fv.Set(out)
+}
@@ -0,0 +1,504 @@
+package jsonschema_mw
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tilteng/go-logger/logger"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// What a JSONSchemaResult validated
+type JSONSchemaSource string
+
+const (
+	JSONSchemaSourceBody   JSONSchemaSource = "body"
+	JSONSchemaSourceQuery  JSONSchemaSource = "query parameters"
+	JSONSchemaSourceHeader JSONSchemaSource = "headers"
+)
+
+type JSONSchemaResult struct {
+	source      JSONSchemaSource
+	errors      []*JSONSchemaResultError
+	decodeError error
+}
+
+type JSONSchemaOpts struct {
+	// Schema for request bodies
+	Name string
+	// Schemas for query parameters and headers. Each is an object schema
+	// whose properties are the parameters. Values are converted to the
+	// property's type first: integer, number, boolean, or array (from
+	// repeated or comma separated values). Header names are matched
+	// case insensitively.
+	QuerySchema  string
+	HeaderSchema string
+	// Schemas for response bodies, by status code. 0 is used for any
+	// status not listed. Validated by the application, not by this
+	// middleware.
+	ResponseSchemas map[int]string
+}
+
+// Whether the body, query parameters, or headers failed
+func (self *JSONSchemaResult) Source() JSONSchemaSource {
+	return self.source
+}
+
+func (self *JSONSchemaResult) Errors() []*JSONSchemaResultError {
+	return self.errors
+}
+
+// The BodyDecoder's error, if the body couldn't be decoded to validate
+func (self *JSONSchemaResult) DecodeError() error {
+	return self.decodeError
+}
+
+type JSONSchemaResultError struct {
+	internalError string
+	resultError   gojsonschema.ResultError
+}
+
+// The validation failure, or nil if the body couldn't be validated at
+// all
+func (self *JSONSchemaResultError) ResultError() gojsonschema.ResultError {
+	return self.resultError
+}
+
+func (self *JSONSchemaResultError) String() string {
+	if self.internalError != "" {
+		return self.internalError
+	}
+	return self.resultError.String()
+}
+
+type ErrorHandler func(context.Context, *JSONSchemaResult) bool
+
+func (self ErrorHandler) Error(ctx context.Context, result *JSONSchemaResult) bool {
+	return self(ctx, result)
+}
+
+// Decodes a request body into a generic document (maps, slices, etc) to
+// validate. Without one, bodies are validated as JSON text.
+type BodyDecoder func(context.Context, []byte) (interface{}, error)
+
+func (self BodyDecoder) DecodeBody(ctx context.Context, body []byte) (interface{}, error) {
+	return self(ctx, body)
+}
+
+// Reads the fields of a form body, other than files, without the body
+// being read into memory first. ok is false if the body isn't a form.
+type FormReader func(context.Context) (values map[string][]string, ok bool, err error)
+
+type JSONSchema struct {
+	schema     *gojsonschema.Schema
+	jsonString string
+	document   interface{}
+	// The file:// URL $refs in the schema are relative to
+	url string
+	// Built when the schema is loaded, for query parameters and form
+	// fields, and for headers
+	params       *paramSchema
+	headerParams *paramSchema
+}
+
+func (self *JSONSchema) GetSchema() *gojsonschema.Schema {
+	return self.schema
+}
+
+func (self *JSONSchema) GetJSONString() string {
+	return self.jsonString
+}
+
+type JSONSchemaMiddleware struct {
+	// Replaced, never modified, when schemas are (re)loaded
+	jsonSchemas map[string]*JSONSchema
+	// Names routes use. These stay loaded when their files are deleted.
+	usedSchemas    map[string]bool
+	schemasLock    sync.RWMutex
+	loadLock       sync.Mutex
+	logger         logger.CtxLogger
+	errorHandler   ErrorHandler
+	bodyDecoder    BodyDecoder
+	formReader     FormReader
+	linkPathPrefix string
+}
+
+func (self *JSONSchemaMiddleware) GetSchema(name string) *JSONSchema {
+	schema, _ := self.GetSchemas()[name]
+	return schema
+}
+
+// Looks up a schema a route needs, panicking if it isn't loaded. It
+// stays loaded if its file is deleted.
+func (self *JSONSchemaMiddleware) UseSchema(name string) *JSONSchema {
+	self.schemasLock.Lock()
+	defer self.schemasLock.Unlock()
+	schema, ok := self.jsonSchemas[name]
+	if !ok {
+		panic(fmt.Errorf("Couldn't find json schema with name '%s'", name))
+	}
+	if self.usedSchemas == nil {
+		self.usedSchemas = map[string]bool{}
+	}
+	self.usedSchemas[name] = true
+	return schema
+}
+
+func (self *JSONSchemaMiddleware) isSchemaUsed(name string) bool {
+	self.schemasLock.RLock()
+	defer self.schemasLock.RUnlock()
+	return self.usedSchemas[name]
+}
+
+// The currently loaded schemas by name. The map must not be modified.
+func (self *JSONSchemaMiddleware) GetSchemas() map[string]*JSONSchema {
+	self.schemasLock.RLock()
+	defer self.schemasLock.RUnlock()
+	return self.jsonSchemas
+}
+
+// Load the .json files under base_path. A schema is named by its path
+// relative to base_path, without .json, like "v1/kitten". $refs between
+// loaded schemas are resolved, relative to the referring file or by a
+// schema's id, and a $ref to anything else is an error.
+func (self *JSONSchemaMiddleware) LoadFromPath(ctx context.Context, base_path string) error {
+	return self.loadFromPath(ctx, base_path, false)
+}
+
+// Load schemas under base_path. Unless keep_going is set, the first
+// error fails the whole load. Otherwise the error is logged, and the
+// schema's previous version, if any, stays.
+func (self *JSONSchemaMiddleware) loadFromPath(ctx context.Context, base_path string, keep_going bool) error {
+	// Only one load at a time, so none are lost
+	self.loadLock.Lock()
+	defer self.loadLock.Unlock()
+
+	base_path, err := filepath.Abs(base_path)
+	if err != nil {
+		return err
+	}
+
+	// Schemas already loaded stay available to $ref
+	previous := self.GetSchemas()
+	json_schemas := map[string]*JSONSchema{}
+	for name, schema := range previous {
+		json_schemas[name] = schema
+	}
+
+	keep := func(name string, err error) error {
+		if !keep_going {
+			return err
+		}
+		if self.logger == nil {
+			return nil
+		}
+		if _, ok := previous[name]; ok {
+			self.logger.LogErrorf(ctx, "Keeping the previous version of schema %s: %s", name, err)
+		} else {
+			self.logger.LogErrorf(ctx, "Not loading schema %s: %s", name, err)
+		}
+		return nil
+	}
+
+	found := map[string]bool{}
+	changed := map[string]bool{}
+	err = filepath.Walk(base_path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		rel_path, err := filepath.Rel(base_path, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel_path[0 : len(rel_path)-5])
+		found[name] = true
+
+		schema, err := readSchemaFile(path)
+		if err != nil {
+			return keep(name, err)
+		}
+		if old, ok := json_schemas[name]; ok && old.jsonString == schema.jsonString {
+			return nil
+		}
+		json_schemas[name] = schema
+		changed[name] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Schemas whose files are gone are dropped, unless a route uses them
+	removed := map[string]bool{}
+	for name := range previous {
+		if !found[name] && !self.isSchemaUsed(name) {
+			delete(json_schemas, name)
+			removed[name] = true
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	for {
+		compiled, failed, err := compileSchemas(json_schemas)
+		if err != nil {
+			return err
+		}
+
+		// A changed schema that doesn't compile goes back to its
+		// previous version, or is left out if it's new. Then everything
+		// is compiled again, as schemas that $ref it may have compiled
+		// against the broken one.
+		reverted := false
+		for _, failure := range failed {
+			if !changed[failure.name] {
+				continue
+			}
+			if err := keep(failure.name, failure.err); err != nil {
+				return err
+			}
+			if old, ok := previous[failure.name]; ok {
+				json_schemas[failure.name] = old
+			} else {
+				delete(json_schemas, failure.name)
+			}
+			delete(changed, failure.name)
+			reverted = true
+		}
+		if reverted {
+			continue
+		}
+
+		// Anything else that fails does because of a schema it refers
+		// to, so it keeps the version compiled against the old one
+		for _, failure := range failed {
+			if err := keep(failure.name, failure.err); err != nil {
+				return err
+			}
+			if old, ok := previous[failure.name]; ok {
+				compiled[failure.name] = old
+			}
+		}
+
+		if self.logger != nil {
+			for _, name := range sortedSchemaNames(changed) {
+				self.logger.LogDebug(ctx, "Loaded schema "+name)
+			}
+			for _, name := range sortedSchemaNames(removed) {
+				self.logger.LogDebug(ctx, "Removed schema "+name)
+			}
+		}
+
+		self.schemasLock.Lock()
+		self.jsonSchemas = compiled
+		self.schemasLock.Unlock()
+		return nil
+	}
+}
+
+type schemaLoadError struct {
+	name string
+	err  error
+}
+
+// Compiles every schema, as what a schema refers to may have changed.
+// Returns the ones that compiled and, by name, the errors for the ones
+// that didn't. Schemas sharing an id are an error.
+func compileSchemas(json_schemas map[string]*JSONSchema) (map[string]*JSONSchema, []*schemaLoadError, error) {
+	names := make([]string, 0, len(json_schemas))
+	for name := range json_schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pool := schemaPool{}
+	ids := map[string]string{}
+	for _, name := range names {
+		schema := json_schemas[name]
+		pool[schema.url] = schema.document
+		if id := schemaDocumentID(schema.document); id != "" {
+			if other, ok := ids[id]; ok {
+				return nil, nil, fmt.Errorf("Schemas %s and %s both have id %s", other, name, id)
+			}
+			ids[id] = name
+			pool[id] = schema.document
+		}
+	}
+
+	compiled := make(map[string]*JSONSchema, len(names))
+	var failed []*schemaLoadError
+	for _, name := range names {
+		schema := json_schemas[name]
+		compiled_schema, err := pool.compile(schema.url)
+		if err != nil {
+			failed = append(failed, &schemaLoadError{
+				name: name,
+				err:  fmt.Errorf("Error loading schema from %s: %s", schema.url, err),
+			})
+			continue
+		}
+		json_schema := &JSONSchema{
+			schema:     compiled_schema,
+			jsonString: schema.jsonString,
+			document:   schema.document,
+			url:        schema.url,
+		}
+		json_schema.params = newParamSchema(json_schema, false)
+		json_schema.headerParams = newParamSchema(json_schema, true)
+		compiled[name] = json_schema
+	}
+	return compiled, failed, nil
+}
+
+// Sorted, so loads log the same way each time
+func sortedSchemaNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Reads and decodes a schema. It's compiled once all of them are read.
+func readSchemaFile(path string) (*JSONSchema, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading schema from %s: %s", path, err)
+	}
+
+	json_string := string(bytes)
+
+	document, err := decodeSchemaDocument(json_string)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading schema from %s: %s", path, err)
+	}
+
+	return &JSONSchema{
+		jsonString: json_string,
+		document:   document,
+		url:        schemaFileURL(path),
+	}, nil
+}
+
+func (self *JSONSchemaMiddleware) NewWrapper(schema *gojsonschema.Schema, linkpath string) *JSONSchemaWrapper {
+	if linkpath != "" {
+		if self.linkPathPrefix != "" {
+			linkpath = self.linkPathPrefix + "/" + linkpath
+		}
+	}
+	return &JSONSchemaWrapper{
+		errorHandler: self.errorHandler,
+		bodyDecoder:  self.bodyDecoder,
+		formReader:   self.formReader,
+		schema:       schema,
+		linkPath:     linkpath,
+	}
+}
+
+func (self *JSONSchemaMiddleware) NewWrapperFromSchemaName(ctx context.Context, name string) *JSONSchemaWrapper {
+	schema := self.UseSchema(name)
+	wrapper := self.NewWrapper(schema.GetSchema(), name)
+	// Looked up again for each request, in case it's been reloaded
+	wrapper.middleware = self
+	wrapper.schemaName = name
+	if self.formReader != nil {
+		wrapper.formSchema = self.newParamSchemaFromName(name, false)
+	}
+	return wrapper
+}
+
+func (self *JSONSchemaMiddleware) newParamSchemaFromName(name string, header bool) *paramSchemaRef {
+	self.UseSchema(name)
+	return &paramSchemaRef{
+		middleware: self,
+		name:       name,
+		header:     header,
+	}
+}
+
+// Returns nil if the options name no schemas. For each schema, the
+// first option naming one wins.
+func (self *JSONSchemaMiddleware) NewWrapperFromRouteOptions(ctx context.Context, opts ...interface{}) *JSONSchemaWrapper {
+	var name, query_name, header_name string
+	for _, opt_map_i := range opts {
+		opt, ok := opt_map_i.(*JSONSchemaOpts)
+		if !ok {
+			continue
+		}
+		if len(name) == 0 {
+			name = opt.Name
+		}
+		if len(query_name) == 0 {
+			query_name = opt.QuerySchema
+		}
+		if len(header_name) == 0 {
+			header_name = opt.HeaderSchema
+		}
+	}
+
+	var wrapper *JSONSchemaWrapper
+	if len(name) != 0 {
+		wrapper = self.NewWrapperFromSchemaName(ctx, name)
+	} else if len(query_name) != 0 || len(header_name) != 0 {
+		wrapper = self.NewWrapper(nil, "")
+	} else {
+		return nil
+	}
+	if len(query_name) != 0 {
+		wrapper.querySchema = self.newParamSchemaFromName(query_name, false)
+	}
+	if len(header_name) != 0 {
+		wrapper.headerSchema = self.newParamSchemaFromName(header_name, true)
+	}
+	return wrapper
+}
+
+// Used to validate bodies whose Content-Type isn't JSON. Without a
+// decoder, every body is validated as JSON.
+func (self *JSONSchemaMiddleware) SetBodyDecoder(decoder BodyDecoder) *JSONSchemaMiddleware {
+	self.bodyDecoder = decoder
+	return self
+}
+
+func (self *JSONSchemaMiddleware) SetLogger(logger logger.CtxLogger) *JSONSchemaMiddleware {
+	self.logger = logger
+	return self
+}
+
+func NewMiddleware(error_handler ErrorHandler) *JSONSchemaMiddleware {
+	return &JSONSchemaMiddleware{
+		errorHandler: error_handler,
+		jsonSchemas:  map[string]*JSONSchema{},
+	}
+}
+
+func NewMiddlewareWithLinkPathPrefix(error_handler ErrorHandler, link_path_prefix string) *JSONSchemaMiddleware {
+	return &JSONSchemaMiddleware{
+		errorHandler:   error_handler,
+		jsonSchemas:    map[string]*JSONSchema{},
+		linkPathPrefix: link_path_prefix,
+	}
+}
+
+// Used to validate form bodies. Their fields are converted to the types
+// the schema declares for them, like query parameters. Files are left
+// out, so they're never read into memory to validate.
+func (self *JSONSchemaMiddleware) SetFormReader(reader FormReader) *JSONSchemaMiddleware {
+	self.formReader = reader
+	return self
+}
@@ -0,0 +1,170 @@
+package jsonschema_mw
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// What a request value is coerced to, from the type of a property of a
+// query or header schema
+type paramProperty struct {
+	name      string
+	types     []string
+	itemTypes []string
+}
+
+// A schema for query parameters or headers. These arrive as strings,
+// so they're converted to the types the schema declares for them before
+// validating. The schema should be an object whose properties are the
+// parameters.
+type paramSchema struct {
+	schema *gojsonschema.Schema
+	// By name, canonicalized for headers
+	properties map[string]*paramProperty
+	header     bool
+}
+
+// "type" may be a string or a list of them
+func schemaTypes(prop map[string]interface{}) []string {
+	switch t := prop["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, t_i := range t {
+			if s, ok := t_i.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// Properties that aren't objects, like draft 6's `true`, are left as
+// strings
+func newParamSchema(schema *JSONSchema, header bool) *paramSchema {
+	param_schema := &paramSchema{
+		schema:     schema.GetSchema(),
+		properties: map[string]*paramProperty{},
+		header:     header,
+	}
+	doc, _ := schema.document.(map[string]interface{})
+	props, _ := doc["properties"].(map[string]interface{})
+	for name, prop_i := range props {
+		prop, ok := prop_i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		param_prop := &paramProperty{
+			name:  name,
+			types: schemaTypes(prop),
+		}
+		if items, ok := prop["items"].(map[string]interface{}); ok {
+			param_prop.itemTypes = schemaTypes(items)
+		}
+		key := name
+		if header {
+			key = http.CanonicalHeaderKey(name)
+		}
+		param_schema.properties[key] = param_prop
+	}
+	return param_schema
+}
+
+// Converts s to the first of types it's valid for. Left a string if
+// none, so validation reports the type that was expected.
+func coerceParam(s string, types []string) interface{} {
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i
+			}
+		case "number":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b
+			}
+		case "null":
+			if s == "" {
+				return nil
+			}
+		case "string":
+			return s
+		}
+	}
+	return s
+}
+
+func (self *paramProperty) coerce(values []string) interface{} {
+	for _, t := range self.types {
+		if t != "array" {
+			continue
+		}
+		// Repeated keys, comma separated values, or both
+		items := []interface{}{}
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				items = append(items, coerceParam(strings.TrimSpace(item), self.itemTypes))
+			}
+		}
+		return items
+	}
+	return coerceParam(values[0], self.types)
+}
+
+// Builds the document to validate. Query parameters the schema doesn't
+// know about are included as strings, so additionalProperties can
+// reject them. Other headers are left out, as there are always some.
+func (self *paramSchema) document(values map[string][]string) map[string]interface{} {
+	doc := map[string]interface{}{}
+	for key, key_values := range values {
+		if len(key_values) == 0 {
+			continue
+		}
+		lookup := key
+		if self.header {
+			lookup = http.CanonicalHeaderKey(key)
+		}
+		prop, ok := self.properties[lookup]
+		if !ok {
+			if !self.header {
+				doc[key] = key_values[0]
+			}
+			continue
+		}
+		doc[prop.name] = prop.coerce(key_values)
+	}
+	return doc
+}
+
+func (self *paramSchema) validate(values map[string][]string) (*gojsonschema.Result, error) {
+	return self.schema.Validate(gojsonschema.NewGoLoader(self.document(values)))
+}
+
+// A query or header schema by name, so reloads are picked up. Routes
+// use the schema, so it's never removed.
+type paramSchemaRef struct {
+	middleware *JSONSchemaMiddleware
+	name       string
+	header     bool
+}
+
+// Returns nil if the schema isn't loaded
+func (self *paramSchemaRef) get() *paramSchema {
+	schema := self.middleware.GetSchema(self.name)
+	if schema == nil {
+		return nil
+	}
+	if self.header {
+		return schema.headerParams
+	}
+	return schema.params
+}
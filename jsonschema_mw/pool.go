@@ -0,0 +1,125 @@
+package jsonschema_mw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/xeipuuv/gojsonreference"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Loaded schema documents by URL, so $refs between them resolve without
+// reading anything else from disk or the network. Each is known by its
+// file:// URL and by its id or $id, if it has one.
+type schemaPool map[string]interface{}
+
+func schemaFileURL(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// Without the fragment
+func schemaDocumentURL(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// Decoded the way gojsonschema decodes documents itself
+func decodeSchemaDocument(json_string string) (interface{}, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(json_string)))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// The document's id ($id in newer drafts), if it's an absolute URL
+func schemaDocumentID(doc interface{}) string {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"$id", "id"} {
+		id, ok := m[key].(string)
+		if !ok {
+			continue
+		}
+		if ref, err := gojsonreference.NewJsonReference(id); err == nil && ref.HasFullUrl {
+			return schemaDocumentURL(id)
+		}
+	}
+	return ""
+}
+
+func (self schemaPool) compile(doc_url string) (*gojsonschema.Schema, error) {
+	return gojsonschema.NewSchema(&poolLoader{pool: self, source: doc_url})
+}
+
+// Implements gojsonschema.JSONLoader and JSONLoaderFactory, so $refs are
+// looked up in the pool
+type poolLoader struct {
+	pool   schemaPool
+	source string
+}
+
+func (self *poolLoader) JsonSource() interface{} {
+	return self.source
+}
+
+func (self *poolLoader) LoadJSON() (interface{}, error) {
+	doc, ok := self.pool[schemaDocumentURL(self.source)]
+	if !ok {
+		return nil, fmt.Errorf("$ref to %s, which isn't a loaded schema", self.source)
+	}
+	return doc, nil
+}
+
+func (self *poolLoader) JsonReference() (gojsonreference.JsonReference, error) {
+	return gojsonreference.NewJsonReference(self.source)
+}
+
+func (self *poolLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return self
+}
+
+func (self *poolLoader) New(source string) gojsonschema.JSONLoader {
+	return &poolLoader{pool: self.pool, source: source}
+}
+
+// The name of the loaded schema a $ref in from points to, and the JSON
+// pointer within it. ok is false if it's to anything else.
+func (self *JSONSchemaMiddleware) ResolveRef(from *JSONSchema, ref string) (name string, pointer string, ok bool) {
+	if from.url == "" {
+		return "", "", false
+	}
+	parent, err := gojsonreference.NewJsonReference(from.url)
+	if err != nil {
+		return "", "", false
+	}
+	child, err := gojsonreference.NewJsonReference(ref)
+	if err != nil {
+		return "", "", false
+	}
+	resolved := &child
+	if !child.HasFullUrl {
+		if resolved, err = parent.Inherits(child); err != nil {
+			return "", "", false
+		}
+	}
+
+	doc_url := schemaDocumentURL(resolved.String())
+	for schema_name, schema := range self.GetSchemas() {
+		if schema.url == doc_url || schemaDocumentID(schema.document) == doc_url {
+			return schema_name, resolved.GetUrl().Fragment, true
+		}
+	}
+	return "", "", false
+}
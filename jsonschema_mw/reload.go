@@ -0,0 +1,78 @@
+package jsonschema_mw
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Load schemas under base_path again, replacing the ones that changed.
+// This is safe while serving requests. A schema that fails to load is
+// logged and its previous version stays, for schemas that $ref it too.
+// Schemas whose files are gone are removed, unless a route uses them.
+func (self *JSONSchemaMiddleware) ReloadFromPath(ctx context.Context, base_path string) error {
+	return self.loadFromPath(ctx, base_path, true)
+}
+
+type schemaFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func schemaFileStates(base_path string) map[string]schemaFileState {
+	states := map[string]schemaFileState{}
+	filepath.Walk(base_path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".json") {
+			states[path] = schemaFileState{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+			}
+		}
+		return nil
+	})
+	return states
+}
+
+func sameSchemaFileStates(a, b map[string]schemaFileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, ok := b[path]; !ok || !other.modTime.Equal(state.modTime) || other.size != state.size {
+			return false
+		}
+	}
+	return true
+}
+
+// Check base_path for changed schema files every interval, and reload
+// them with ReloadFromPath() when there are any. Returns when ctx is
+// done, so run it in a goroutine.
+func (self *JSONSchemaMiddleware) WatchPath(ctx context.Context, base_path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	states := schemaFileStates(base_path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		new_states := schemaFileStates(base_path)
+		if sameSchemaFileStates(states, new_states) {
+			continue
+		}
+		states = new_states
+
+		if err := self.ReloadFromPath(ctx, base_path); err != nil && self.logger != nil {
+			self.logger.LogErrorf(ctx, "Error reloading schemas from %s: %s", base_path, err)
+		}
+	}
+}
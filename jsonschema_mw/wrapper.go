@@ -0,0 +1,191 @@
+package jsonschema_mw
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tilteng/go-api-framework/api_router"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type JSONSchemaWrapper struct {
+	errorHandler ErrorHandler
+	bodyDecoder  BodyDecoder
+	formReader   FormReader
+	linkPath     string
+	schema       *gojsonschema.Schema
+	querySchema  *paramSchemaRef
+	headerSchema *paramSchemaRef
+	// The body schema, for form fields
+	formSchema *paramSchemaRef
+	// If set, schemaName is looked up here for each request rather than
+	// using schema
+	middleware *JSONSchemaMiddleware
+	schemaName string
+}
+
+func (self *JSONSchemaWrapper) currentSchema() *gojsonschema.Schema {
+	if self.middleware != nil {
+		if schema := self.middleware.GetSchema(self.schemaName); schema != nil {
+			return schema.GetSchema()
+		}
+	}
+	return self.schema
+}
+
+func (self *JSONSchemaWrapper) loaderForBody(ctx context.Context, body []byte) (gojsonschema.JSONLoader, error) {
+	if self.bodyDecoder == nil {
+		return gojsonschema.NewStringLoader(string(body)), nil
+	}
+	doc, err := self.bodyDecoder.DecodeBody(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	return gojsonschema.NewGoLoader(doc), nil
+}
+
+func (self *JSONSchemaWrapper) validateBody(ctx context.Context, rctx *api_router.RequestContext, body []byte) bool {
+	our_result := &JSONSchemaResult{source: JSONSchemaSourceBody}
+
+	var resp *gojsonschema.Result
+	loader, err := self.loaderForBody(ctx, body)
+	if err == nil {
+		resp, err = self.currentSchema().Validate(loader)
+	} else {
+		our_result.decodeError = err
+	}
+	if err != nil {
+		err = fmt.Errorf("Error validating body: %s", err)
+	}
+	return self.handleResult(ctx, rctx, our_result, resp, err)
+}
+
+func (self *JSONSchemaWrapper) validateForm(ctx context.Context, rctx *api_router.RequestContext, values map[string][]string) bool {
+	param_schema := &paramSchema{schema: self.currentSchema()}
+	if self.formSchema != nil {
+		param_schema = self.formSchema.get()
+	}
+	if param_schema == nil {
+		err := fmt.Errorf("Error validating body: Couldn't find json schema with name '%s'", self.formSchema.name)
+		return self.handleResult(ctx, rctx, &JSONSchemaResult{source: JSONSchemaSourceBody}, nil, err)
+	}
+	resp, err := param_schema.validate(values)
+	if err != nil {
+		err = fmt.Errorf("Error validating body: %s", err)
+	}
+	return self.handleResult(ctx, rctx, &JSONSchemaResult{source: JSONSchemaSourceBody}, resp, err)
+}
+
+func (self *JSONSchemaWrapper) validateParams(ctx context.Context, rctx *api_router.RequestContext, source JSONSchemaSource, schema *paramSchemaRef, values map[string][]string) bool {
+	param_schema := schema.get()
+	if param_schema == nil {
+		err := fmt.Errorf("Error validating %s: Couldn't find json schema with name '%s'", source, schema.name)
+		return self.handleResult(ctx, rctx, &JSONSchemaResult{source: source}, nil, err)
+	}
+	resp, err := param_schema.validate(values)
+	if err != nil {
+		err = fmt.Errorf("Error validating %s: %s", source, err)
+	}
+	return self.handleResult(ctx, rctx, &JSONSchemaResult{source: source}, resp, err)
+}
+
+func (self *JSONSchemaWrapper) handleResult(ctx context.Context, rctx *api_router.RequestContext, our_result *JSONSchemaResult, resp *gojsonschema.Result, err error) bool {
+	if err != nil {
+		our_result.errors = []*JSONSchemaResultError{
+			&JSONSchemaResultError{
+				internalError: err.Error(),
+			},
+		}
+	} else if resp.Valid() {
+		return true
+	} else {
+		json_errors := resp.Errors()
+		our_result.errors = make(
+			[]*JSONSchemaResultError, len(json_errors), len(json_errors),
+		)
+		for i, result := range json_errors {
+			our_result.errors[i] = &JSONSchemaResultError{
+				resultError: result,
+			}
+		}
+	}
+
+	if self.errorHandler != nil {
+		return self.errorHandler.Error(ctx, our_result)
+	}
+
+	var str string
+	for i, result := range our_result.errors {
+		if i == 0 {
+			str += result.String()
+		} else {
+			str += "," + result.String()
+		}
+	}
+	rctx.SetStatus(400)
+	rctx.WriteResponse(nil) // Force writing of status
+	panic(str)
+}
+
+func (self *JSONSchemaWrapper) SetErrorHandler(error_handler ErrorHandler) *JSONSchemaWrapper {
+	self.errorHandler = error_handler
+	return self
+}
+
+func (self *JSONSchemaWrapper) Wrap(next api_router.RouteFn) api_router.RouteFn {
+	return func(ctx context.Context) {
+		rctx := api_router.RequestContextFromContext(ctx)
+		if self.linkPath != "" {
+			rctx.SetResponseHeader(
+				"Link",
+				fmt.Sprintf(`<%s>; rel="describedBy"`,
+					self.linkPath,
+				),
+			)
+		}
+		r := rctx.HTTPRequest()
+		if self.querySchema != nil {
+			if !self.validateParams(ctx, rctx, JSONSchemaSourceQuery, self.querySchema, r.URL.Query()) {
+				return
+			}
+		}
+		if self.headerSchema != nil {
+			if !self.validateParams(ctx, rctx, JSONSchemaSourceHeader, self.headerSchema, r.Header) {
+				return
+			}
+		}
+		if self.schema == nil {
+			next(ctx)
+			return
+		}
+		if self.formReader != nil {
+			values, ok, err := self.formReader(ctx)
+			if err != nil {
+				our_result := &JSONSchemaResult{
+					source:      JSONSchemaSourceBody,
+					decodeError: err,
+				}
+				err = fmt.Errorf("Error validating body: %s", err)
+				if self.handleResult(ctx, rctx, our_result, nil, err) {
+					next(ctx)
+				}
+				return
+			}
+			if ok {
+				if self.validateForm(ctx, rctx, values) {
+					next(ctx)
+				}
+				return
+			}
+		}
+		body, err := rctx.BodyCopy()
+		if err != nil {
+			// Passed along as is, as errors like a body that's too
+			// large may carry their own status
+			panic(err)
+		}
+		if self.validateBody(ctx, rctx, body) {
+			next(ctx)
+		}
+	}
+}
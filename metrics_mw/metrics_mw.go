@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/tilteng/go-api-router/api_router"
+	"github.com/tilteng/go-api-framework/api_router"
 	"github.com/tilteng/go-metrics/metrics"
 )
 
@@ -61,6 +61,8 @@ func (self *MetricsWrapper) sendMetrics(ctx context.Context, duration time.Durat
 			"method": http_req.Method,
 			"status": fmt.Sprintf("%d", writer.Status()),
 			"size":   fmt.Sprintf("%d", writer.Size()),
+			// Same as size, unless the response was compressed
+			"uncompressed_size": fmt.Sprintf("%d", writer.UncompressedSize()),
 		},
 	)
 }
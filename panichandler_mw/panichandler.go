@@ -3,7 +3,7 @@ package panichandler_mw
 import (
 	"context"
 
-	"github.com/tilteng/go-api-router/api_router"
+	"github.com/tilteng/go-api-framework/api_router"
 )
 
 type PanicHandler interface {
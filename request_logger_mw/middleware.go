@@ -7,7 +7,7 @@ import (
 	"net/http"
 	"net/url"
 
-	"github.com/tilteng/go-api-router/api_router"
+	"github.com/tilteng/go-api-framework/api_router"
 	"github.com/tilteng/go-logger/logger"
 )
 
@@ -131,7 +131,9 @@ func (self *RequestLoggerWrapper) Wrap(next api_router.RouteFn) api_router.Route
 
 		body, err := rctx.BodyCopy()
 		if err != nil {
-			panic(fmt.Sprintf("Couldn't read body: %+v", err))
+			// Whatever reads the body next sees the same error and
+			// deals with it
+			body = []byte(fmt.Sprintf("Couldn't read body: %s", err))
 		}
 		if self.opts.Logger != nil && !self.opts.Disable {
 			self.opts.Logger.LogDebugf(
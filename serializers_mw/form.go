@@ -0,0 +1,653 @@
+package serializers_mw
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Deserializers for application/x-www-form-urlencoded and
+// multipart/form-data request bodies. Bodies decode into structs using
+// `form` tags, falling back to `json` tags and then field names. Values
+// are converted to the field's type. Uploaded files decode into
+// *FormFile or []*FormFile fields.
+//
+// Decoding into a map[string]interface{} or interface{} gives a string
+// for each field, a []interface{} for repeated fields, and a *FormFile
+// for each file.
+
+var _formSerializer = NewFormSerializer(nil)
+var _multipartFormSerializer = NewMultipartFormSerializer(nil)
+
+// Implemented by the form deserializers, so a request's form body can be
+// parsed once and kept for everything that reads it
+type formDeserializer interface {
+	readFormData(io.Reader, map[string]string) (*formData, error)
+}
+
+// Serializers that can only be used for request bodies
+type requestOnlySerializer interface {
+	requestOnly()
+}
+
+type FormOpts struct {
+	// Uploaded files bigger than this are written to temp files.
+	// Default 1 MiB.
+	MaxFileMemory int64
+	// Largest file allowed. Default 32 MiB.
+	MaxFileSize int64
+	// Most files allowed in one request. Default 16.
+	MaxFiles int
+	// Total size of all fields that aren't files. Default 1 MiB.
+	MaxFieldsSize int64
+	// Directory for temp files. Default os.TempDir()
+	TempDir string
+}
+
+func (self *FormOpts) withDefaults() *FormOpts {
+	opts := &FormOpts{}
+	if self != nil {
+		*opts = *self
+	}
+	if opts.MaxFileMemory <= 0 {
+		opts.MaxFileMemory = 1 << 20
+	}
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = 32 << 20
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 16
+	}
+	if opts.MaxFieldsSize <= 0 {
+		opts.MaxFieldsSize = 1 << 20
+	}
+	return opts
+}
+
+// Returned when a form body is over one of the FormOpts limits
+type FormLimitError struct {
+	// Field name, if the limit is for a single field
+	Field string
+	Limit string
+	Max   int64
+}
+
+func (self *FormLimitError) Error() string {
+	if self.Field != "" {
+		return fmt.Sprintf("Form field '%s' exceeds the %s limit of %d", self.Field, self.Limit, self.Max)
+	}
+	return fmt.Sprintf("Form exceeds the %s limit of %d", self.Limit, self.Max)
+}
+
+// An uploaded file. Small files are kept in memory. Bigger ones are
+// written to a temp file that's removed once the request is finished.
+type FormFile struct {
+	Field    string
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	content  []byte
+	tempPath string
+}
+
+type memFormFile struct {
+	*bytes.Reader
+}
+
+func (self *memFormFile) Close() error {
+	return nil
+}
+
+// Returns a handle for reading the file's content. Close it when done.
+func (self *FormFile) Open() (multipart.File, error) {
+	if self.tempPath != "" {
+		return os.Open(self.tempPath)
+	}
+	return &memFormFile{bytes.NewReader(self.content)}, nil
+}
+
+func (self *FormFile) ContentType() string {
+	return self.Header.Get("Content-Type")
+}
+
+// Only the metadata. The content is never included.
+func (self *FormFile) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"filename":     self.Filename,
+		"content_type": self.ContentType(),
+		"size":         self.Size,
+	})
+}
+
+func (self *FormFile) remove() {
+	if self.tempPath != "" {
+		os.Remove(self.tempPath)
+	}
+}
+
+type formData struct {
+	values url.Values
+	files  map[string][]*FormFile
+}
+
+func (self *formData) cleanup() {
+	for _, files := range self.files {
+		for _, file := range files {
+			file.remove()
+		}
+	}
+}
+
+// application/x-www-form-urlencoded
+
+type formSerializer struct {
+	opts *FormOpts
+}
+
+func NewFormSerializer(opts *FormOpts) Serializer {
+	return &formSerializer{opts: opts.withDefaults()}
+}
+
+func (self *formSerializer) requestOnly() {}
+
+func (self *formSerializer) GetMimeType() string {
+	return "application/x-www-form-urlencoded"
+}
+
+func (self *formSerializer) Serialize(v interface{}) ([]byte, error) {
+	return nil, errors.New("application/x-www-form-urlencoded is only supported for request bodies")
+}
+
+func (self *formSerializer) SerializeToWriter(w io.Writer, v interface{}) error {
+	_, err := self.Serialize(v)
+	return err
+}
+
+func (self *formSerializer) Deserialize(data []byte, v interface{}) error {
+	return self.DeserializeFromReader(bytes.NewReader(data), v)
+}
+
+func (self *formSerializer) DeserializeFromReader(r io.Reader, v interface{}) error {
+	data, err := self.readFormData(r, nil)
+	if err != nil {
+		return err
+	}
+	return decodeForm(data, v)
+}
+
+func (self *formSerializer) readFormData(r io.Reader, _ map[string]string) (*formData, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, self.opts.MaxFieldsSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > self.opts.MaxFieldsSize {
+		return nil, &FormLimitError{Limit: "MaxFieldsSize", Max: self.opts.MaxFieldsSize}
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return &formData{values: values}, nil
+}
+
+// multipart/form-data
+
+type multipartFormSerializer struct {
+	opts *FormOpts
+}
+
+func NewMultipartFormSerializer(opts *FormOpts) Serializer {
+	return &multipartFormSerializer{opts: opts.withDefaults()}
+}
+
+func (self *multipartFormSerializer) requestOnly() {}
+
+func (self *multipartFormSerializer) GetMimeType() string {
+	return "multipart/form-data"
+}
+
+func (self *multipartFormSerializer) Serialize(v interface{}) ([]byte, error) {
+	return nil, errors.New("multipart/form-data is only supported for request bodies")
+}
+
+func (self *multipartFormSerializer) SerializeToWriter(w io.Writer, v interface{}) error {
+	_, err := self.Serialize(v)
+	return err
+}
+
+func (self *multipartFormSerializer) Deserialize(data []byte, v interface{}) error {
+	return errors.New("multipart/form-data requires a boundary parameter")
+}
+
+func (self *multipartFormSerializer) DeserializeFromReader(r io.Reader, v interface{}) error {
+	return self.Deserialize(nil, v)
+}
+
+func (self *multipartFormSerializer) DeserializeWithParams(r io.Reader, params map[string]string, v interface{}) (func(), error) {
+	data, err := self.readFormData(r, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeForm(data, v); err != nil {
+		data.cleanup()
+		return nil, err
+	}
+	return data.cleanup, nil
+}
+
+func (self *multipartFormSerializer) readFormData(r io.Reader, params map[string]string) (*formData, error) {
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, self.Deserialize(nil, nil)
+	}
+	return self.readForm(multipart.NewReader(r, boundary))
+}
+
+func (self *multipartFormSerializer) readForm(mr *multipart.Reader) (*formData, error) {
+	data := &formData{
+		values: url.Values{},
+		files:  map[string][]*FormFile{},
+	}
+
+	var fields_size int64
+	var num_files int
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			data.cleanup()
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			remaining := self.opts.MaxFieldsSize - fields_size
+			b, err := ioutil.ReadAll(io.LimitReader(part, remaining+1))
+			if err != nil {
+				data.cleanup()
+				return nil, err
+			}
+			if int64(len(b)) > remaining {
+				data.cleanup()
+				return nil, &FormLimitError{Limit: "MaxFieldsSize", Max: self.opts.MaxFieldsSize}
+			}
+			fields_size += int64(len(b))
+			data.values.Add(name, string(b))
+			continue
+		}
+
+		num_files++
+		if num_files > self.opts.MaxFiles {
+			data.cleanup()
+			return nil, &FormLimitError{Limit: "MaxFiles", Max: int64(self.opts.MaxFiles)}
+		}
+
+		file, err := self.readFile(part)
+		if err != nil {
+			data.cleanup()
+			return nil, err
+		}
+		data.files[name] = append(data.files[name], file)
+	}
+}
+
+// Keep the file in memory up to MaxFileMemory, then spill to a temp file
+func (self *multipartFormSerializer) readFile(part *multipart.Part) (*FormFile, error) {
+	file := &FormFile{
+		Field:    part.FormName(),
+		Filename: part.FileName(),
+		Header:   part.Header,
+	}
+	too_large := &FormLimitError{
+		Field: file.Field,
+		Limit: "MaxFileSize",
+		Max:   self.opts.MaxFileSize,
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, self.opts.MaxFileMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= self.opts.MaxFileMemory {
+		if n > self.opts.MaxFileSize {
+			return nil, too_large
+		}
+		file.content = buf.Bytes()
+		file.Size = n
+		return file, nil
+	}
+
+	tmp, err := ioutil.TempFile(self.opts.TempDir, "form-upload-")
+	if err != nil {
+		return nil, err
+	}
+	file.tempPath = tmp.Name()
+
+	size, err := io.Copy(tmp, io.MultiReader(
+		&buf,
+		io.LimitReader(part, self.opts.MaxFileSize-n+1),
+	))
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil && size > self.opts.MaxFileSize {
+		err = too_large
+	}
+	if err != nil {
+		file.remove()
+		return nil, err
+	}
+
+	file.Size = size
+	return file, nil
+}
+
+// Decoding into Go values
+
+var formFileType = reflect.TypeOf(&FormFile{})
+var formFilesType = reflect.TypeOf([]*FormFile{})
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func (self *formData) generic() map[string]interface{} {
+	doc := make(map[string]interface{}, len(self.values)+len(self.files))
+	for name, vals := range self.values {
+		if len(vals) == 1 {
+			doc[name] = vals[0]
+			continue
+		}
+		arr := make([]interface{}, len(vals))
+		for i, val := range vals {
+			arr[i] = val
+		}
+		doc[name] = arr
+	}
+	for name, files := range self.files {
+		if len(files) == 1 {
+			doc[name] = files[0]
+			continue
+		}
+		arr := make([]interface{}, len(files))
+		for i, file := range files {
+			arr[i] = file
+		}
+		doc[name] = arr
+	}
+	return doc
+}
+
+func decodeForm(data *formData, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("form: decoding requires a non-nil pointer")
+	}
+
+	rv = rv.Elem()
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			break
+		}
+		rv.Set(reflect.ValueOf(data.generic()))
+		return nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		return decodeFormMap(data, rv)
+	case reflect.Struct:
+		return decodeFormStruct(data, rv)
+	}
+
+	return fmt.Errorf("form: cannot decode into Go value of type %s", rv.Type())
+}
+
+func decodeFormMap(data *formData, rv reflect.Value) error {
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMap(rv.Type()))
+	}
+	elem_type := rv.Type().Elem()
+
+	if elem_type.Kind() == reflect.Interface && elem_type.NumMethod() == 0 {
+		for name, val := range data.generic() {
+			rv.SetMapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()), reflect.ValueOf(val))
+		}
+		return nil
+	}
+
+	for name, vals := range data.values {
+		elem := reflect.New(elem_type).Elem()
+		if err := setFormField(elem, vals, nil); err != nil {
+			return fmt.Errorf("form field '%s': %s", name, err)
+		}
+		rv.SetMapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()), elem)
+	}
+	if elem_type == formFileType || elem_type == formFilesType {
+		for name, files := range data.files {
+			elem := reflect.New(elem_type).Elem()
+			setFormField(elem, nil, files)
+			rv.SetMapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()), elem)
+		}
+	}
+	return nil
+}
+
+type formField struct {
+	name  string
+	index []int
+}
+
+// Named by `form` tag, then `json` tag, then field name. Embedded
+// structs are flattened. The first field found for a name wins.
+func formFields(t reflect.Type) []*formField {
+	var fields []*formField
+	seen := map[string]bool{}
+
+	var walk func(reflect.Type, []int)
+	walk = func(t reflect.Type, parent_index []int) {
+		var embedded []reflect.StructField
+
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			name := ""
+			for _, tag_name := range []string{"form", "json"} {
+				if tag, ok := sf.Tag.Lookup(tag_name); ok {
+					name = strings.Split(tag, ",")[0]
+					break
+				}
+			}
+			if name == "-" {
+				continue
+			}
+
+			if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				embedded = append(embedded, sf)
+				continue
+			}
+			if sf.PkgPath != "" {
+				continue
+			}
+
+			if name == "" {
+				name = sf.Name
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			index := append(append([]int{}, parent_index...), i)
+			fields = append(fields, &formField{name: name, index: index})
+		}
+
+		// Outer fields take precedence over embedded ones
+		for _, sf := range embedded {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				if sf.PkgPath != "" {
+					continue
+				}
+				ft = ft.Elem()
+			}
+			walk(ft, append(append([]int{}, parent_index...), sf.Index[0]))
+		}
+	}
+	walk(t, nil)
+
+	return fields
+}
+
+func decodeFormStruct(data *formData, rv reflect.Value) error {
+	for _, field := range formFields(rv.Type()) {
+		vals := data.values[field.name]
+		files := data.files[field.name]
+		if len(vals) == 0 && len(files) == 0 {
+			continue
+		}
+
+		fv := rv
+		for i, x := range field.index {
+			if i > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+
+		if err := setFormField(fv, vals, files); err != nil {
+			return fmt.Errorf("form field '%s': %s", field.name, err)
+		}
+	}
+	return nil
+}
+
+func setFormField(fv reflect.Value, vals []string, files []*FormFile) error {
+	switch fv.Type() {
+	case formFileType:
+		if len(files) != 0 {
+			fv.Set(reflect.ValueOf(files[0]))
+		}
+		return nil
+	case formFilesType:
+		fv.Set(reflect.ValueOf(files))
+		return nil
+	}
+
+	if len(vals) == 0 {
+		return nil
+	}
+
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 &&
+		!reflect.PtrTo(fv.Type()).Implements(textUnmarshalerType) {
+		slice := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			if err := setFormValue(slice.Index(i), val); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+
+	return setFormValue(fv, vals[0])
+}
+
+func setFormValue(fv reflect.Value, s string) error {
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return setFormValue(fv.Elem(), s)
+	}
+
+	if fv.CanAddr() {
+		if tu, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return tu.UnmarshalText([]byte(s))
+		}
+	}
+
+	if fv.Kind() == reflect.String {
+		fv.SetString(s)
+		return nil
+	}
+
+	// Empty inputs leave non-string fields alone
+	if s == "" {
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.Bool:
+		if s == "on" {
+			// What browsers send for a checked checkbox
+			fv.SetBool(true)
+			return nil
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a boolean", s)
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid %s", s, fv.Type())
+		}
+		fv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid %s", s, fv.Type())
+		}
+		fv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid number", s)
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		// []byte
+		fv.SetBytes([]byte(s))
+	case reflect.Interface:
+		if fv.NumMethod() != 0 {
+			return fmt.Errorf("cannot decode into Go value of type %s", fv.Type())
+		}
+		fv.Set(reflect.ValueOf(s))
+	default:
+		return fmt.Errorf("cannot decode into Go value of type %s", fv.Type())
+	}
+	return nil
+}
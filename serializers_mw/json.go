@@ -0,0 +1,466 @@
+package serializers_mw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var _jsonSerializer = jsonSerializer{mimeType: "application/json"}
+
+// A JSON serializer for another media type, such as one with a +json
+// suffix
+func NewJSONSerializer(mime_type string) Serializer {
+	return jsonSerializer{mimeType: mime_type}
+}
+
+// How strictly JSON request bodies are decoded. See
+// ContextWithJSONDecodeOpts().
+type JSONDecodeOpts struct {
+	// Fail on object keys that don't match a struct field
+	DisallowUnknownFields bool
+	// Decode numbers into interface{} as json.Number instead of float64
+	UseNumber bool
+	// Most arrays and objects that can be nested. 0 means no limit.
+	MaxDepth int
+	// Fail if anything but whitespace follows the top-level value
+	DisallowTrailingData bool
+}
+
+// Returned when a JSON body can't be decoded. Pointer is the RFC 6901
+// JSON pointer to the offending value, "" being the whole document.
+type JSONDecodeError struct {
+	Pointer string
+	Err     error
+}
+
+func (self *JSONDecodeError) Error() string {
+	if self.Pointer == "" {
+		return self.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", self.Pointer, self.Err)
+}
+
+// Implemented by deserializers that support JSONDecodeOpts. This is used
+// in place of DeserializeFromReader() when the request has options.
+type JSONOptsDeserializer interface {
+	DeserializeWithJSONOpts(io.Reader, *JSONDecodeOpts, interface{}) error
+}
+
+type jsonSerializer struct {
+	mimeType string
+}
+
+func (self jsonSerializer) GetMimeType() string {
+	return self.mimeType
+}
+
+func (self jsonSerializer) Serialize(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (self jsonSerializer) SerializeToWriter(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (self jsonSerializer) Deserialize(data []byte, v interface{}) error {
+	// Like json.Unmarshal()
+	return decodeJSON(bytes.NewReader(data), &JSONDecodeOpts{DisallowTrailingData: true}, v)
+}
+
+func (self jsonSerializer) DeserializeFromReader(r io.Reader, v interface{}) error {
+	return self.DeserializeWithJSONOpts(r, nil, v)
+}
+
+func (self jsonSerializer) DeserializeWithJSONOpts(r io.Reader, opts *JSONDecodeOpts, v interface{}) error {
+	return decodeJSON(r, opts, v)
+}
+
+var errJSONTooDeep = errors.New("JSON nested too deeply")
+
+// Keeps what's been read, for finding where errors are, and fails as
+// soon as arrays and objects are nested more than maxDepth deep, so a
+// body like "[[[[..." isn't read to the end first.
+type jsonBodyReader struct {
+	reader   io.Reader
+	data     bytes.Buffer
+	maxDepth int
+	depth    int
+	inString bool
+	escaped  bool
+	err      error
+}
+
+func (self *jsonBodyReader) Read(b []byte) (int, error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	n, err := self.reader.Read(b)
+	if self.maxDepth > 0 {
+		for i, c := range b[:n] {
+			if self.inString {
+				switch {
+				case self.escaped:
+					self.escaped = false
+				case c == '\\':
+					self.escaped = true
+				case c == '"':
+					self.inString = false
+				}
+				continue
+			}
+			switch c {
+			case '"':
+				self.inString = true
+			case '[', '{':
+				self.depth++
+				if self.depth > self.maxDepth {
+					// Nothing after this is decoded
+					self.data.Write(b[:i+1])
+					self.err = errJSONTooDeep
+					return i + 1, self.err
+				}
+			case ']', '}':
+				self.depth--
+			}
+		}
+	}
+	self.data.Write(b[:n])
+	if err != nil && err != io.EOF {
+		self.err = err
+	}
+	return n, err
+}
+
+func (self *jsonBodyReader) tooDeepError() error {
+	ptr := ""
+	walkJSON(self.data.Bytes(), func(value_ptr string, depth int, _ int64) bool {
+		ptr = value_ptr
+		return depth <= self.maxDepth
+	})
+	return &JSONDecodeError{
+		Pointer: ptr,
+		Err:     fmt.Errorf("nested more than %d levels deep", self.maxDepth),
+	}
+}
+
+func decodeJSON(r io.Reader, opts *JSONDecodeOpts, v interface{}) error {
+	if opts == nil {
+		opts = &JSONDecodeOpts{}
+	}
+
+	body := &jsonBodyReader{reader: r, maxDepth: opts.MaxDepth}
+	dec := json.NewDecoder(body)
+	if opts.UseNumber {
+		dec.UseNumber()
+	}
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		switch {
+		case err == errJSONTooDeep:
+			return body.tooDeepError()
+		case err == body.err:
+			// Like the body being too large
+			return err
+		}
+		return newJSONDecodeError(body.data.Bytes(), v, err)
+	}
+	if opts.DisallowTrailingData {
+		if _, err := dec.Token(); err != io.EOF {
+			if err != nil && err == body.err && err != errJSONTooDeep {
+				return err
+			}
+			return &JSONDecodeError{
+				Err: errors.New("unexpected data after the top-level value"),
+			}
+		}
+	}
+	return nil
+}
+
+func newJSONDecodeError(data []byte, v interface{}, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		ptr, _ := walkJSON(data, func(string, int, int64) bool { return true })
+		return &JSONDecodeError{Pointer: ptr, Err: err}
+	case *json.UnmarshalTypeError:
+		// Offset is just past the value, or its first token for arrays
+		// and objects
+		ptr := ""
+		walkJSON(data, func(value_ptr string, _ int, end int64) bool {
+			ptr = value_ptr
+			return end < e.Offset
+		})
+		return &JSONDecodeError{
+			Pointer: ptr,
+			Err:     fmt.Errorf("expected %s, not %s", jsonTypeName(e.Type), e.Value),
+		}
+	}
+	if err == io.EOF {
+		return &JSONDecodeError{Err: errors.New("the body is empty")}
+	}
+	if err == io.ErrUnexpectedEOF {
+		ptr, _ := walkJSON(data, func(string, int, int64) bool { return true })
+		return &JSONDecodeError{Pointer: ptr, Err: errors.New("unexpected end of input")}
+	}
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		if ptr, key, ok := findUnknownJSONField(data, reflect.TypeOf(v)); ok {
+			return &JSONDecodeError{
+				Pointer: ptr,
+				Err:     fmt.Errorf("unknown field %q", key),
+			}
+		}
+	}
+	return &JSONDecodeError{Err: err}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return t.String()
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+type jsonWalkFrame struct {
+	ptr   string
+	array bool
+	index int
+	key   string
+	// An object waiting for its next key
+	wantKey bool
+}
+
+// Calls fn with the JSON pointer and depth of each value in data, along
+// with the input offset just past the value's first token. Depth counts
+// the value itself if it's an array or object. Stops when fn returns
+// false, or after the top-level value. On a syntax error, returns it
+// with the pointer of where it happened.
+func walkJSON(data []byte, fn func(ptr string, depth int, end int64) bool) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var stack []*jsonWalkFrame
+
+	next_ptr := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		top := stack[len(stack)-1]
+		switch {
+		case top.array:
+			return top.ptr + "/" + strconv.Itoa(top.index)
+		case top.wantKey:
+			return top.ptr
+		}
+		return top.ptr + "/" + escapeJSONPointer(top.key)
+	}
+	value_done := func() {
+		if top := stack[len(stack)-1]; top.array {
+			top.index++
+		} else {
+			top.wantKey = true
+		}
+	}
+
+	for {
+		ptr := next_ptr()
+		tok, err := dec.Token()
+		if err == io.EOF && len(stack) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return ptr, err
+		}
+
+		delim, is_delim := tok.(json.Delim)
+		if is_delim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return "", nil
+			}
+			value_done()
+			continue
+		}
+		if len(stack) != 0 {
+			if top := stack[len(stack)-1]; top.wantKey {
+				top.key = tok.(string)
+				top.wantKey = false
+				continue
+			}
+		}
+
+		depth := len(stack)
+		if is_delim {
+			depth++
+		}
+		if !fn(ptr, depth, dec.InputOffset()) {
+			return "", nil
+		}
+		if is_delim {
+			stack = append(stack, &jsonWalkFrame{
+				ptr:     ptr,
+				array:   delim == '[',
+				wantKey: delim == '{',
+			})
+			continue
+		}
+		if len(stack) == 0 {
+			return "", nil
+		}
+		value_done()
+	}
+}
+
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// Fields encoding/json would decode into, including those of embedded
+// structs
+func jsonFields(t reflect.Type) []*jsonField {
+	var fields []*jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, &jsonField{name: name, typ: field.Type})
+	}
+	return fields
+}
+
+// Matches keys like encoding/json: exactly, or else case-insensitively
+func lookupJSONField(fields []*jsonField, key string) *jsonField {
+	for _, field := range fields {
+		if field.name == key {
+			return field
+		}
+	}
+	for _, field := range fields {
+		if strings.EqualFold(field.name, key) {
+			return field
+		}
+	}
+	return nil
+}
+
+// encoding/json doesn't say where an unknown field is, so find it by
+// walking the document along with the type
+func findUnknownJSONField(data []byte, t reflect.Type) (string, string, bool) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if t == nil || dec.Decode(&doc) != nil {
+		return "", "", false
+	}
+	return findUnknownField("", doc, t)
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+func findUnknownField(ptr string, doc interface{}, t reflect.Type) (string, string, bool) {
+	for {
+		if t.Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+			return "", "", false
+		}
+		if t.Kind() != reflect.Ptr {
+			break
+		}
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			break
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(obj) {
+			key_ptr := ptr + "/" + escapeJSONPointer(key)
+			field := lookupJSONField(fields, key)
+			if field == nil {
+				return key_ptr, key, true
+			}
+			if p, k, ok := findUnknownField(key_ptr, obj[key], field.typ); ok {
+				return p, k, true
+			}
+		}
+	case reflect.Map:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, key := range sortedKeys(obj) {
+			key_ptr := ptr + "/" + escapeJSONPointer(key)
+			if p, k, ok := findUnknownField(key_ptr, obj[key], t.Elem()); ok {
+				return p, k, true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := doc.([]interface{})
+		if !ok {
+			break
+		}
+		for i, item := range list {
+			if p, k, ok := findUnknownField(ptr+"/"+strconv.Itoa(i), item, t.Elem()); ok {
+				return p, k, true
+			}
+		}
+	}
+	return "", "", false
+}
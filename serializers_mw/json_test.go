@@ -0,0 +1,105 @@
+package serializers_mw
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestJSONDecodeErrors(t *testing.T) {
+	type item struct {
+		Name string `json:"name"`
+	}
+	type doc struct {
+		Items []item `json:"items"`
+		Count int    `json:"count"`
+	}
+
+	tests := []struct {
+		body string
+		opts *JSONDecodeOpts
+		ptr  string
+		err  string
+	}{
+		{`{"items":[{"name":1}]}`, nil, "/items/0/name", "expected a string, not number"},
+		{`{"items":[{"nope":1}]}`, &JSONDecodeOpts{DisallowUnknownFields: true}, "/items/0/nope", `unknown field "nope"`},
+		{`{"items":[[]]}`, &JSONDecodeOpts{MaxDepth: 2}, "/items/0", "nested more than 2 levels deep"},
+		{`{"items":[{"name":"[[["}],"count":1}`, &JSONDecodeOpts{MaxDepth: 3}, "", ""},
+		{`{"count":1} {}`, &JSONDecodeOpts{DisallowTrailingData: true}, "", "unexpected data after the top-level value"},
+		{``, nil, "", "the body is empty"},
+	}
+
+	for _, test := range tests {
+		err := _jsonSerializer.DeserializeWithJSONOpts(strings.NewReader(test.body), test.opts, &doc{})
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.body, err)
+			}
+			continue
+		}
+		decode_err, ok := err.(*JSONDecodeError)
+		if !ok {
+			t.Errorf("%s: got %#v, want a *JSONDecodeError", test.body, err)
+			continue
+		}
+		if decode_err.Pointer != test.ptr || decode_err.Err.Error() != test.err {
+			t.Errorf("%s: got %q at %q, want %q at %q", test.body, decode_err.Err, decode_err.Pointer, test.err, test.ptr)
+		}
+	}
+}
+
+// Fails the test if more than limit bytes are read
+type limitCheckReader struct {
+	t      *testing.T
+	reader io.Reader
+	limit  int
+	read   int
+}
+
+func (self *limitCheckReader) Read(b []byte) (int, error) {
+	if len(b) > 16 {
+		b = b[:16]
+	}
+	n, err := self.reader.Read(b)
+	self.read += n
+	if self.read > self.limit {
+		self.t.Fatalf("read %d bytes, want no more than %d", self.read, self.limit)
+	}
+	return n, err
+}
+
+// The depth limit applies while reading, not after the whole body's read
+func TestJSONMaxDepthStreams(t *testing.T) {
+	r := &limitCheckReader{
+		t:      t,
+		reader: strings.NewReader(strings.Repeat("[", 1<<20)),
+		limit:  64,
+	}
+	var v interface{}
+	err := _jsonSerializer.DeserializeWithJSONOpts(r, &JSONDecodeOpts{MaxDepth: 4}, &v)
+	decode_err, ok := err.(*JSONDecodeError)
+	if !ok {
+		t.Fatalf("got %#v, want a *JSONDecodeError", err)
+	}
+	if decode_err.Pointer != "/0/0/0/0" {
+		t.Errorf("got pointer %q, want %q", decode_err.Pointer, "/0/0/0/0")
+	}
+}
+
+func TestJSONReadErrors(t *testing.T) {
+	read_err := errors.New("body too large")
+	r := io.MultiReader(strings.NewReader(`{"a":`), &errReader{read_err})
+	var v interface{}
+	if err := _jsonSerializer.DeserializeFromReader(r, &v); err != read_err {
+		t.Errorf("got %#v, want the read error", err)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (self *errReader) Read([]byte) (int, error) {
+	return 0, self.err
+}
@@ -0,0 +1,369 @@
+package serializers_mw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tilteng/go-api-framework/api_router"
+
+	"bitbucket.org/ww/goautoneg"
+)
+
+type contextKey struct {
+	name string
+}
+
+func (self *contextKey) String() string {
+	return "serializers_mw context value " + self.name
+}
+
+type ErrorHandler func(context.Context, error)
+
+func (self ErrorHandler) Error(ctx context.Context, err error) {
+	self(ctx, err)
+}
+
+// Passed to the ErrorHandler when Content-Type doesn't match any media
+// type we consume
+type UnsupportedMediaTypeError struct {
+	MediaType string
+}
+
+func (self *UnsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("No support for Content-Type media type: %s", self.MediaType)
+}
+
+// Passed to the ErrorHandler when Accept: doesn't match any media type
+// we produce
+type NotAcceptableError struct {
+	Accept string
+}
+
+func (self *NotAcceptableError) Error() string {
+	return fmt.Sprintf("No support for Accept media type(s): %s", self.Accept)
+}
+
+type SerializerMiddleware struct {
+	consumes     []string
+	produces     []string
+	serializers  map[string]Serializer
+	errorHandler ErrorHandler
+}
+
+// Add a serializer for this middleware only. It takes precedence over
+// one registered with RegisterSerializer() for the same media type.
+func (self *SerializerMiddleware) AddSerializer(serializer Serializer) *SerializerMiddleware {
+	if serializer == nil {
+		panic("serializer must not be nil")
+	}
+	mime_type := baseMediaType(serializer.GetMimeType())
+	if mime_type == "" {
+		panic("serializer must have a mime type")
+	}
+	self.serializers[mime_type] = serializer
+	return self
+}
+
+func (self *SerializerMiddleware) getSerializer(mime_type string) Serializer {
+	if serializer, ok := self.serializers[baseMediaType(mime_type)]; ok {
+		return serializer
+	}
+	return GetSerializer(mime_type)
+}
+
+// Make sure every media type we consume and produce is valid and has a
+// serializer.
+func (self *SerializerMiddleware) Check() error {
+	if len(self.consumes) == 0 || len(self.produces) == 0 {
+		return errors.New("Serializer middleware must consume and produce at least one media type")
+	}
+	for _, types := range [][]string{self.consumes, self.produces} {
+		for _, s := range types {
+			if _, err := parseMediaType(s); err != nil {
+				return fmt.Errorf("Invalid media type '%s': %s", s, err)
+			}
+			if self.getSerializer(s) == nil {
+				return fmt.Errorf("No serializer registered for media type '%s'", s)
+			}
+		}
+	}
+	for _, s := range self.consumes {
+		if _, ok := self.getSerializer(s).(responseOnlySerializer); ok {
+			return fmt.Errorf("Media type '%s' can only be produced, not consumed", s)
+		}
+	}
+	for _, s := range self.produces {
+		if _, ok := self.getSerializer(s).(requestOnlySerializer); ok {
+			return fmt.Errorf("Media type '%s' can only be consumed, not produced", s)
+		}
+	}
+	return nil
+}
+
+func (self *SerializerMiddleware) NewWrapper() *SerializerWrapper {
+	consumes, err := parseMediaTypes(self.consumes)
+	if err != nil {
+		panic(err)
+	}
+	produces, err := parseMediaTypes(self.produces)
+	if err != nil {
+		panic(err)
+	}
+	return &SerializerWrapper{
+		middleware:   self,
+		consumes:     consumes,
+		produces:     produces,
+		errorHandler: self.errorHandler,
+	}
+}
+
+type SerializerWrapper struct {
+	middleware   *SerializerMiddleware
+	consumes     []*mediaType
+	produces     []*mediaType
+	errorHandler ErrorHandler
+}
+
+var requestContextCtxKey = &contextKey{"requestContext"}
+var jsonDecodeOptsCtxKey = &contextKey{"jsonDecodeOpts"}
+
+// Decode JSON request bodies with opts. This needs to be set on the
+// context before the serializer middleware runs.
+func ContextWithJSONDecodeOpts(ctx context.Context, opts *JSONDecodeOpts) context.Context {
+	return context.WithValue(ctx, jsonDecodeOptsCtxKey, opts)
+}
+
+// Returns the matching media type we consume along with the header's
+// parameters
+func (self *SerializerWrapper) matchContentType(ctype_hdr string) (*mediaType, map[string]string) {
+	ctype, err := parseMediaType(ctype_hdr)
+	if err != nil {
+		return nil, nil
+	}
+	for _, consume_type := range self.consumes {
+		if ctype.base == consume_type.base && consume_type.paramsMatch(ctype.params) {
+			return consume_type, ctype.params
+		}
+	}
+	return nil, nil
+}
+
+func acceptSpecificity(clause goautoneg.Accept) int {
+	switch {
+	case clause.Type == "*":
+		return 0
+	case clause.SubType == "*":
+		return 1
+	}
+	return 2
+}
+
+// goautoneg.ParseAccept() can order a more specific type ahead of one
+// with a higher q value, so sort again: highest q first, then most
+// specific.
+func parseAccept(accept string) []goautoneg.Accept {
+	clauses := goautoneg.ParseAccept(accept)
+	sort.SliceStable(clauses, func(i, j int) bool {
+		if clauses[i].Q != clauses[j].Q {
+			return clauses[i].Q > clauses[j].Q
+		}
+		return acceptSpecificity(clauses[i]) > acceptSpecificity(clauses[j])
+	})
+	return clauses
+}
+
+// Like goautoneg.Negotiate(), but parameters on both sides must agree.
+// Vendor media types with a structured syntax suffix (RFC 6839) also
+// match their suffix type. Ie, application/vnd.app+json;version=2 is
+// served by application/json, unless we produce that vendor type
+// itself. A clause with q=0 means "not acceptable": it never matches,
+// and a type it names can't be matched by a wildcard either.
+func (self *SerializerWrapper) negotiateAccept(accept string) *mediaType {
+	clauses := parseAccept(accept)
+	rejected := map[string]bool{}
+	for _, clause := range clauses {
+		if clause.Q <= 0 {
+			rejected[strings.ToLower(clause.Type+"/"+clause.SubType)] = true
+		}
+	}
+	for _, clause := range clauses {
+		if clause.Q <= 0 {
+			continue
+		}
+		c_type := strings.ToLower(clause.Type)
+		c_subtype := strings.ToLower(clause.SubType)
+		c_suffix := ""
+		if idx := strings.LastIndex(c_subtype, "+"); idx != -1 {
+			c_suffix = c_subtype[idx+1:]
+		}
+
+		var suffix_match *mediaType
+		for _, produce_type := range self.produces {
+			if rejected[produce_type.base] {
+				continue
+			}
+			parts := strings.SplitN(produce_type.base, "/", 2)
+			suffix_only := false
+			switch {
+			case c_type == "*" && c_subtype == "*":
+			case c_type != parts[0]:
+				continue
+			case c_subtype == "*", c_subtype == parts[1]:
+			case c_suffix != "" && c_suffix == parts[1]:
+				suffix_only = true
+			default:
+				continue
+			}
+
+			params_ok := true
+			for k, v := range clause.Params {
+				if pv, ok := produce_type.params[k]; ok && pv != v {
+					params_ok = false
+					break
+				}
+			}
+			if !params_ok {
+				continue
+			}
+			if !suffix_only {
+				return produce_type
+			}
+			if suffix_match == nil {
+				suffix_match = produce_type
+			}
+		}
+		if suffix_match != nil {
+			return suffix_match
+		}
+	}
+	return nil
+}
+
+func (self *SerializerWrapper) newRequestContext(ctx context.Context, rctx *api_router.RequestContext) (*requestContext, error) {
+	var ctype *mediaType
+	var ctype_params map[string]string
+
+	if ctype_hdr := rctx.Header("Content-Type"); ctype_hdr == "" {
+		ctype = self.consumes[0]
+		ctype_params = ctype.params
+	} else if ctype, ctype_params = self.matchContentType(ctype_hdr); ctype == nil {
+		return nil, &UnsupportedMediaTypeError{MediaType: ctype_hdr}
+	}
+
+	var atype *mediaType
+
+	if accept := rctx.Header("Accept"); accept == "" {
+		atype = self.produces[0]
+	} else if atype = self.negotiateAccept(accept); atype == nil {
+		return nil, &NotAcceptableError{Accept: accept}
+	}
+
+	json_opts, _ := ctx.Value(jsonDecodeOptsCtxKey).(*JSONDecodeOpts)
+
+	deserializer := self.middleware.getSerializer(ctype.base)
+	serializer := self.middleware.getSerializer(atype.base)
+	if deserializer == nil || serializer == nil {
+		return nil, fmt.Errorf(
+			"No serializer registered for media type '%s' or '%s'",
+			ctype.base,
+			atype.base,
+		)
+	}
+
+	return &requestContext{
+		rctx:              rctx,
+		deserializer:      deserializer,
+		serializer:        serializer,
+		contentTypeParams: ctype_params,
+		contentType:       atype.full,
+		jsonDecodeOpts:    json_opts,
+	}, nil
+}
+
+func (self *SerializerWrapper) SetErrorHandler(error_handler ErrorHandler) *SerializerWrapper {
+	self.errorHandler = error_handler
+	return self
+}
+
+func (self *SerializerWrapper) Wrap(next api_router.RouteFn) api_router.RouteFn {
+	return func(ctx context.Context) {
+		rctx := api_router.RequestContextFromContext(ctx)
+		mw_rctx, err := self.newRequestContext(ctx, rctx)
+		if err != nil {
+			if self.errorHandler == nil {
+				panic(err)
+			}
+			self.errorHandler.Error(ctx, err)
+			return
+		}
+		// Remove anything left over from reading the body, like temp
+		// files for uploads
+		defer mw_rctx.cleanup()
+		ctx = context.WithValue(ctx, requestContextCtxKey, mw_rctx)
+		rctx = rctx.WithContext(ctx)
+		next(ctx)
+	}
+}
+
+func NewMiddleware(consumes, produces []string, error_handler ErrorHandler) *SerializerMiddleware {
+	return &SerializerMiddleware{
+		consumes:     consumes,
+		produces:     produces,
+		serializers:  map[string]Serializer{},
+		errorHandler: error_handler,
+	}
+}
+
+func RequestContextFromContext(ctx context.Context) RequestContext {
+	mw_rctx, _ := ctx.Value(requestContextCtxKey).(*requestContext)
+	return mw_rctx
+}
+
+func WriteSerializedResponse(ctx context.Context, v interface{}) error {
+	mw_rctx, ok := ctx.Value(requestContextCtxKey).(*requestContext)
+	if !ok {
+		return errors.New("Request did not pass through serializers middleware")
+	}
+	return mw_rctx.WriteSerializedResponse(ctx, v)
+}
+
+func ReadDeserializedBody(ctx context.Context, v interface{}) error {
+	mw_rctx, ok := ctx.Value(requestContextCtxKey).(*requestContext)
+	if !ok {
+		return errors.New("Request did not pass through serializers middleware")
+	}
+	return mw_rctx.ReadDeserializedBody(ctx, v)
+}
+
+// The fields of a form request body that aren't files. The body is
+// parsed as ReadDeserializedBody() would, with uploaded files kept in
+// memory or temp files, and kept for it. ok is false if the body isn't
+// a form.
+func ReadFormValues(ctx context.Context) (values map[string][]string, ok bool, err error) {
+	mw_rctx, ok := ctx.Value(requestContextCtxKey).(*requestContext)
+	if !ok {
+		return nil, false, errors.New("Request did not pass through serializers middleware")
+	}
+	if _, ok := mw_rctx.deserializer.(formDeserializer); !ok {
+		return nil, false, nil
+	}
+	form, err := mw_rctx.readForm()
+	if err != nil {
+		return nil, true, err
+	}
+	return form.values, true, nil
+}
+
+// Deserialize bytes with the request's deserializer, like for a body
+// that's already been read.
+func DeserializeBody(ctx context.Context, body []byte, v interface{}) error {
+	mw_rctx, ok := ctx.Value(requestContextCtxKey).(*requestContext)
+	if !ok {
+		return errors.New("Request did not pass through serializers middleware")
+	}
+	return mw_rctx.deserialize(bytes.NewReader(body), v)
+}
@@ -0,0 +1,36 @@
+package serializers_mw
+
+import "testing"
+
+func TestNegotiateAccept(t *testing.T) {
+	wrapper := (&SerializerMiddleware{
+		consumes: []string{"application/json"},
+		produces: []string{"application/json", "application/msgpack"},
+	}).NewWrapper()
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"application/msgpack", "application/msgpack"},
+		{"application/json;q=0.5, application/msgpack", "application/msgpack"},
+		{"application/vnd.api+json", "application/json"},
+		{"*/*", "application/json"},
+		{"application/json;q=0", ""},
+		{"application/msgpack;q=0, application/json;q=0.1", "application/json"},
+		{"*/*;q=0", ""},
+		{"*/*, application/json;q=0", "application/msgpack"},
+		{"application/*, application/json;q=0.0", "application/msgpack"},
+		{"text/html", ""},
+	}
+
+	for _, test := range tests {
+		got := ""
+		if mt := wrapper.negotiateAccept(test.accept); mt != nil {
+			got = mt.base
+		}
+		if got != test.want {
+			t.Errorf("Accept: %s negotiated %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package serializers_mw
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// MessagePack (https://msgpack.org) serializer, using
+// github.com/vmihailenco/msgpack/v4. Struct fields are named and omitted
+// according to their `json` tags, so the same types work with either
+// serializer. A `msgpack` tag takes precedence, and a type can encode
+// itself by implementing msgpack.Marshaler and msgpack.Unmarshaler.
+// Unlike encoding/json, a field can't shadow one of the same name in an
+// embedded struct. json.RawMessage and json.Number are encoded as the
+// values they hold, so pre-rendered JSON looks the same in either format.
+
+var _msgpackSerializer = msgpackSerializer{mimeType: "application/msgpack"}
+var _xMsgpackSerializer = msgpackSerializer{mimeType: "application/x-msgpack"}
+
+type msgpackSerializer struct {
+	mimeType string
+}
+
+func (self msgpackSerializer) GetMimeType() string {
+	return self.mimeType
+}
+
+func (self msgpackSerializer) Serialize(v interface{}) ([]byte, error) {
+	return MsgpackMarshal(v)
+}
+
+func (self msgpackSerializer) SerializeToWriter(w io.Writer, v interface{}) error {
+	return newMsgpackEncoder(w).Encode(v)
+}
+
+func (self msgpackSerializer) Deserialize(data []byte, v interface{}) error {
+	return MsgpackUnmarshal(data, v)
+}
+
+func (self msgpackSerializer) DeserializeFromReader(r io.Reader, v interface{}) error {
+	return newMsgpackDecoder(r).Decode(v)
+}
+
+func init() {
+	msgpack.Register(json.RawMessage{}, encodeJSONRawMessage, decodeJSONRawMessage)
+	msgpack.Register(json.Number(""), encodeJSONNumber, nil)
+}
+
+func encodeJSONRawMessage(enc *msgpack.Encoder, v reflect.Value) error {
+	raw := v.Bytes()
+	if len(raw) == 0 {
+		return enc.EncodeNil()
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return err
+	}
+	return enc.Encode(generic)
+}
+
+func decodeJSONRawMessage(dec *msgpack.Decoder, v reflect.Value) error {
+	generic, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	v.SetBytes(raw)
+	return nil
+}
+
+// Integers stay integers, rather than becoming float64
+func encodeJSONNumber(enc *msgpack.Encoder, v reflect.Value) error {
+	num := json.Number(v.String())
+	if i, err := num.Int64(); err == nil {
+		return enc.EncodeInt(i)
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return err
+	}
+	return enc.EncodeFloat64(f)
+}
+
+func newMsgpackEncoder(w io.Writer) *msgpack.Encoder {
+	return msgpack.NewEncoder(w).UseJSONTag(true).UseCompactEncoding(true)
+}
+
+// Maps decode as map[string]interface{} and numbers as int64, uint64,
+// or float64, like they would from JSON
+func newMsgpackDecoder(r io.Reader) *msgpack.Decoder {
+	return msgpack.NewDecoder(r).UseJSONTag(true).UseDecodeInterfaceLoose(true)
+}
+
+func MsgpackMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := newMsgpackEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func MsgpackUnmarshal(data []byte, v interface{}) error {
+	return newMsgpackDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,158 @@
+package serializers_mw
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type msgpackTestInner struct {
+	Name string `json:"name"`
+}
+
+type msgpackTestOuter struct {
+	msgpackTestInner
+	Id       string            `json:"id"`
+	Tags     []string          `json:"tags"`
+	Attrs    map[string]int    `json:"attrs"`
+	Optional *float64          `json:"optional,omitempty"`
+	Skipped  string            `json:"-"`
+	Renamed  string            `json:"json_name" msgpack:"msgpack_name"`
+	Extra    map[string]string `json:"extra,omitempty"`
+}
+
+func TestMsgpackJSONTags(t *testing.T) {
+	b, err := MsgpackMarshal(&msgpackTestOuter{
+		msgpackTestInner: msgpackTestInner{Name: "Sparky"},
+		Id:               "abc",
+		Tags:             []string{"a"},
+		Skipped:          "no",
+		Renamed:          "yes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic interface{}
+	if err := MsgpackUnmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"name":         "Sparky",
+		"id":           "abc",
+		"tags":         []interface{}{"a"},
+		"attrs":        nil,
+		"msgpack_name": "yes",
+	}
+	if !reflect.DeepEqual(generic, want) {
+		t.Errorf("encoded %#v, want %#v", generic, want)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	half := 0.5
+	v := &msgpackTestOuter{
+		msgpackTestInner: msgpackTestInner{Name: "Sparky"},
+		Id:               "abc",
+		Tags:             []string{"a", "b"},
+		Attrs:            map[string]int{"x": 1},
+		Optional:         &half,
+		Renamed:          "yes",
+		Extra:            map[string]string{"color": "black"},
+	}
+
+	var buf bytes.Buffer
+	if err := _msgpackSerializer.SerializeToWriter(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	got := &msgpackTestOuter{}
+	if err := _msgpackSerializer.DeserializeFromReader(&buf, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Errorf("decoded %+v, want %+v", got, v)
+	}
+}
+
+// Decoded like JSON would be, so bodies read into interface{} can be
+// handled the same way
+func TestMsgpackGenericTypes(t *testing.T) {
+	b, err := MsgpackMarshal(map[string]interface{}{
+		"int":   int8(-3),
+		"uint":  uint64(1) << 63,
+		"float": float32(1.5),
+		"list":  []int{1},
+		"map":   map[string]bool{"ok": true},
+		"nil":   nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic interface{}
+	if err := MsgpackUnmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"int":   int64(-3),
+		"uint":  uint64(1) << 63,
+		"float": float64(1.5),
+		"list":  []interface{}{int64(1)},
+		"map":   map[string]interface{}{"ok": true},
+		"nil":   nil,
+	}
+	if !reflect.DeepEqual(generic, want) {
+		t.Errorf("decoded %#v, want %#v", generic, want)
+	}
+}
+
+func TestMsgpackCompactIntegers(t *testing.T) {
+	b, err := MsgpackMarshal(int64(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{0x05}) {
+		t.Errorf("encoded as % x, want a positive fixint", b)
+	}
+}
+
+type msgpackTestRaw struct {
+	Attrs map[string]json.RawMessage `json:"attrs"`
+	Data  json.RawMessage            `json:"data"`
+}
+
+// Pre-rendered JSON is encoded as the values it holds, not as bytes
+func TestMsgpackJSONRawMessage(t *testing.T) {
+	v := &msgpackTestRaw{
+		Attrs: map[string]json.RawMessage{
+			"name": json.RawMessage(`"Mo"`),
+			"age":  json.RawMessage(`3`),
+		},
+		Data: json.RawMessage(`{"weight":4.5,"tags":["a"]}`),
+	}
+	b, err := MsgpackMarshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic interface{}
+	if err := MsgpackUnmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"attrs": map[string]interface{}{"name": "Mo", "age": int64(3)},
+		"data": map[string]interface{}{
+			"weight": float64(4.5),
+			"tags":   []interface{}{"a"},
+		},
+	}
+	if !reflect.DeepEqual(generic, want) {
+		t.Errorf("encoded %#v, want %#v", generic, want)
+	}
+
+	got := &msgpackTestRaw{}
+	if err := MsgpackUnmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Attrs["name"]) != `"Mo"` || string(got.Data) != `{"tags":["a"],"weight":4.5}` {
+		t.Errorf("decoded %s and %s", got.Attrs["name"], got.Data)
+	}
+}
@@ -0,0 +1,104 @@
+package serializers_mw
+
+import (
+	"mime"
+	"strings"
+	"sync"
+)
+
+var serializersLock sync.RWMutex
+
+var serializers = map[string]Serializer{
+	"application/json":                  _jsonSerializer,
+	"application/msgpack":               _msgpackSerializer,
+	"application/x-msgpack":             _xMsgpackSerializer,
+	"application/x-www-form-urlencoded": _formSerializer,
+	"multipart/form-data":               _multipartFormSerializer,
+	"application/x-ndjson":              _ndjsonSerializer,
+	"text/event-stream":                 _eventStreamSerializer,
+}
+
+// Register a serializer for its GetMimeType(), making it available to
+// every middleware. This replaces any serializer already registered for
+// the same media type.
+func RegisterSerializer(serializer Serializer) {
+	if serializer == nil {
+		panic("serializer must not be nil")
+	}
+	mime_type := baseMediaType(serializer.GetMimeType())
+	if mime_type == "" {
+		panic("serializer must have a mime type")
+	}
+	serializersLock.Lock()
+	defer serializersLock.Unlock()
+	serializers[mime_type] = serializer
+}
+
+// Returns the registered serializer for a media type. Parameters are
+// ignored.
+func GetSerializer(mime_type string) Serializer {
+	serializersLock.RLock()
+	defer serializersLock.RUnlock()
+	return serializers[baseMediaType(mime_type)]
+}
+
+// Media types with registered serializers
+func RegisteredMediaTypes() []string {
+	serializersLock.RLock()
+	defer serializersLock.RUnlock()
+	types := make([]string, 0, len(serializers))
+	for mime_type := range serializers {
+		types = append(types, mime_type)
+	}
+	return types
+}
+
+type mediaType struct {
+	// As configured, including any parameters
+	full   string
+	base   string
+	params map[string]string
+}
+
+func baseMediaType(s string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(s, ";", 2)[0]))
+}
+
+func parseMediaType(s string) (*mediaType, error) {
+	base, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return nil, err
+	}
+	return &mediaType{full: s, base: base, params: params}, nil
+}
+
+func parseMediaTypes(types []string) ([]*mediaType, error) {
+	parsed := make([]*mediaType, len(types))
+	for i, s := range types {
+		mt, err := parseMediaType(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = mt
+	}
+	return parsed, nil
+}
+
+// Parameters we've been configured with must be present with the same
+// value. Others are ignored. charset values are case-insensitive.
+func (self *mediaType) paramsMatch(params map[string]string) bool {
+	for k, v := range self.params {
+		other, ok := params[k]
+		if !ok {
+			return false
+		}
+		if k == "charset" {
+			if !strings.EqualFold(v, other) {
+				return false
+			}
+		} else if v != other {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package serializers_mw
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/tilteng/go-api-framework/api_router"
+)
+
+type Serializer interface {
+	GetMimeType() string
+	Deserialize([]byte, interface{}) error
+	DeserializeFromReader(io.Reader, interface{}) error
+	Serialize(interface{}) ([]byte, error)
+	SerializeToWriter(io.Writer, interface{}) error
+}
+
+// Implemented by deserializers that need the Content-Type parameters,
+// like the multipart boundary. This is used in place of
+// DeserializeFromReader() when available. The returned function, if not
+// nil, is called to clean up (eg, remove temp files) once the request
+// is finished.
+type ParamsDeserializer interface {
+	DeserializeWithParams(io.Reader, map[string]string, interface{}) (func(), error)
+}
+
+type RequestContext interface {
+	WriteSerializedResponse(context.Context, interface{}) error
+	ReadDeserializedBody(context.Context, interface{}) error
+	// Whether the request has no body, putting back what's read to find
+	// out. Form bodies are never empty, as an empty form decodes fine.
+	IsBodyEmpty() bool
+	// The response media type negotiated from Accept:
+	ContentType() string
+}
+
+type requestContext struct {
+	rctx         *api_router.RequestContext
+	deserializer Serializer
+	serializer   Serializer
+	// Parameters from Content-Type:
+	contentTypeParams map[string]string
+	// Negotiated from Accept:
+	contentType string
+	// From ContextWithJSONDecodeOpts()
+	jsonDecodeOpts *JSONDecodeOpts
+	cleanups       []func()
+	// A form body, once it's been parsed
+	form    *formData
+	formErr error
+}
+
+func (self *requestContext) WriteSerializedResponse(_ context.Context, v interface{}) error {
+	if hdrs := self.rctx.ResponseWriter().Header(); hdrs.Get("Content-Type") == "" {
+		hdrs.Set("Content-Type", self.contentType)
+	}
+	self.rctx.WriteStatusHeader()
+	return self.serializer.SerializeToWriter(
+		self.rctx.ResponseWriter(),
+		v,
+	)
+}
+
+func (self *requestContext) ContentType() string {
+	return self.contentType
+}
+
+func (self *requestContext) ReadDeserializedBody(_ context.Context, v interface{}) error {
+	if _, ok := self.deserializer.(formDeserializer); ok {
+		form, err := self.readForm()
+		if err != nil {
+			return err
+		}
+		return decodeForm(form, v)
+	}
+	return self.deserialize(self.rctx.Body(), v)
+}
+
+func (self *requestContext) IsBodyEmpty() bool {
+	// The form may already be parsed, leaving nothing to read
+	if _, ok := self.deserializer.(formDeserializer); ok {
+		return false
+	}
+	body := self.rctx.Body()
+	if body == nil {
+		return true
+	}
+	var buf [1]byte
+	n, err := io.ReadFull(body, buf[:])
+	if n == 0 && err == io.EOF {
+		return true
+	}
+	self.rctx.SetBody(&peekedBody{
+		Reader: io.MultiReader(bytes.NewReader(buf[:n]), body),
+		Closer: body,
+	})
+	return false
+}
+
+// The body, with what IsBodyEmpty() read put back
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Parses a form body the first time, so uploads are only read once
+func (self *requestContext) readForm() (*formData, error) {
+	if self.form == nil && self.formErr == nil {
+		fd := self.deserializer.(formDeserializer)
+		self.form, self.formErr = fd.readFormData(self.rctx.Body(), self.contentTypeParams)
+		if self.form != nil {
+			self.cleanups = append(self.cleanups, self.form.cleanup)
+		}
+	}
+	return self.form, self.formErr
+}
+
+func (self *requestContext) deserialize(r io.Reader, v interface{}) error {
+	if self.jsonDecodeOpts != nil {
+		if jd, ok := self.deserializer.(JSONOptsDeserializer); ok {
+			return jd.DeserializeWithJSONOpts(r, self.jsonDecodeOpts, v)
+		}
+	}
+	pd, ok := self.deserializer.(ParamsDeserializer)
+	if !ok {
+		return self.deserializer.DeserializeFromReader(r, v)
+	}
+	cleanup, err := pd.DeserializeWithParams(r, self.contentTypeParams, v)
+	if cleanup != nil {
+		self.cleanups = append(self.cleanups, cleanup)
+	}
+	return err
+}
+
+func (self *requestContext) cleanup() {
+	for _, cleanup := range self.cleanups {
+		cleanup()
+	}
+	self.cleanups = nil
+}
@@ -0,0 +1,196 @@
+package serializers_mw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Serializers for streaming media types. A slice or array is written as
+// one NDJSON record or one server-sent event per element. Anything else
+// is written as a single record or event.
+
+var _ndjsonSerializer = ndjsonSerializer{}
+var _eventStreamSerializer = eventStreamSerializer{}
+
+// Serializers that can only be used for responses
+type responseOnlySerializer interface {
+	responseOnly()
+}
+
+func eachElement(v interface{}, fn func(interface{}) error) error {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte is a single value
+			break
+		}
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := fn(rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fn(v)
+}
+
+// application/x-ndjson: one JSON value per line
+
+type ndjsonSerializer struct{}
+
+func (self ndjsonSerializer) GetMimeType() string {
+	return "application/x-ndjson"
+}
+
+func (self ndjsonSerializer) Serialize(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := self.SerializeToWriter(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (self ndjsonSerializer) SerializeToWriter(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	return eachElement(v, func(elem interface{}) error {
+		return enc.Encode(elem)
+	})
+}
+
+func (self ndjsonSerializer) Deserialize(data []byte, v interface{}) error {
+	return self.DeserializeFromReader(bytes.NewReader(data), v)
+}
+
+// Records are decoded as elements of a JSON array
+func (self ndjsonSerializer) DeserializeFromReader(r io.Reader, v interface{}) error {
+	var records []json.RawMessage
+	dec := json.NewDecoder(r)
+	for {
+		var record json.RawMessage
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	if records == nil {
+		records = []json.RawMessage{}
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// text/event-stream: server-sent events
+
+// A server-sent event. Empty fields are left out.
+type ServerSentEvent struct {
+	ID    string
+	Event string
+	// How long the client should wait before reconnecting
+	Retry time.Duration
+	// Strings and []byte are sent as is. Anything else is sent as JSON.
+	Data interface{}
+}
+
+// Writes the event in text/event-stream format
+func (self *ServerSentEvent) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	if self.ID != "" {
+		buf.WriteString("id: " + sseFieldValue(self.ID) + "\n")
+	}
+	if self.Event != "" {
+		buf.WriteString("event: " + sseFieldValue(self.Event) + "\n")
+	}
+	if self.Retry > 0 {
+		buf.WriteString("retry: " + strconv.FormatInt(int64(self.Retry/time.Millisecond), 10) + "\n")
+	}
+
+	var data []byte
+	switch d := self.Data.(type) {
+	case nil:
+	case string:
+		data = []byte(d)
+	case []byte:
+		data = d
+	default:
+		var err error
+		if data, err = json.Marshal(d); err != nil {
+			return 0, err
+		}
+	}
+	if data != nil {
+		// Each line of data needs its own field
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			buf.WriteString("data: ")
+			buf.Write(scanner.Bytes())
+			buf.WriteByte('\n')
+		}
+		if len(data) == 0 {
+			buf.WriteString("data\n")
+		}
+	}
+
+	buf.WriteByte('\n')
+	return buf.WriteTo(w)
+}
+
+// Field values can't span lines
+func sseFieldValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+type eventStreamSerializer struct{}
+
+func (self eventStreamSerializer) responseOnly() {}
+
+func (self eventStreamSerializer) GetMimeType() string {
+	return "text/event-stream"
+}
+
+func (self eventStreamSerializer) Serialize(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := self.SerializeToWriter(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// *ServerSentEvent values are written as they are. Anything else is
+// sent as an event's data.
+func (self eventStreamSerializer) SerializeToWriter(w io.Writer, v interface{}) error {
+	return eachElement(v, func(elem interface{}) error {
+		event, ok := elem.(*ServerSentEvent)
+		if !ok {
+			event = &ServerSentEvent{Data: elem}
+		}
+		_, err := event.WriteTo(w)
+		return err
+	})
+}
+
+func (self eventStreamSerializer) Deserialize(data []byte, v interface{}) error {
+	return errors.New("text/event-stream is only supported for responses")
+}
+
+func (self eventStreamSerializer) DeserializeFromReader(r io.Reader, v interface{}) error {
+	return self.Deserialize(nil, v)
+}